@@ -0,0 +1,259 @@
+package blacklist
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"github.com/dist-ribut-us/docs/mixnetrouting/probe"
+	"github.com/dist-ribut-us/errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// ErrBadEntry is returned when unmarshaling a malformed Entry
+	ErrBadEntry errors.String = "Bad blacklist entry"
+	// ErrBadSignature is returned when gossip is not signed by its signer
+	ErrBadSignature errors.String = "Bad blacklist gossip signature"
+	// ErrUntrusted is returned when gossip is signed by an untrusted key
+	ErrUntrusted errors.String = "Blacklist gossip signer is not trusted"
+	// ErrExpired is returned when accepting gossip for an expired Entry
+	ErrExpired errors.String = "Blacklist entry has expired"
+)
+
+// Reason a node was blacklisted
+type Reason byte
+
+const (
+	// Other is a reason not covered below; the Evidence should explain it
+	Other Reason = iota
+	// Freeloading nodes accept messages but do not forward them. The Evidence
+	// is the marshaled probe.Stats.
+	Freeloading
+	// Tampering nodes modify the messages they forward
+	Tampering
+)
+
+// Entry is a blacklisted node. ID is the string form of the node ID used by
+// the onion, cyclic and path packages.
+type Entry struct {
+	ID       string
+	Reason   Reason
+	Evidence []byte
+	Added    time.Time
+	Expires  time.Time
+}
+
+// MaxEvidence is the longest Evidence that can be marshaled
+const MaxEvidence = 1<<16 - 1
+
+// Marshal an Entry as
+// Reason | Added | Expires | len(ID) | ID | len(Evidence) | Evidence
+// with 1 byte for the ID length and 2 for the Evidence length.
+func (e *Entry) Marshal() ([]byte, error) {
+	if len(e.ID) > 255 || len(e.Evidence) > MaxEvidence {
+		return nil, ErrBadEntry
+	}
+	b := make([]byte, 18, 20+len(e.ID)+len(e.Evidence))
+	b[0] = byte(e.Reason)
+	binary.BigEndian.PutUint64(b[1:], uint64(e.Added.Unix()))
+	binary.BigEndian.PutUint64(b[9:], uint64(e.Expires.Unix()))
+	b[17] = byte(len(e.ID))
+	b = append(b, e.ID...)
+	b = append(b, byte(len(e.Evidence)>>8), byte(len(e.Evidence)))
+	return append(b, e.Evidence...), nil
+}
+
+// UnmarshalEntry reverses Entry.Marshal
+func UnmarshalEntry(b []byte) (*Entry, error) {
+	if len(b) < 18 {
+		return nil, ErrBadEntry
+	}
+	e := &Entry{
+		Reason:  Reason(b[0]),
+		Added:   time.Unix(int64(binary.BigEndian.Uint64(b[1:])), 0),
+		Expires: time.Unix(int64(binary.BigEndian.Uint64(b[9:])), 0),
+	}
+	ln := int(b[17])
+	b = b[18:]
+	if len(b) < ln+2 {
+		return nil, ErrBadEntry
+	}
+	e.ID = string(b[:ln])
+	b = b[ln:]
+	ln = int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) != ln {
+		return nil, ErrBadEntry
+	}
+	if ln > 0 {
+		e.Evidence = append([]byte(nil), b...)
+	}
+	return e, nil
+}
+
+// List is a blacklist. It satisfies path.Blacklist, onion.Blacklist and
+// cyclic.Blacklist so the same List can be used when selecting hops and when
+// routing. Entries are blocked until they expire.
+type List struct {
+	// Now can be replaced for testing
+	Now     func() time.Time
+	mux     sync.RWMutex
+	entries map[string]*Entry
+}
+
+// New creates an empty List
+func New() *List {
+	return &List{
+		Now:     time.Now,
+		entries: make(map[string]*Entry),
+	}
+}
+
+// Add an Entry, replacing any entry for the same ID. If Added is not set it is
+// set to Now.
+func (l *List) Add(e *Entry) {
+	if e.Added.IsZero() {
+		e.Added = l.Now()
+	}
+	l.mux.Lock()
+	l.entries[e.ID] = e
+	l.mux.Unlock()
+}
+
+// Remove the Entry for an ID
+func (l *List) Remove(id string) {
+	l.mux.Lock()
+	delete(l.entries, id)
+	l.mux.Unlock()
+}
+
+// Entry returns the unexpired Entry for an ID or nil
+func (l *List) Entry(id string) *Entry {
+	l.mux.RLock()
+	e, ok := l.entries[id]
+	l.mux.RUnlock()
+	if !ok || !l.Now().Before(e.Expires) {
+		return nil
+	}
+	return e
+}
+
+// Blocked returns true if the ID has an unexpired Entry
+func (l *List) Blocked(id string) bool {
+	return l.Entry(id) != nil
+}
+
+// Expire removes expired entries
+func (l *List) Expire() {
+	now := l.Now()
+	l.mux.Lock()
+	for id, e := range l.entries {
+		if !now.Before(e.Expires) {
+			delete(l.entries, id)
+		}
+	}
+	l.mux.Unlock()
+}
+
+// Entries returns the unexpired entries sorted by ID
+func (l *List) Entries() []*Entry {
+	now := l.Now()
+	l.mux.RLock()
+	es := make([]*Entry, 0, len(l.entries))
+	for _, e := range l.entries {
+		if now.Before(e.Expires) {
+			es = append(es, e)
+		}
+	}
+	l.mux.RUnlock()
+	sort.Slice(es, func(i, j int) bool { return es[i].ID < es[j].ID })
+	return es
+}
+
+// Reporter returns a function for probe.Prober.OnFail that blacklists failed
+// nodes for ttl with the probe Stats as Evidence.
+func (l *List) Reporter(ttl time.Duration) func(string, probe.Stats) {
+	return func(id string, s probe.Stats) {
+		now := l.Now()
+		l.Add(&Entry{
+			ID:       id,
+			Reason:   Freeloading,
+			Evidence: MarshalStats(s),
+			Added:    now,
+			Expires:  now.Add(ttl),
+		})
+	}
+}
+
+// MarshalStats as Sent | Delivered | Lost, each 4 bytes
+func MarshalStats(s probe.Stats) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b, uint32(s.Sent))
+	binary.BigEndian.PutUint32(b[4:], uint32(s.Delivered))
+	binary.BigEndian.PutUint32(b[8:], uint32(s.Lost))
+	return b
+}
+
+// UnmarshalStats reverses MarshalStats
+func UnmarshalStats(b []byte) (probe.Stats, error) {
+	if len(b) != 12 {
+		return probe.Stats{}, ErrBadEntry
+	}
+	return probe.Stats{
+		Sent:      int(binary.BigEndian.Uint32(b)),
+		Delivered: int(binary.BigEndian.Uint32(b[4:])),
+		Lost:      int(binary.BigEndian.Uint32(b[8:])),
+	}, nil
+}
+
+// Sign an Entry to share it as gossip. The gossip is
+// Signer | Signature | Entry, where the signature covers the marshaled Entry.
+func Sign(e *Entry, key ed25519.PrivateKey) ([]byte, error) {
+	eb, err := e.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, ed25519.PublicKeySize+ed25519.SignatureSize+len(eb))
+	b = append(b, key.Public().(ed25519.PublicKey)...)
+	b = append(b, ed25519.Sign(key, eb)...)
+	return append(b, eb...), nil
+}
+
+// Open gossip created by Sign, returning the Entry and the key that signed it
+func Open(b []byte) (*Entry, ed25519.PublicKey, error) {
+	if len(b) < ed25519.PublicKeySize+ed25519.SignatureSize {
+		return nil, nil, ErrBadEntry
+	}
+	pub := ed25519.PublicKey(append([]byte(nil), b[:ed25519.PublicKeySize]...))
+	b = b[ed25519.PublicKeySize:]
+	sig, eb := b[:ed25519.SignatureSize], b[ed25519.SignatureSize:]
+	if !ed25519.Verify(pub, eb, sig) {
+		return nil, nil, ErrBadSignature
+	}
+	e, err := UnmarshalEntry(eb)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, pub, nil
+}
+
+// Accept gossip and add its Entry to the List if the signer is trusted and the
+// Entry has not expired. Gossip never replaces an entry that expires later.
+func (l *List) Accept(b []byte, trusted func(ed25519.PublicKey) bool) (*Entry, error) {
+	e, pub, err := Open(b)
+	if err != nil {
+		return nil, err
+	}
+	if !trusted(pub) {
+		return nil, ErrUntrusted
+	}
+	if !l.Now().Before(e.Expires) {
+		return nil, ErrExpired
+	}
+	if cur := l.Entry(e.ID); cur != nil && !e.Expires.After(cur.Expires) {
+		return cur, nil
+	}
+	l.Add(e)
+	return e, nil
+}
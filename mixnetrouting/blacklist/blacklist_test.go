@@ -0,0 +1,142 @@
+package blacklist
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/dist-ribut-us/docs/mixnetrouting/path"
+	"github.com/dist-ribut-us/docs/mixnetrouting/probe"
+	"github.com/dist-ribut-us/docs/mixnetrouting/sim"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	l := New()
+	now := time.Now()
+	l.Now = func() time.Time { return now }
+	l.Add(&Entry{ID: "a", Reason: Tampering, Expires: now.Add(time.Minute)})
+	l.Add(&Entry{ID: "b", Expires: now.Add(time.Hour)})
+	assert.True(t, l.Blocked("a"))
+	assert.False(t, l.Blocked("c"))
+	assert.Equal(t, now, l.Entry("a").Added)
+	assert.Len(t, l.Entries(), 2)
+
+	now = now.Add(time.Minute)
+	assert.False(t, l.Blocked("a"))
+	assert.True(t, l.Blocked("b"))
+	assert.Len(t, l.Entries(), 1)
+	l.Expire()
+	assert.Len(t, l.entries, 1)
+
+	l.Remove("b")
+	assert.False(t, l.Blocked("b"))
+}
+
+func TestMarshal(t *testing.T) {
+	e := &Entry{
+		ID:       "node",
+		Reason:   Freeloading,
+		Evidence: MarshalStats(probe.Stats{Sent: 12, Delivered: 1, Lost: 11}),
+		Added:    time.Unix(1000, 0),
+		Expires:  time.Unix(2000, 0),
+	}
+	b, err := e.Marshal()
+	assert.NoError(t, err)
+	got, err := UnmarshalEntry(b)
+	assert.NoError(t, err)
+	assert.Equal(t, e, got)
+	s, err := UnmarshalStats(got.Evidence)
+	assert.NoError(t, err)
+	assert.Equal(t, probe.Stats{Sent: 12, Delivered: 1, Lost: 11}, s)
+
+	_, err = UnmarshalEntry(b[:len(b)-1])
+	assert.Equal(t, ErrBadEntry, err)
+	_, err = UnmarshalEntry(b[:10])
+	assert.Equal(t, ErrBadEntry, err)
+	_, err = (&Entry{Evidence: make([]byte, MaxEvidence+1)}).Marshal()
+	assert.Equal(t, ErrBadEntry, err)
+}
+
+func TestGossip(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	trusted := func(k ed25519.PublicKey) bool { return k.Equal(pub) }
+	now := time.Now()
+	e := &Entry{ID: "node", Expires: now.Add(time.Hour)}
+
+	b, err := Sign(e, priv)
+	assert.NoError(t, err)
+	l := New()
+	got, err := l.Accept(b, trusted)
+	assert.NoError(t, err)
+	assert.Equal(t, "node", got.ID)
+	assert.True(t, l.Blocked("node"))
+
+	// an entry that expires sooner does not replace it
+	b, err = Sign(&Entry{ID: "node", Expires: now.Add(time.Minute)}, priv)
+	assert.NoError(t, err)
+	_, err = l.Accept(b, trusted)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(time.Hour).Unix(), l.Entry("node").Expires.Unix())
+
+	b, err = Sign(e, other)
+	assert.NoError(t, err)
+	_, err = l.Accept(b, trusted)
+	assert.Equal(t, ErrUntrusted, err)
+
+	b, err = Sign(e, priv)
+	assert.NoError(t, err)
+	b[len(b)-1] ^= 1
+	_, err = l.Accept(b, trusted)
+	assert.Equal(t, ErrBadSignature, err)
+
+	b, err = Sign(&Entry{ID: "old", Expires: now.Add(-time.Minute)}, priv)
+	assert.NoError(t, err)
+	_, err = l.Accept(b, trusted)
+	assert.Equal(t, ErrExpired, err)
+}
+
+func TestEnforce(t *testing.T) {
+	s, err := sim.New(20)
+	assert.NoError(t, err)
+	n, bad := s.Nodes[0], s.Nodes[5]
+	bad.Freeload = true
+
+	l := New()
+	p := probe.New(n.PrivNode, s.ProbeHops(n), n.Send)
+	p.OnFail = l.Reporter(time.Hour)
+	for i := 0; i < p.MinProbes; i++ {
+		assert.NoError(t, p.Probe(bad.Pub()))
+	}
+	p.Now = func() time.Time { return time.Now().Add(p.Timeout) }
+	p.Expire()
+	e := l.Entry(bad.String())
+	if assert.NotNil(t, e) {
+		assert.Equal(t, Freeloading, e.Reason)
+	}
+
+	// path selection skips the node
+	s.Selector = path.NewSelector(path.Blacklisted(l))
+	for i := 0; i < 20; i++ {
+		hops, err := s.Hops(n, 5)()
+		assert.NoError(t, err)
+		for _, h := range hops {
+			assert.NotEqual(t, bad.String(), h.String())
+		}
+	}
+
+	// and routing refuses traffic to and from it
+	n.Blacklist = l
+	rb := onion.NewSendRoute()
+	assert.NoError(t, rb.Push(bad.Pub()))
+	assert.NoError(t, rb.Push(n.Pub()))
+	rp := rb.Send([]byte("test"))
+	_, err = n.Deliver(&onion.RoutePackage{RouteMsg: rp.RouteMsg})
+	assert.Equal(t, onion.ErrBlocked{}, err)
+
+	rb = onion.NewSendRoute()
+	assert.NoError(t, rb.Push(n.Pub()))
+	assert.Equal(t, onion.ErrBlocked{}, bad.Send(rb.Send([]byte("test"))))
+}
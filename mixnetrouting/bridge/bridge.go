@@ -0,0 +1,296 @@
+package bridge
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/docs/mixnetrouting/dht"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/dist-ribut-us/errors"
+	"sync"
+	"time"
+)
+
+const (
+	// ErrBadDescriptor is returned when unmarshaling a malformed Descriptor
+	ErrBadDescriptor errors.String = "Bad bridge descriptor"
+	// ErrExpired is returned when publishing a Descriptor that has expired
+	ErrExpired errors.String = "Bridge descriptor has expired"
+	// ErrBadBatch is returned when unmarshaling a malformed batch
+	ErrBadBatch errors.String = "Bad batch"
+)
+
+const (
+	// DefaultMaxHold is how long a message is held before it is forwarded
+	// without waiting for other traffic.
+	DefaultMaxHold = 10 * time.Minute
+	// DefaultMaxHeld is the number of messages held for each peer
+	DefaultMaxHeld = 32
+)
+
+var encode = base64.URLEncoding.EncodeToString
+
+// Descriptor advertises a Garlic Bridge, a pair of nodes that communicate
+// openly. Other users can cross the bridge with low-urgency hops.
+type Descriptor struct {
+	A, B    *onion.PubNode
+	Expires time.Time
+}
+
+// Marshal a Descriptor as len(A) | A | len(B) | B | Expires, with 2 bytes for
+// each length.
+func (d *Descriptor) Marshal() []byte {
+	a, bn := d.A.Marshal(), d.B.Marshal()
+	b := make([]byte, 2, 12+len(a)+len(bn))
+	binary.BigEndian.PutUint16(b, uint16(len(a)))
+	b = append(b, a...)
+	b = append(b, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(bn)))
+	b = append(b, bn...)
+	exp := make([]byte, 8)
+	binary.BigEndian.PutUint64(exp, uint64(d.Expires.Unix()))
+	return append(b, exp...)
+}
+
+// unmarshalPubNode reads a length prefixed PubNode from the front of b
+func unmarshalPubNode(b []byte) (*onion.PubNode, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, ErrBadDescriptor
+	}
+	ln := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < ln {
+		return nil, nil, ErrBadDescriptor
+	}
+	n, err := onion.UnmarshalPubNode(b[:ln])
+	if err != nil {
+		return nil, nil, ErrBadDescriptor
+	}
+	return n, b[ln:], nil
+}
+
+// Unmarshal reverses Descriptor.Marshal
+func Unmarshal(b []byte) (*Descriptor, error) {
+	a, b, err := unmarshalPubNode(b)
+	if err != nil {
+		return nil, err
+	}
+	bn, b, err := unmarshalPubNode(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 8 {
+		return nil, ErrBadDescriptor
+	}
+	return &Descriptor{
+		A:       a,
+		B:       bn,
+		Expires: time.Unix(int64(binary.BigEndian.Uint64(b)), 0),
+	}, nil
+}
+
+// Reverse returns the Descriptor for crossing the bridge from B to A
+func (d *Descriptor) Reverse() *Descriptor {
+	return &Descriptor{
+		A:       d.B,
+		B:       d.A,
+		Expires: d.Expires,
+	}
+}
+
+// Push a crossing from A to B onto a route
+func (d *Descriptor) Push(rb *onion.RouteBuilder) error {
+	return rb.PushBridge(d.A, d.B)
+}
+
+// Key is the DHT key under which the bridges of a node are published
+func Key(id []byte) []byte {
+	return crypto.GetDigest([]byte("bridge"), id).Slice()[:onion.IDLen]
+}
+
+// Publish a Descriptor to the DHT under the key of both nodes. It is stored
+// until it expires, limited by the MaxTTL of the DHT.
+func Publish(n *dht.Node, d *Descriptor) error {
+	ttl := d.Expires.Sub(n.Now())
+	if ttl <= 0 {
+		return ErrExpired
+	}
+	b := d.Marshal()
+	if err := n.Put(Key(d.A.ID), b, ttl); err != nil {
+		return err
+	}
+	return n.Put(Key(d.B.ID), b, ttl)
+}
+
+// Find the unexpired bridges published for a node. Each is oriented so that
+// the node is A. Bridges with a node that does not Verify are skipped.
+func Find(n *dht.Node, id []byte) ([]*Descriptor, error) {
+	vs, err := n.Get(Key(id))
+	if err != nil {
+		return nil, err
+	}
+	now := n.Now()
+	var ds []*Descriptor
+	for _, v := range vs {
+		d, err := Unmarshal(v)
+		if err != nil || !now.Before(d.Expires) || d.A.Verify() != nil || d.B.Verify() != nil {
+			continue
+		}
+		switch encode(id) {
+		case d.A.String():
+			ds = append(ds, d)
+		case d.B.String():
+			ds = append(ds, d.Reverse())
+		}
+	}
+	return ds, nil
+}
+
+// Held is a message held for a bridge peer
+type Held struct {
+	*onion.RouteMsg
+	Next  []byte
+	Since time.Time
+}
+
+// Holder is the node side of a bridge. Low-urgency messages for a bridge peer
+// are held until the node has other traffic for the peer, and then piggyback
+// on it. Messages held longer than MaxHold are due to be sent on their own.
+type Holder struct {
+	MaxHold time.Duration
+	MaxHeld int
+	// Now can be replaced for testing
+	Now   func() time.Time
+	mux   sync.Mutex
+	peers map[string]time.Time
+	held  map[string][]*Held
+}
+
+// NewHolder creates a Holder with no bridges
+func NewHolder() *Holder {
+	return &Holder{
+		MaxHold: DefaultMaxHold,
+		MaxHeld: DefaultMaxHeld,
+		Now:     time.Now,
+		peers:   make(map[string]time.Time),
+		held:    make(map[string][]*Held),
+	}
+}
+
+// Add a bridge. The node must be A.
+func (h *Holder) Add(d *Descriptor) {
+	h.mux.Lock()
+	h.peers[d.B.String()] = d.Expires
+	h.mux.Unlock()
+}
+
+// Hold a Delivery if it is a low-urgency forward to an unexpired bridge peer
+// and there is room. It returns false if the message should be sent now.
+func (h *Holder) Hold(d *onion.Delivery, rm *onion.RouteMsg) bool {
+	if !d.Forward || !d.Hold {
+		return false
+	}
+	id := encode(d.Next)
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	now := h.Now()
+	exp, ok := h.peers[id]
+	if !ok || !now.Before(exp) || len(h.held[id]) >= h.MaxHeld {
+		return false
+	}
+	h.held[id] = append(h.held[id], &Held{
+		RouteMsg: rm,
+		Next:     d.Next,
+		Since:    now,
+	})
+	return true
+}
+
+// Piggyback returns and releases the messages held for a peer so they can be
+// sent along with other traffic.
+func (h *Holder) Piggyback(to []byte) []*onion.RouteMsg {
+	id := encode(to)
+	h.mux.Lock()
+	held := h.held[id]
+	delete(h.held, id)
+	h.mux.Unlock()
+	rms := make([]*onion.RouteMsg, len(held))
+	for i, hd := range held {
+		rms[i] = hd.RouteMsg
+	}
+	return rms
+}
+
+// Due returns and releases the messages that have been held longer than
+// MaxHold or whose bridge has expired.
+func (h *Holder) Due() []*Held {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	now := h.Now()
+	var due []*Held
+	for id, held := range h.held {
+		expired := !now.Before(h.peers[id])
+		keep := held[:0]
+		for _, hd := range held {
+			if expired || now.Sub(hd.Since) >= h.MaxHold {
+				due = append(due, hd)
+			} else {
+				keep = append(keep, hd)
+			}
+		}
+		if len(keep) == 0 {
+			delete(h.held, id)
+		} else {
+			h.held[id] = keep
+		}
+	}
+	for id, exp := range h.peers {
+		if !now.Before(exp) {
+			delete(h.peers, id)
+		}
+	}
+	return due
+}
+
+// Len returns the number of messages held for a peer
+func (h *Holder) Len(to []byte) int {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	return len(h.held[encode(to)])
+}
+
+// MarshalBatch combines several RouteMsgs so they can be sent together as
+// a sequence of length prefixed messages.
+func MarshalBatch(rms []*onion.RouteMsg) []byte {
+	var b []byte
+	ln := make([]byte, 4)
+	for _, rm := range rms {
+		m := rm.Marshal()
+		binary.BigEndian.PutUint32(ln, uint32(len(m)))
+		b = append(b, ln...)
+		b = append(b, m...)
+	}
+	return b
+}
+
+// UnmarshalBatch reverses MarshalBatch
+func UnmarshalBatch(b []byte) ([]*onion.RouteMsg, error) {
+	var rms []*onion.RouteMsg
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, ErrBadBatch
+		}
+		ln := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint64(ln) > uint64(len(b)) {
+			return nil, ErrBadBatch
+		}
+		rm, err := onion.UnmarshalRouteMsg(b[:ln])
+		if err != nil {
+			return nil, ErrBadBatch
+		}
+		rms = append(rms, rm)
+		b = b[ln:]
+	}
+	return rms, nil
+}
@@ -0,0 +1,112 @@
+package bridge
+
+import (
+	"crypto/rand"
+	"github.com/dist-ribut-us/docs/mixnetrouting/dht"
+	"github.com/dist-ribut-us/docs/mixnetrouting/memnet"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func setupDescriptor() *Descriptor {
+	return &Descriptor{
+		A:       onion.NewPrivNode().Pub(),
+		B:       onion.NewPrivNode().Pub(),
+		Expires: time.Now().Add(time.Hour).Truncate(time.Second),
+	}
+}
+
+func TestDescriptor(t *testing.T) {
+	d := setupDescriptor()
+	got, err := Unmarshal(d.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, d.A.Marshal(), got.A.Marshal())
+	assert.Equal(t, d.B.Marshal(), got.B.Marshal())
+	assert.True(t, d.Expires.Equal(got.Expires))
+
+	_, err = Unmarshal(d.Marshal()[1:])
+	assert.Equal(t, ErrBadDescriptor, err)
+	assert.Equal(t, d.B, d.Reverse().A)
+}
+
+func TestPublish(t *testing.T) {
+	net := memnet.New()
+	var nodes []*dht.Node
+	for i := 0; i < 20; i++ {
+		id := make([]byte, onion.IDLen)
+		rand.Read(id)
+		n, _, err := dht.Listen(net, id)
+		assert.NoError(t, err)
+		if i > 0 {
+			assert.NoError(t, n.Join(nodes[0].Addr))
+		}
+		nodes = append(nodes, n)
+	}
+
+	d := setupDescriptor()
+	assert.NoError(t, Publish(nodes[3], d))
+
+	ds, err := Find(nodes[12], d.A.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, ds, 1) {
+		assert.Equal(t, d.B.ID, ds[0].B.ID)
+	}
+	ds, err = Find(nodes[12], d.B.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, ds, 1) {
+		assert.Equal(t, d.A.ID, ds[0].B.ID)
+	}
+
+	d.Expires = time.Now().Add(-time.Second)
+	assert.Equal(t, ErrExpired, Publish(nodes[3], d))
+}
+
+func TestHolder(t *testing.T) {
+	d := setupDescriptor()
+	h := NewHolder()
+	now := time.Now()
+	h.Now = func() time.Time { return now }
+	h.MaxHeld = 2
+	rm := &onion.RouteMsg{}
+
+	fwd := &onion.Delivery{Forward: true, Hold: true, Next: d.B.ID}
+	// not a bridge peer yet
+	assert.False(t, h.Hold(fwd, rm))
+	h.Add(d)
+	assert.True(t, h.Hold(fwd, rm))
+	assert.False(t, h.Hold(&onion.Delivery{Forward: true, Next: d.B.ID}, rm))
+	assert.True(t, h.Hold(fwd, rm))
+	// full
+	assert.False(t, h.Hold(fwd, rm))
+	assert.Equal(t, 2, h.Len(d.B.ID))
+
+	assert.Len(t, h.Piggyback(d.B.ID), 2)
+	assert.Equal(t, 0, h.Len(d.B.ID))
+
+	assert.True(t, h.Hold(fwd, rm))
+	now = now.Add(time.Minute)
+	assert.True(t, h.Hold(fwd, rm))
+	assert.Len(t, h.Due(), 0)
+	now = now.Add(DefaultMaxHold - time.Minute)
+	assert.Len(t, h.Due(), 1)
+	assert.Equal(t, 1, h.Len(d.B.ID))
+
+	// once the bridge expires everything is due and nothing more is held
+	now = d.Expires
+	assert.Len(t, h.Due(), 1)
+	assert.False(t, h.Hold(fwd, rm))
+}
+
+func TestBatch(t *testing.T) {
+	rms := []*onion.RouteMsg{
+		{Map: make([]byte, onion.PacketLength), Data: []byte("one")},
+		{Map: make([]byte, 2*onion.PacketLength), Data: []byte("two")},
+	}
+	got, err := UnmarshalBatch(MarshalBatch(rms))
+	assert.NoError(t, err)
+	assert.Equal(t, rms, got)
+	_, err = UnmarshalBatch([]byte{0, 0, 1})
+	assert.Equal(t, ErrBadBatch, err)
+}
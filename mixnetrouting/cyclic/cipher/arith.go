@@ -0,0 +1,93 @@
+package cipher
+
+import (
+	"math/big"
+)
+
+// Backend selects the arithmetic used to cycle a cipher. Every Backend gives
+// bit-identical results so nodes on a route do not need to agree on it; each
+// node picks its own with the Backend of its Params or with CycleWith and
+// FinalWith.
+type Backend byte
+
+const (
+	// FixedBase uses a precomputed table for each root. It is the fastest, but
+	// the time it takes depends on the key.
+	FixedBase Backend = iota
+	// ConstantTime uses a Montgomery ladder over fixed size limbs so that the
+	// time taken to cycle does not depend on the key. It is roughly an order of
+	// magnitude slower than FixedBase.
+	ConstantTime
+)
+
+// arith is the interface to the modular arithmetic. Cycling a cipher first
+// combines the node's key with a random value to get the exponent and then
+// applies it to every segment.
+type arith interface {
+	// exponent returns key+rnd as a big endian value. It may be reduced modulo
+	// p-1.
+	exponent(p *Params, key []byte, rnd *big.Int) []byte
+	// cycle returns a copy of data where each segment i has been multiplied by
+	// root(i)^e % p
+	cycle(p *Params, data, e []byte) []byte
+}
+
+func (b Backend) arith() arith {
+	if b == ConstantTime {
+		return ladderArith{}
+	}
+	return fixedBaseArith{}
+}
+
+// ladderArith cycles with a Montgomery ladder. The key is never handled by
+// math/big; it is added to the random value with fixed width byte arithmetic
+// and is not reduced, because r^(k+rnd) = r^((k+rnd)%(p-1)) % p. Every bit of
+// the exponent costs the same two multiplications and the only branches and
+// memory accesses depend on lengths, which are public.
+type ladderArith struct{}
+
+func (ladderArith) exponent(p *Params, key []byte, rnd *big.Int) []byte {
+	ln := len(key)
+	if ln < p.pLen {
+		ln = p.pLen
+	}
+	e := rnd.FillBytes(make([]byte, ln+1))
+	var c uint16
+	for i := 1; i <= len(e); i++ {
+		c += uint16(e[len(e)-i])
+		if i <= len(key) {
+			c += uint16(key[len(key)-i])
+		}
+		e[len(e)-i] = byte(c)
+		c >>= 8
+	}
+	return e
+}
+
+func (ladderArith) cycle(p *Params, data, e []byte) []byte {
+	pLen := p.pLen
+	n := len(data) / pLen
+	roots := p.roots(n)
+	out := make([]byte, len(data))
+	parallel(n, func(from, to int) {
+		m := p.mod
+		r0, r1, t := m.newNat(), m.newNat(), m.scratch()
+		for i := from; i < to; i++ {
+			m.toMont(r1, natFromBig(roots[i], m.n), t)
+			m.ladder(r0, r1, e, t)
+			// r0 is in Montgomery form so the product is in normal form
+			seg := natFromBytes(data[i*pLen:(i+1)*pLen], m.n)
+			m.mul(r0, seg, r0, t)
+			r0.fillBytes(out[i*pLen : (i+1)*pLen])
+		}
+	})
+	return out
+}
+
+// roots returns the first n roots, extending the table if necessary
+func (p *Params) roots(n int) []*big.Int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.fillRoots(n)
+	return p.Roots[:n]
+}
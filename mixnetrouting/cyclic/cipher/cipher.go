@@ -2,195 +2,192 @@ package cipher
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"github.com/dist-ribut-us/errors"
 	"math/big"
 )
 
-// 70035030982873223990326147545273826083163227324677473758120515445066011271064596346550284227444737
-// (2*571)^32 + 1
-// A larger prime may be needed
 var (
-	p = new(big.Int).SetBytes([]byte{
-		32, 201, 195, 52, 180, 51, 194, 228, 73, 211, 71, 87, 253,
-		82, 32, 232, 27, 223, 96, 40, 188, 105, 158, 196, 189, 36,
-		148, 33, 216, 20, 50, 221, 59, 70, 142, 71, 129, 0, 0, 0, 1,
-	})
-	bigZero      = big.NewInt(0)
-	bigOne       = big.NewInt(1)
-	bigTwo       = big.NewInt(2)
-	phi          = new(big.Int).Sub(p, bigOne)
-	pLen         = len(p.Bytes())
-	primeFactors = []*big.Int{big.NewInt(2), big.NewInt(571)}
+	bigOne = big.NewInt(1)
 )
 
 const (
 	// ErrWrongLength is returned when a key of incorrect length is used.
 	ErrWrongLength errors.String = "Cipher must be a multiple of the prime length"
+	// ErrBadFraming is returned by Final when the recovered message does not
+	// have a valid length header and padding. This will happen if the cipher
+	// was corrupted or any key was wrong.
+	ErrBadFraming errors.String = "Cipher framing is corrupt"
+	// ErrBadCipher is returned when a Cipher is nil or has no accumulator
+	ErrBadCipher errors.String = "Cipher is missing its accumulator"
 )
 
-// PrimeLength returns the byte length of the prime
-func PrimeLength() int { return pLen }
-
-// Cipher holds the enciphered data and the cipher accumulator
+// Cipher holds the enciphered data and the cipher accumulator. ParamsID
+// identifies the Params the cipher was started with.
 type Cipher struct {
-	Data []byte
-	Acc  *big.Int
+	Data     []byte
+	Acc      *big.Int
+	ParamsID byte
 }
 
-// Cycle applies a cyclic key to the cipher. It chooses a random value and adds
-// that to both the key and the accumulator.
-func (c *Cipher) Cycle(key []byte) error {
-	if len(c.Data)%pLen != 0 {
+// check that the cipher is well formed for the params
+func (c *Cipher) check(p *Params) error {
+	if c == nil || c.Acc == nil {
+		return ErrBadCipher
+	}
+	if c.ParamsID != p.ID {
+		return ErrParamsMismatch
+	}
+	if len(c.Data)%p.pLen != 0 {
 		return ErrWrongLength
 	}
+	return nil
+}
+
+// Cycle applies a cyclic key to the cipher with the Backend of the Params. It
+// chooses a random value and adds that to both the key and the accumulator.
+func (c *Cipher) Cycle(p *Params, key []byte) error {
+	return c.CycleWith(p, p.Backend, key)
+}
+
+// CycleWith is Cycle using the given Backend
+func (c *Cipher) CycleWith(p *Params, b Backend, key []byte) error {
+	if err := c.check(p); err != nil {
+		return err
+	}
 
-	rnd := make([]byte, pLen+1)
+	rnd := make([]byte, p.pLen+1)
 	rand.Read(rnd)
 	bigRnd := new(big.Int).SetBytes(rnd)
-	bigRnd.Mod(bigRnd, phi)
-	k := new(big.Int).SetBytes(key)
+	bigRnd.Mod(bigRnd, p.phi)
+	c.Acc.Mod(c.Acc.Add(c.Acc, bigRnd), p.phi)
 
-	k.Mod(k.Add(k, bigRnd), phi)
-	c.Acc.Mod(c.Acc.Add(c.Acc, bigRnd), phi)
-
-	c.cycle(k)
+	a := b.arith()
+	c.cycle(p, a, a.exponent(p, key, bigRnd))
 	return nil
 }
 
 // cycle is the core of the algorithm shared by both the exposed Cycle method
-// the Final method. It deterministically applies a key to the cipher data.
-func (c *Cipher) cycle(key *big.Int) {
-	// z is declared to be reused as intermediary portion of the calculation
-	// it doesn't have any special meaning
-	z := new(big.Int)
-	bigC := new(big.Int)
-	g := newGenerator()
-	out := make([]byte, len(c.Data))
-	for i := 0; i*pLen < len(c.Data); i++ {
-		bigC.SetBytes(c.Data[i*pLen : (i+1)*pLen])
-		// c = (c * r^k) % p
-		z.Exp(g.next(), key, p)
-		bigC.Mul(bigC, z)
-		bigC.Mod(bigC, p)
-		bs := bigC.Bytes()
-		copy(out[(i*pLen)+(pLen-len(bs)):], bs)
-	}
-	c.Data = out
+// the Final method. It deterministically applies the big endian exponent e to
+// the cipher data using the arithmetic a.
+func (c *Cipher) cycle(p *Params, a arith, e []byte) {
+	c.Data = a.cycle(p, c.Data, e)
 }
 
 // Start the cyclic cipher
-func Start(keys [][]byte, msg []byte) (*Cipher, error) {
-	sum := sumKeys(keys)
-	c := &Cipher{
-		Data: prepMsg(msg),
-		Acc:  new(big.Int),
-	}
-	return c, c.Cycle(sum.Sub(phi, sum).Bytes())
+func Start(p *Params, keys [][]byte, msg []byte) (*Cipher, error) {
+	return StartPadded(p, keys, msg, 0)
 }
 
-// Final is called to finish the cipher, it compensates for the accumulator and
-// removes the leading zero from each segment. It does not remove trailing
-// zeros.
-func (c *Cipher) Final() ([]byte, error) {
-	if len(c.Data)%pLen != 0 {
-		return nil, ErrWrongLength
+// StartPadded starts the cyclic cipher with the message padded to at least
+// size bytes before it is broken into chunks, so that messages of different
+// lengths produce the same length of cipher Data. The size includes the
+// LenHeader bytes that frame the message. The padding is removed by Final.
+func StartPadded(p *Params, keys [][]byte, msg []byte, size int) (*Cipher, error) {
+	sum := sumKeys(p, keys)
+	c := &Cipher{
+		Data:     prepPadded(p, msg, size),
+		Acc:      new(big.Int),
+		ParamsID: p.ID,
 	}
-	c.Acc.Sub(c.Acc.Neg(c.Acc), phi)
-	c.Acc.Mod(c.Acc, phi)
-	c.cycle(c.Acc)
-	return finishMsg(c.Data), nil
+	return c, c.Cycle(p, sum.Sub(p.phi, sum).Bytes())
 }
 
-// generator for primitive roots
-type generator struct {
-	r *big.Int
-	i int
+// Final is called to finish the cipher, it compensates for the accumulator and
+// removes the framing added by Start, returning exactly the original message.
+// It uses the Backend of the Params.
+func (c *Cipher) Final(p *Params) ([]byte, error) {
+	return c.FinalWith(p, p.Backend)
 }
 
-func newGenerator() *generator {
-	return &generator{
-		r: new(big.Int).Set(bigOne),
+// FinalWith is Final using the given Backend
+func (c *Cipher) FinalWith(p *Params, b Backend) ([]byte, error) {
+	if err := c.check(p); err != nil {
+		return nil, err
 	}
+	c.Acc.Sub(c.Acc.Neg(c.Acc), p.phi)
+	c.Acc.Mod(c.Acc, p.phi)
+	c.cycle(p, b.arith(), c.Acc.Bytes())
+	return finishMsg(p, c.Data)
 }
 
-// The first time a generator is used it populates this table, on all subsequent
-// runs, it just does a look up.
-var rootTbl []*big.Int
-
-func (g *generator) next() *big.Int {
-	// first check the root table
-	if g.i < len(rootTbl) {
-		g.r.Set(rootTbl[g.i])
-		g.i++
-		return g.r
-	}
-
-	// z is used for intermediate calculations
-	z := new(big.Int)
-	for {
-		g.r.Add(g.r, bigOne)
-		isR := true
-
-		for _, pf := range primeFactors {
-			// r is a primitive root if for every prime factor
-			// r^(phi/pf) % p != 1
-			z.Div(phi, pf)
-			z.Exp(g.r, z, p)
-			if z.Cmp(bigOne) == 0 {
-				isR = false
-				break
-			}
-		}
-
-		if isR {
-			rootTbl = append(rootTbl, new(big.Int).Set(g.r))
-			g.i++
-			return g.r
-		}
-	}
-}
+// LenHeader is the byte length of the message length that prepMsg places in
+// front of the message. It counts towards the size passed to StartPadded.
+const LenHeader = 4
 
 // prepMsg breaks the message into chunks that are guaranteed to be less than
 // p by taking sections one byte shorter than p and padding them with a leading
-// zero. It also pad the tail with enough zeros to round out the length.
-func prepMsg(m []byte) []byte {
-	l := len(m) % (pLen - 1)
-	if l != 0 {
-		b := make([]byte, pLen-1-l)
-		m = append(m, b...)
+// zero. The message is prefixed with its length so that the padding added to
+// the tail to round out the length can be removed by finishMsg. Because the
+// length is inside the cipher, it is encrypted along with the message.
+func prepMsg(p *Params, m []byte) []byte {
+	return prepPadded(p, m, 0)
+}
+
+// prepPadded is prepMsg with the framed message padded to at least size bytes
+func prepPadded(p *Params, m []byte, size int) []byte {
+	pLen := p.pLen
+	ln := LenHeader + len(m)
+	if ln < size {
+		ln = size
 	}
-	out := make([]byte, (len(m)/(pLen-1))*pLen)
+	if l := ln % (pLen - 1); l != 0 {
+		ln += pLen - 1 - l
+	}
+	framed := make([]byte, ln)
+	binary.BigEndian.PutUint32(framed, uint32(len(m)))
+	copy(framed[LenHeader:], m)
 
-	for i := 0; i*(pLen-1) < len(m); i++ {
-		copy(out[i*pLen+1:], m[i*(pLen-1):(i+1)*(pLen-1)])
+	out := make([]byte, (ln/(pLen-1))*pLen)
+	for i := 0; i*(pLen-1) < ln; i++ {
+		copy(out[i*pLen+1:], framed[i*(pLen-1):(i+1)*(pLen-1)])
 	}
 	return out
 }
 
-// finishMsg removes the zeros added to each segment by prepMsg, but it does not
-// remove the trailing zeros.
-func finishMsg(c []byte) []byte {
+// finishMsg removes the zeros added to each segment by prepMsg and uses the
+// length header to remove the padding, returning exactly the original message.
+// If the leading zeros, header or padding are not what prepMsg would have
+// produced, ErrBadFraming is returned.
+func finishMsg(p *Params, c []byte) ([]byte, error) {
+	pLen := p.pLen
 	if len(c)%pLen != 0 {
-		return nil
+		return nil, ErrWrongLength
 	}
 
-	out := make([]byte, (len(c)/pLen)*(pLen-1))
+	framed := make([]byte, (len(c)/pLen)*(pLen-1))
 	for i := 0; i*pLen < len(c); i++ {
-		copy(out[i*(pLen-1):], c[i*pLen+1:(i+1)*pLen])
+		if c[i*pLen] != 0 {
+			return nil, ErrBadFraming
+		}
+		copy(framed[i*(pLen-1):], c[i*pLen+1:(i+1)*pLen])
 	}
-	return out
+	if len(framed) < LenHeader {
+		return nil, ErrBadFraming
+	}
+	ln := binary.BigEndian.Uint32(framed)
+	framed = framed[LenHeader:]
+	if uint64(ln) > uint64(len(framed)) {
+		return nil, ErrBadFraming
+	}
+	for _, b := range framed[ln:] {
+		if b != 0 {
+			return nil, ErrBadFraming
+		}
+	}
+	return framed[:ln], nil
 }
 
-func sumKeys(keys [][]byte) *big.Int {
+func sumKeys(p *Params, keys [][]byte) *big.Int {
 	sum := big.NewInt(0)
 	for _, k := range keys {
 		sum.Add(sum, new(big.Int).SetBytes(k))
 	}
-	return sum.Mod(sum, phi)
+	return sum.Mod(sum, p.phi)
 }
 
 // SumKeys returns the sum of the keys as a byte slice. This avoids directly
 // dealing with big.Int outside of this package.
-func SumKeys(keys [][]byte) []byte {
-	return sumKeys(keys).Bytes()
+func SumKeys(p *Params, keys [][]byte) []byte {
+	return sumKeys(p, keys).Bytes()
 }
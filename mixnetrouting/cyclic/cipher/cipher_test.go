@@ -3,13 +3,15 @@ package cipher
 import (
 	"crypto/rand"
 	"github.com/stretchr/testify/assert"
+	"math/big"
+	"strconv"
 	"testing"
 )
 
-func GenerateKeys(n int) [][]byte {
+func GenerateKeys(p *Params, n int) [][]byte {
 	keys := make([][]byte, n)
 	for i := range keys {
-		rnd := make([]byte, (pLen - 1))
+		rnd := make([]byte, (p.PrimeLength() - 1))
 		rand.Read(rnd)
 		keys[i] = rnd
 	}
@@ -19,23 +21,23 @@ func GenerateKeys(n int) [][]byte {
 func TestEndToEnd(t *testing.T) {
 	msgLn := 60000
 
-	keys := GenerateKeys(10)
+	keys := GenerateKeys(Default, 10)
 
 	msg := make([]byte, msgLn)
 	rand.Read(msg)
 
-	c, err := Start(keys, msg)
+	c, err := Start(Default, keys, msg)
 	assert.NoError(t, err)
 
 	for _, k := range keys {
-		err = c.Cycle(k)
+		err = c.Cycle(Default, k)
 		assert.NoError(t, err)
 	}
 
-	out, err := c.Final()
+	out, err := c.Final(Default)
 	assert.NoError(t, err)
 
-	assert.Equal(t, msg, out[:msgLn])
+	assert.Equal(t, msg, out)
 }
 
 func TestPrepAndFinishMsg(t *testing.T) {
@@ -43,5 +45,209 @@ func TestPrepAndFinishMsg(t *testing.T) {
 	msg := make([]byte, msgLn)
 	rand.Read(msg)
 
-	assert.Equal(t, msg, finishMsg(prepMsg(msg)))
+	out, err := finishMsg(Default, prepMsg(Default, msg))
+	assert.NoError(t, err)
+	assert.Equal(t, msg, out)
+
+	// trailing zeros are part of the message
+	for _, msg := range [][]byte{{}, {0}, {1, 0, 0}, make([]byte, Default.pLen*3)} {
+		out, err := finishMsg(Default, prepMsg(Default, msg))
+		assert.NoError(t, err)
+		assert.Equal(t, msg, out)
+	}
+}
+
+func TestStartPadded(t *testing.T) {
+	keys := GenerateKeys(Default, 3)
+	var ln int
+	for _, msg := range [][]byte{{}, []byte("short"), make([]byte, 1000)} {
+		c, err := StartPadded(Default, keys, msg, 2048)
+		assert.NoError(t, err)
+		if ln == 0 {
+			ln = len(c.Data)
+		}
+		assert.Equal(t, ln, len(c.Data))
+		for _, k := range keys {
+			assert.NoError(t, c.Cycle(Default, k))
+		}
+		out, err := c.Final(Default)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, out)
+	}
+}
+
+func TestBadFraming(t *testing.T) {
+	p := Default
+	msg := []byte("framing test")
+
+	c := prepMsg(p, msg)
+	c[0] = 1
+	_, err := finishMsg(p, c)
+	assert.Equal(t, ErrBadFraming, err)
+
+	// length longer than the message
+	c = prepMsg(p, msg)
+	c[1] = 0xff
+	_, err = finishMsg(p, c)
+	assert.Equal(t, ErrBadFraming, err)
+
+	// non-zero padding
+	c = prepMsg(p, msg)
+	c[len(c)-1] = 1
+	_, err = finishMsg(p, c)
+	assert.Equal(t, ErrBadFraming, err)
+
+	_, err = finishMsg(p, c[1:])
+	assert.Equal(t, ErrWrongLength, err)
+
+	// a wrong key corrupts the whole message
+	keys := GenerateKeys(p, 3)
+	ciph, err := Start(p, keys, msg)
+	assert.NoError(t, err)
+	assert.NoError(t, ciph.Cycle(p, keys[0]))
+	assert.NoError(t, ciph.Cycle(p, keys[1]))
+	_, err = ciph.Final(p)
+	assert.Equal(t, ErrBadFraming, err)
+}
+
+func TestParamsMismatch(t *testing.T) {
+	keys := GenerateKeys(Demo, 3)
+	c, err := Start(Demo, keys, []byte("test"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, ErrParamsMismatch, c.Cycle(Level1K, keys[0]))
+	_, err = c.Final(Level1K)
+	assert.Equal(t, ErrParamsMismatch, err)
+}
+
+func TestLargeParams(t *testing.T) {
+	msg := []byte("this is a test of the larger parameter sets")
+	for _, p := range []*Params{Level1K, Level2K} {
+		keys := GenerateKeys(p, 3)
+		c, err := Start(p, keys, msg)
+		assert.NoError(t, err)
+		for _, k := range keys {
+			assert.NoError(t, c.Cycle(p, k))
+		}
+		out, err := c.Final(p)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, out)
+	}
 }
+
+// cycleExp is the straightforward version of cycle that does a full
+// exponentiation for every segment. It is kept to check and benchmark cycle.
+func (c *Cipher) cycleExp(p *Params, key *big.Int) {
+	z := new(big.Int)
+	bigC := new(big.Int)
+	pLen := p.pLen
+	out := make([]byte, len(c.Data))
+	for i := 0; i*pLen < len(c.Data); i++ {
+		bigC.SetBytes(c.Data[i*pLen : (i+1)*pLen])
+		z.Exp(p.root(i), key, p.P)
+		bigC.Mul(bigC, z)
+		bigC.Mod(bigC, p.P)
+		bs := bigC.Bytes()
+		copy(out[(i*pLen)+(pLen-len(bs)):], bs)
+	}
+	c.Data = out
+}
+
+func TestBackendsMatchExp(t *testing.T) {
+	for _, p := range []*Params{Demo, Level1K} {
+		msg := make([]byte, 5000)
+		rand.Read(msg)
+		data := prepMsg(p, msg)
+		// the segments of a cipher in transit do not need to be less than p
+		for i := 0; i < len(data); i += p.pLen {
+			data[i] = 0xff
+		}
+		// keys are longer than the prime for the demo params
+		key := make([]byte, 56)
+		rand.Read(key)
+		rnd, err := rand.Int(rand.Reader, p.phi)
+		assert.NoError(t, err)
+
+		k := new(big.Int).SetBytes(key)
+		expect := &Cipher{Data: data}
+		expect.cycleExp(p, k.Add(k, rnd))
+
+		for _, a := range []arith{fixedBaseArith{}, ladderArith{}} {
+			out := a.cycle(p, data, a.exponent(p, key, rnd))
+			assert.Equal(t, expect.Data, out, p.Name)
+		}
+	}
+}
+
+func TestTableCap(t *testing.T) {
+	p := NewParams(201, "cap", Level3K.P, Level3K.Factors)
+	n := p.maxTables() + 2
+	data := make([]byte, n*p.pLen)
+	for i := 0; i < len(data); i += p.pLen {
+		rand.Read(data[i+1 : i+p.pLen])
+	}
+	rnd, err := rand.Int(rand.Reader, p.phi)
+	assert.NoError(t, err)
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	k := new(big.Int).SetBytes(key)
+	expect := &Cipher{Data: data}
+	expect.cycleExp(p, k.Add(k, rnd))
+	a := fixedBaseArith{}
+	assert.Equal(t, expect.Data, a.cycle(p, data, a.exponent(p, key, rnd)))
+	// segments past the cap do not get tables
+	assert.Len(t, p.tbls, p.maxTables())
+}
+
+func TestConstantTimeEndToEnd(t *testing.T) {
+	p := Demo
+	// Cycle and Final use the Backend of the Params, ConstantTime by default
+	assert.Equal(t, ConstantTime, p.Backend)
+	keys := GenerateKeys(p, 5)
+	msg := make([]byte, 1000)
+	rand.Read(msg)
+
+	c, err := Start(p, keys, msg)
+	assert.NoError(t, err)
+	for i, k := range keys {
+		// nodes do not need to agree on the backend
+		if i%2 == 0 {
+			assert.NoError(t, c.Cycle(p, k))
+		} else {
+			assert.NoError(t, c.CycleWith(p, FixedBase, k))
+		}
+	}
+	out, err := c.Final(p)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, out)
+}
+
+func benchmarkCycle(b *testing.B, backend Backend, exp bool) {
+	p := NewParams(Default.ID, Default.Name, Default.P, Default.Factors)
+	a := backend.arith()
+	key := make([]byte, 56)
+	rand.Read(key)
+	rnd, _ := rand.Int(rand.Reader, p.phi)
+	e := a.exponent(p, key, rnd)
+	for _, size := range []int{4096, 16384, 65536} {
+		msg := make([]byte, size)
+		rand.Read(msg)
+		c := &Cipher{Data: prepMsg(p, msg)}
+		// build the root tables before timing
+		c.cycle(p, a, e)
+		b.Run(strconv.Itoa(size/1024)+"k", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if exp {
+					c.cycleExp(p, new(big.Int).SetBytes(e))
+				} else {
+					c.cycle(p, a, e)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCycle(b *testing.B)             { benchmarkCycle(b, FixedBase, false) }
+func BenchmarkCycleConstantTime(b *testing.B) { benchmarkCycle(b, ConstantTime, false) }
+func BenchmarkCycleExp(b *testing.B)          { benchmarkCycle(b, FixedBase, true) }
@@ -0,0 +1,174 @@
+package cipher
+
+import (
+	"math/big"
+	"runtime"
+	"sync"
+)
+
+// window is the number of exponent bits covered by each entry in a fixedBase.
+// Digits are stored in a byte, so it must be at most 8.
+const window = 4
+
+// minChunk is the fewest segments worth handing to a goroutine
+const minChunk = 8
+
+// maxTableBytes bounds the memory the tables of a Params may use. Segments
+// past the last table are cycled with the ladder instead.
+const maxTableBytes = 8 << 20
+
+// fixedBase holds r^(2^(window*i)) % p in Montgomery form for every window i
+// of an exponent less than p-1. Because the roots never change, the table is
+// computed once and r^k can then be found with one multiplication per window
+// plus 2*(2^window-1) using Yao's method instead of a full exponentiation. The
+// cost is memory; each table holds windows*limbs*8 bytes, about bits^2/32, or
+// about 136KB for Level2K.
+type fixedBase []nat
+
+func newFixedBase(r *big.Int, p *Params) fixedBase {
+	m, t := p.mod, p.mod.scratch()
+	fb := make(fixedBase, p.windows())
+	fb[0] = m.newNat()
+	m.toMont(fb[0], natFromBig(r, m.n), t)
+	for i := 1; i < len(fb); i++ {
+		z := m.newNat()
+		copy(z, fb[i-1])
+		for j := 0; j < window; j++ {
+			m.mul(z, z, z, t)
+		}
+		fb[i] = z
+	}
+	return fb
+}
+
+// windows is the number of windows needed for an exponent less than p-1
+func (p *Params) windows() int {
+	return (p.phi.BitLen() + window - 1) / window
+}
+
+// maxTables is the number of tables that fit in maxTableBytes, at least one
+func (p *Params) maxTables() int {
+	n := maxTableBytes / (p.windows() * p.mod.n * 8)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// digits breaks the big endian value e into n base 2^window digits, least
+// significant first. The value must fit in n digits.
+func digits(e []byte, n int) []byte {
+	d := make([]byte, n)
+	for i := range d {
+		for j := 0; j < window; j++ {
+			bit := i*window + j
+			idx := len(e) - 1 - bit/8
+			if idx < 0 {
+				return d
+			}
+			d[i] |= (e[idx] >> uint(bit%8) & 1) << uint(j)
+		}
+	}
+	return d
+}
+
+// exp sets z to r^k % p in Montgomery form where d holds the digits of k. The
+// values b and t are used for intermediate calculations. For each digit value
+// v, from largest to smallest, b accumulates the product of the table entries
+// whose digit is v and z accumulates b, so that each entry is multiplied into z
+// v times.
+func (fb fixedBase) exp(z, b, t nat, d []byte, m *modulus) {
+	copy(z, m.one)
+	copy(b, m.one)
+	for v := byte(1<<window - 1); v > 0; v-- {
+		for i, dv := range d {
+			if dv == v {
+				m.mul(b, b, fb[i], t)
+			}
+		}
+		m.mul(z, z, b, t)
+	}
+}
+
+// fixedBaseArith cycles using a fixedBase for each root. Both the digits of
+// the exponent and the table lookups that depend on them affect the timing.
+type fixedBaseArith struct{}
+
+// exponent reduces key+rnd modulo p-1 so that it fits in the table windows
+func (fixedBaseArith) exponent(p *Params, key []byte, rnd *big.Int) []byte {
+	k := new(big.Int).SetBytes(key)
+	return k.Mod(k.Add(k, rnd), p.phi).Bytes()
+}
+
+func (fixedBaseArith) cycle(p *Params, data, e []byte) []byte {
+	pLen := p.pLen
+	n := len(data) / pLen
+	tbls, roots := p.tables(n)
+	// The digits of the exponent are shared by every segment
+	d := digits(e, p.windows())
+	out := make([]byte, len(data))
+	parallel(n, func(from, to int) {
+		m := p.mod
+		// z, b and t are declared to be reused as intermediary portions of the
+		// calculation they don't have any special meaning
+		z, b, t := m.newNat(), m.newNat(), m.scratch()
+		for i := from; i < to; i++ {
+			seg := natFromBytes(data[i*pLen:(i+1)*pLen], m.n)
+			// r^k is in Montgomery form so multiplying by a segment in normal form
+			// gives c = (c * r^k) % p in normal form.
+			if i < len(tbls) {
+				tbls[i].exp(z, b, t, d, m)
+			} else {
+				m.toMont(b, natFromBig(roots[i], m.n), t)
+				m.ladder(z, b, e, t)
+			}
+			m.mul(z, seg, z, t)
+			z.fillBytes(out[i*pLen : (i+1)*pLen])
+		}
+	})
+	return out
+}
+
+// tables returns a fixedBase for each of the first n roots, up to maxTables,
+// building any that are missing, along with the first n roots.
+func (p *Params) tables(n int) ([]fixedBase, []*big.Int) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.fillRoots(n)
+	roots := p.Roots[:n]
+	if max := p.maxTables(); n > max {
+		n = max
+	}
+	if ln := len(p.tbls); ln < n {
+		tbls := make([]fixedBase, n-ln)
+		parallel(len(tbls), func(from, to int) {
+			for i := from; i < to; i++ {
+				tbls[i] = newFixedBase(p.Roots[ln+i], p)
+			}
+		})
+		p.tbls = append(p.tbls, tbls...)
+	}
+	return p.tbls[:n], roots
+}
+
+// parallel splits n segments into contiguous chunks, one per processor, and
+// calls fn on each chunk concurrently. It returns when every chunk is done.
+func parallel(n int, fn func(from, to int)) {
+	procs := runtime.GOMAXPROCS(0)
+	if max := n / minChunk; procs > max {
+		procs = max
+	}
+	if procs < 2 {
+		fn(0, n)
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(procs)
+	for i := 0; i < procs; i++ {
+		go func(from, to int) {
+			fn(from, to)
+			wg.Done()
+		}(i*n/procs, (i+1)*n/procs)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,53 @@
+package cipher
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+)
+
+// fuzzMaxData keeps each exec fast, Final cycles every chunk of Data
+const fuzzMaxData = 64 * 1024
+
+func FuzzFinal(f *testing.F) {
+	keys := GenerateKeys(Default, 3)
+	c, err := Start(Default, keys, []byte("fuzz"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, k := range keys {
+		if err := c.Cycle(Default, k); err != nil {
+			f.Fatal(err)
+		}
+	}
+	f.Add(c.Data, c.Acc.Bytes(), c.ParamsID, false)
+	f.Add([]byte{}, []byte{}, Default.ID, true)
+	f.Add(make([]byte, Default.pLen), []byte{1}, Default.ID, false)
+
+	f.Fuzz(func(t *testing.T, data, acc []byte, id byte, nilAcc bool) {
+		if len(data) > fuzzMaxData {
+			return
+		}
+		c := &Cipher{
+			Data:     data,
+			ParamsID: id,
+		}
+		if !nilAcc {
+			c.Acc = new(big.Int).SetBytes(acc)
+		}
+		msg, err := c.Final(Default)
+		if err == nil && len(msg) > len(data) {
+			t.Fatal("Final returned more than the cipher")
+		}
+	})
+}
+
+func TestBadCipher(t *testing.T) {
+	var c *Cipher
+	_, err := c.Final(Default)
+	assert.Equal(t, ErrBadCipher, err)
+	c = &Cipher{ParamsID: Default.ID}
+	assert.Equal(t, ErrBadCipher, c.Cycle(Default, []byte{1}))
+	_, err = c.Final(Default)
+	assert.Equal(t, ErrBadCipher, err)
+}
@@ -0,0 +1,157 @@
+package cipher
+
+import (
+	"math/big"
+	"math/bits"
+)
+
+// modulus holds a prime as fixed size little endian 64 bit limbs along with
+// the values needed for Montgomery multiplication. A value x in Montgomery
+// form is x*R % p where R = 2^(64*n). Every value handled by a modulus has
+// exactly n limbs.
+type modulus struct {
+	n     int
+	m     nat
+	m0inv uint64 // -m^-1 % 2^64
+	rr    nat    // R^2 % m
+	one   nat    // R % m, 1 in Montgomery form
+}
+
+// nat is a fixed length little endian number
+type nat []uint64
+
+func newModulus(p *big.Int) *modulus {
+	n := (p.BitLen() + 63) / 64
+	m := &modulus{
+		n: n,
+		m: natFromBig(p, n),
+	}
+
+	// Newton's method for the inverse of m[0] mod 2^64, each step doubles the
+	// number of correct bits.
+	inv := uint64(1)
+	for i := 0; i < 6; i++ {
+		inv *= 2 - m.m[0]*inv
+	}
+	m.m0inv = -inv
+
+	r := new(big.Int).Lsh(bigOne, uint(64*n))
+	m.one = natFromBig(new(big.Int).Mod(r, p), n)
+	r.Mul(r, r)
+	m.rr = natFromBig(r.Mod(r, p), n)
+	return m
+}
+
+func natFromBig(x *big.Int, n int) nat {
+	return natFromBytes(x.FillBytes(make([]byte, n*8)), n)
+}
+
+// natFromBytes reads a big endian byte slice that is no longer than 8*n bytes
+func natFromBytes(b []byte, n int) nat {
+	z := make(nat, n)
+	for i := range z {
+		for j := 0; j < 8; j++ {
+			idx := len(b) - 1 - i*8 - j
+			if idx < 0 {
+				return z
+			}
+			z[i] |= uint64(b[idx]) << uint(8*j)
+		}
+	}
+	return z
+}
+
+// fillBytes writes x into b as a big endian value, b must be long enough to
+// hold x.
+func (x nat) fillBytes(b []byte) {
+	for i := range b {
+		idx := len(b) - 1 - i
+		b[idx] = byte(x[i/8] >> uint(8*(i%8)))
+	}
+}
+
+func (m *modulus) newNat() nat { return make(nat, m.n) }
+
+// scratch returns a buffer large enough to be used by mul
+func (m *modulus) scratch() nat { return make(nat, m.n+2) }
+
+// mul sets z = x*y*R^-1 % m using the CIOS method. x may be any n limb value,
+// y must be less than m. The final subtraction does not branch on the result.
+// z may alias x or y, t must come from scratch.
+func (m *modulus) mul(z, x, y, t nat) {
+	n := m.n
+	for i := range t {
+		t[i] = 0
+	}
+	for i := 0; i < n; i++ {
+		var c, hi, lo uint64
+		yi := y[i]
+		for j := 0; j < n; j++ {
+			hi, lo = bits.Mul64(x[j], yi)
+			lo, cc := bits.Add64(lo, t[j], 0)
+			hi += cc
+			lo, cc = bits.Add64(lo, c, 0)
+			hi += cc
+			t[j], c = lo, hi
+		}
+		t[n], c = bits.Add64(t[n], c, 0)
+		t[n+1] = c
+
+		q := t[0] * m.m0inv
+		hi, lo = bits.Mul64(q, m.m[0])
+		_, cc := bits.Add64(lo, t[0], 0)
+		c = hi + cc
+		for j := 1; j < n; j++ {
+			hi, lo = bits.Mul64(q, m.m[j])
+			lo, cc = bits.Add64(lo, t[j], 0)
+			hi += cc
+			lo, cc = bits.Add64(lo, c, 0)
+			hi += cc
+			t[j-1], c = lo, hi
+		}
+		t[n-1], c = bits.Add64(t[n], c, 0)
+		t[n] = t[n+1] + c
+	}
+
+	// t < 2m, subtract m and keep the result if there was no borrow
+	var b uint64
+	for i := 0; i < n; i++ {
+		z[i], b = bits.Sub64(t[i], m.m[i], b)
+	}
+	_, b = bits.Sub64(t[n], 0, b)
+	// b is 1 if t < m
+	mask := -b
+	for i := 0; i < n; i++ {
+		z[i] = (t[i] & mask) | (z[i] &^ mask)
+	}
+}
+
+// toMont sets z to x in Montgomery form
+func (m *modulus) toMont(z, x, t nat) { m.mul(z, x, m.rr, t) }
+
+// ladder sets r0 to r1^e in Montgomery form where r1 is in Montgomery form and
+// e is big endian. It uses the Montgomery ladder, so every bit of e takes the
+// same operations and r1 is overwritten. The invariant is r1 = r0 * base.
+func (m *modulus) ladder(r0, r1 nat, e []byte, t nat) {
+	copy(r0, m.one)
+	for _, byt := range e {
+		for j := 7; j >= 0; j-- {
+			b := uint64(byt>>uint(j)) & 1
+			cswap(r0, r1, b)
+			m.mul(r1, r0, r1, t)
+			m.mul(r0, r0, r0, t)
+			cswap(r0, r1, b)
+		}
+	}
+}
+
+// cswap swaps x and y if b is 1 and leaves them if b is 0 without branching on
+// b.
+func cswap(x, y nat, b uint64) {
+	mask := -b
+	for i := range x {
+		d := (x[i] ^ y[i]) & mask
+		x[i] ^= d
+		y[i] ^= d
+	}
+}
@@ -0,0 +1,135 @@
+// Command paramgen searches for a prime of the form (a*b)^n + 1 and writes a
+// Go source file that registers it as a cipher.Params. The factorization of
+// p-1 is known by construction and is proved along with the primality of p and
+// the primitive root table before anything is written.
+//
+//	go run ./cyclic/cipher/paramgen -bits 2048 -id 5 -name custom2k -o params_custom2k.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dist-ribut-us/docs/mixnetrouting/cyclic/cipher"
+	"io"
+	"math/big"
+	"os"
+	"text/template"
+)
+
+func main() {
+	bits := flag.Int("bits", 1024, "minimum bit length of the prime")
+	a := flag.Int64("a", 2, "fixed prime factor, must be 2 for (a*b)^n+1 to be odd")
+	n := flag.Int64("n", 0, "exponent, must be a power of 2; 0 picks the smallest that keeps a*b under 16 bits")
+	start := flag.Int64("start", 0, "smallest value of b to try")
+	id := flag.Int("id", 0, "Params ID carried in each cipher, 1-255")
+	name := flag.String("name", "", "Params name used for lookup")
+	roots := flag.Int("roots", 256, "number of primitive roots to include in the table")
+	pkg := flag.String("pkg", "cipher", "package of the generated file")
+	varName := flag.String("var", "", "name of the generated Params variable, defaults to Params<id>")
+	out := flag.String("o", "", "output file, defaults to stdout")
+	flag.Parse()
+
+	if *id < 1 || *id > 255 || *name == "" {
+		fail("-id must be between 1 and 255 and -name must be set")
+	}
+	if *n == 0 {
+		*n = 1
+		for int64(*bits) > *n*16 {
+			*n *= 2
+		}
+	}
+	if *varName == "" {
+		*varName = fmt.Sprintf("Params%d", *id)
+	}
+
+	p, err := cipher.SearchFermat(*bits, *a, *n, *start)
+	if err != nil {
+		fail(err.Error())
+	}
+	p.ID = byte(*id)
+	p.Name = *name
+	p.FillRoots(*roots)
+	if err := p.Prove(); err != nil {
+		fail(err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "found (%d*%d)^%d + 1, %d bits\n", *a, p.Factors[1], *n, p.P.BitLen())
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fail(err.Error())
+		}
+		defer f.Close()
+		w = f
+	}
+
+	err = tmpl.Execute(w, struct {
+		Pkg, Var, Qual string
+		A, N           int64
+		Bits           int
+		P              *cipher.Params
+	}{
+		Pkg:  *pkg,
+		Var:  *varName,
+		Qual: qualifier(*pkg),
+		A:    *a,
+		N:    *n,
+		Bits: p.P.BitLen(),
+		P:    p,
+	})
+	if err != nil {
+		fail(err.Error())
+	}
+}
+
+func qualifier(pkg string) string {
+	if pkg == "cipher" {
+		return ""
+	}
+	return "cipher."
+}
+
+func fail(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(1)
+}
+
+var tmpl = template.Must(template.New("params").Funcs(template.FuncMap{
+	"str": func(b *big.Int) string { return b.String() },
+}).Parse(`// Code generated by paramgen. DO NOT EDIT.
+
+package {{.Pkg}}
+
+import (
+{{- if .Qual}}
+	"github.com/dist-ribut-us/docs/mixnetrouting/cyclic/cipher"
+{{- end}}
+	"math/big"
+)
+
+// {{.Var}} is ({{.A}}*{{index .P.Factors 1}})^{{.N}} + 1, a {{.Bits}} bit prime.
+var {{.Var}} = func() *{{.Qual}}Params {
+	p, _ := new(big.Int).SetString("{{str .P.P}}", 10)
+	params := {{.Qual}}NewParams({{.P.ID}}, "{{.P.Name}}", p, []*big.Int{
+{{- range .P.Factors}}
+		big.NewInt({{str .}}),
+{{- end}}
+	})
+	params.Roots = []*big.Int{
+{{- range .P.Roots}}
+		big.NewInt({{str .}}),
+{{- end}}
+	}
+	return params
+}()
+
+func init() {
+	if err := {{.Var}}.Prove(); err != nil {
+		panic(err)
+	}
+	if err := {{.Qual}}Register({{.Var}}); err != nil {
+		panic(err)
+	}
+}
+`))
@@ -0,0 +1,187 @@
+package cipher
+
+import (
+	"github.com/dist-ribut-us/errors"
+	"math/big"
+	"sync"
+)
+
+// Params holds a prime and the public values derived from it. Every node on a
+// route must cycle with the same Params. All of the registered parameter sets
+// use primes of the form (a*b)^n + 1 so that the factorization of p-1 is known,
+// which makes finding primitive roots cheap.
+type Params struct {
+	// ID is carried in each Cipher so that nodes can reject a mismatch.
+	ID   byte
+	Name string
+	// P is the prime
+	P *big.Int
+	// Factors are the distinct prime factors of P-1
+	Factors []*big.Int
+	// Roots is the table of primitive roots. If it is not populated, it will be
+	// extended as needed by searching from 2.
+	Roots []*big.Int
+	// Backend is the arithmetic Cycle and Final use. It does not change the
+	// result, so it does not need to match between nodes. NewParams sets
+	// ConstantTime so a routing node does not leak its key through timing.
+	Backend Backend
+
+	phi  *big.Int
+	pLen int
+	mod  *modulus
+	// tbls holds a fixedBase for each root in Roots that has been used
+	tbls []fixedBase
+	mux  sync.Mutex
+}
+
+const (
+	// ErrUnknownParams is returned when looking up a Params that has not been
+	// registered.
+	ErrUnknownParams errors.String = "Unknown cipher params"
+	// ErrParamsMismatch is returned when a Cipher is used with Params other than
+	// the ones it was started with.
+	ErrParamsMismatch errors.String = "Cipher params do not match"
+	// ErrParamsTaken is returned when registering a Params with an ID or Name
+	// that is already in use.
+	ErrParamsTaken errors.String = "Cipher params ID or Name already registered"
+)
+
+// NewParams creates a Params for the prime p where factors are the distinct
+// prime factors of p-1 and the ConstantTime Backend. The root table will be
+// populated as it is used.
+func NewParams(id byte, name string, p *big.Int, factors []*big.Int) *Params {
+	return &Params{
+		ID:      id,
+		Name:    name,
+		P:       p,
+		Factors: factors,
+		Backend: ConstantTime,
+		phi:     new(big.Int).Sub(p, bigOne),
+		pLen:    len(p.Bytes()),
+		mod:     newModulus(p),
+	}
+}
+
+// genFermat returns the prime (a*b)^n + 1 as Params. It does not check that the
+// value is prime.
+func genFermat(id byte, name string, a, b, n int64) *Params {
+	p := big.NewInt(a * b)
+	p.Exp(p, big.NewInt(n), nil)
+	p.Add(p, bigOne)
+	return NewParams(id, name, p, []*big.Int{big.NewInt(a), big.NewInt(b)})
+}
+
+// The registered parameter sets, in order of increasing security. Larger primes
+// are slower and increase the overhead of each key.
+var (
+	// Demo is (2*571)^32 + 1, a 326 bit prime. It is large enough to show the
+	// approach is practical, but may not be large enough for actual use.
+	Demo = genFermat(1, "demo", 2, 571, 32)
+	// Level1K is (2*33581)^64 + 1, a 1027 bit prime.
+	Level1K = genFermat(2, "1k", 2, 33581, 64)
+	// Level2K is (2*40867)^128 + 1, a 2089 bit prime.
+	Level2K = genFermat(3, "2k", 2, 40867, 128)
+	// Level3K is (2*3511)^256 + 1, a 3272 bit prime.
+	Level3K = genFermat(4, "3k", 2, 3511, 256)
+
+	// Default is the Params used when none is specified.
+	Default = Demo
+)
+
+var (
+	registryMux sync.RWMutex
+	registryIDs = make(map[byte]*Params)
+	registryNms = make(map[string]*Params)
+)
+
+func init() {
+	for _, p := range []*Params{Demo, Level1K, Level2K, Level3K} {
+		Register(p)
+	}
+}
+
+// Register adds a Params to the registry so that it can be found by ID or Name.
+func Register(p *Params) error {
+	registryMux.Lock()
+	defer registryMux.Unlock()
+	if _, ok := registryIDs[p.ID]; ok {
+		return ErrParamsTaken
+	}
+	if _, ok := registryNms[p.Name]; ok {
+		return ErrParamsTaken
+	}
+	registryIDs[p.ID] = p
+	registryNms[p.Name] = p
+	return nil
+}
+
+// Lookup a registered Params by ID
+func Lookup(id byte) (*Params, error) {
+	registryMux.RLock()
+	p, ok := registryIDs[id]
+	registryMux.RUnlock()
+	if !ok {
+		return nil, ErrUnknownParams
+	}
+	return p, nil
+}
+
+// LookupName finds a registered Params by Name
+func LookupName(name string) (*Params, error) {
+	registryMux.RLock()
+	p, ok := registryNms[name]
+	registryMux.RUnlock()
+	if !ok {
+		return nil, ErrUnknownParams
+	}
+	return p, nil
+}
+
+// PrimeLength returns the byte length of the prime
+func (p *Params) PrimeLength() int { return p.pLen }
+
+// root returns the ith primitive root, extending the table if necessary.
+func (p *Params) root(i int) *big.Int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.fillRoots(i + 1)
+	return p.Roots[i]
+}
+
+// fillRoots extends the root table to hold at least n roots. The caller must
+// hold the lock.
+func (p *Params) fillRoots(n int) {
+	for len(p.Roots) < n {
+		r := bigOne
+		if ln := len(p.Roots); ln > 0 {
+			r = p.Roots[ln-1]
+		}
+		p.Roots = append(p.Roots, p.nextRoot(r))
+	}
+}
+
+// nextRoot finds the first primitive root greater than r
+func (p *Params) nextRoot(r *big.Int) *big.Int {
+	r = new(big.Int).Set(r)
+	for {
+		r.Add(r, bigOne)
+		if p.IsRoot(r) {
+			return r
+		}
+	}
+}
+
+// IsRoot checks if r is a primitive root of p. It is a primitive root if for
+// every prime factor r^(phi/pf) % p != 1
+func (p *Params) IsRoot(r *big.Int) bool {
+	// z is used for intermediate calculations
+	z := new(big.Int)
+	for _, pf := range p.Factors {
+		z.Div(p.phi, pf)
+		z.Exp(r, z, p.P)
+		if z.Cmp(bigOne) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,47 @@
+package cipher
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+)
+
+func TestRegisteredParams(t *testing.T) {
+	for _, p := range []*Params{Demo, Level1K, Level2K, Level3K} {
+		assert.True(t, p.P.ProbablyPrime(20), p.Name)
+
+		// the factors should completely divide p-1
+		z := new(big.Int).Set(p.phi)
+		m := new(big.Int)
+		for _, f := range p.Factors {
+			for {
+				q, r := new(big.Int).DivMod(z, f, m)
+				if r.Sign() != 0 {
+					break
+				}
+				z = q
+			}
+		}
+		assert.Equal(t, 0, z.Cmp(bigOne), p.Name)
+
+		byID, err := Lookup(p.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, p, byID)
+		byName, err := LookupName(p.Name)
+		assert.NoError(t, err)
+		assert.Equal(t, p, byName)
+	}
+
+	_, err := Lookup(255)
+	assert.Equal(t, ErrUnknownParams, err)
+	assert.Equal(t, ErrParamsTaken, Register(NewParams(Demo.ID, "other", Demo.P, Demo.Factors)))
+}
+
+func TestRoots(t *testing.T) {
+	// 2 is not a primitive root of the demo prime, 3 is
+	assert.False(t, Demo.IsRoot(big.NewInt(2)))
+	assert.Equal(t, big.NewInt(3), Demo.root(0))
+	for i := 0; i < 10; i++ {
+		assert.True(t, Demo.IsRoot(Demo.root(i)))
+	}
+}
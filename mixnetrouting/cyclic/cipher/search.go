@@ -0,0 +1,147 @@
+package cipher
+
+import (
+	"github.com/dist-ribut-us/errors"
+	"math/big"
+)
+
+const (
+	// ErrBadFactors is returned by Prove when Factors is not the complete set of
+	// distinct prime factors of P-1.
+	ErrBadFactors errors.String = "Factors are not the prime factors of p-1"
+	// ErrNotPrime is returned by Prove when no witness can be found that P is
+	// prime.
+	ErrNotPrime errors.String = "Could not prove p is prime"
+	// ErrBadRoot is returned by Prove when the root table contains a value that
+	// is not a primitive root or is out of order.
+	ErrBadRoot errors.String = "Root table contains a bad value"
+	// ErrBadSearch is returned when the search arguments cannot produce a prime.
+	ErrBadSearch errors.String = "Search requires a of 2, positive bits and n a power of 2"
+)
+
+// maxWitness bounds the search for a Lucas witness in Prove. If p is prime,
+// primitive roots are dense enough that one is found long before this.
+const maxWitness = 10000
+
+// Prove checks that Params are safe to use. Every factor must be prime and
+// together they must completely factor p-1. Given the complete factorization,
+// a primitive root of p is a Lucas witness that p is prime. Finally, every
+// value in the root table must be a primitive root and the table must be in
+// increasing order.
+func (p *Params) Prove() error {
+	z := new(big.Int).Set(p.phi)
+	q, m := new(big.Int), new(big.Int)
+	for _, f := range p.Factors {
+		// The factors are small enough that ProbablyPrime is exact
+		if f.BitLen() > 64 || !f.ProbablyPrime(0) {
+			return ErrBadFactors
+		}
+		divided := false
+		for {
+			q.DivMod(z, f, m)
+			if m.Sign() != 0 {
+				break
+			}
+			z.Set(q)
+			divided = true
+		}
+		if !divided {
+			return ErrBadFactors
+		}
+	}
+	if z.Cmp(bigOne) != 0 {
+		return ErrBadFactors
+	}
+
+	// Lucas test: if w^(p-1) % p == 1 and w^((p-1)/f) % p != 1 for every f,
+	// then p is prime.
+	w := big.NewInt(1)
+	witness := false
+	for i := 0; i < maxWitness && !witness; i++ {
+		w.Add(w, bigOne)
+		if z.Exp(w, p.phi, p.P).Cmp(bigOne) != 0 {
+			return ErrNotPrime
+		}
+		witness = p.IsRoot(w)
+	}
+	if !witness {
+		return ErrNotPrime
+	}
+
+	prev := bigOne
+	for _, r := range p.Roots {
+		if r.Cmp(prev) <= 0 || r.Cmp(p.P) >= 0 || !p.IsRoot(r) {
+			return ErrBadRoot
+		}
+		prev = r
+	}
+	return nil
+}
+
+// FillRoots extends the root table so that it holds at least n roots.
+func (p *Params) FillRoots(n int) {
+	p.mux.Lock()
+	p.fillRoots(n)
+	p.mux.Unlock()
+}
+
+// SearchFermat looks for a prime of the form (a*b)^n + 1 of at least the given
+// bit length where a is a given prime and b is a prime greater than or equal to
+// start. If start is too small to reach the bit length, the search begins at
+// the smallest b that does. For primes to exist n must be a power of 2 and a*b
+// must be even, so a must be 2, the only even prime; any other a would fail
+// Prove. Otherwise ErrBadSearch is returned, since for odd n > 1 the search
+// would never end. The factorization of p-1 is known by construction and the
+// returned Params has passed Prove. It has an ID of 0 and no Name.
+func SearchFermat(bits int, a, n, start int64) (*Params, error) {
+	if bits < 1 || n < 1 || n&(n-1) != 0 || a != 2 {
+		return nil, ErrBadSearch
+	}
+	bigA, bigN := big.NewInt(a), big.NewInt(n)
+
+	// b starts at the smallest value so that (a*b)^n >= 2^(bits-1)
+	b := minBase(bits-1, bigN)
+	b.Add(b, bigA).Sub(b, bigOne).Div(b, bigA)
+	if s := big.NewInt(start); s.Cmp(b) > 0 {
+		b = s
+	}
+	if b.Bit(0) == 0 {
+		b.Add(b, bigOne)
+	}
+
+	p := new(big.Int)
+	for two := big.NewInt(2); ; b.Add(b, two) {
+		if !b.ProbablyPrime(0) {
+			continue
+		}
+		p.Mul(bigA, b)
+		p.Exp(p, bigN, nil)
+		p.Add(p, bigOne)
+		if !p.ProbablyPrime(20) {
+			continue
+		}
+		params := NewParams(0, "", p, []*big.Int{bigA, b})
+		if err := params.Prove(); err != nil {
+			return nil, err
+		}
+		return params, nil
+	}
+}
+
+// minBase returns the smallest x such that x^n >= 2^bits
+func minBase(bits int, n *big.Int) *big.Int {
+	target := new(big.Int).Lsh(bigOne, uint(bits))
+	lo := big.NewInt(1)
+	hi := new(big.Int).Lsh(bigOne, uint(bits/int(n.Int64())+1))
+	z := new(big.Int)
+	for lo.Cmp(hi) < 0 {
+		mid := new(big.Int).Add(lo, hi)
+		mid.Rsh(mid, 1)
+		if z.Exp(mid, n, nil).Cmp(target) >= 0 {
+			hi = mid
+		} else {
+			lo = mid.Add(mid, bigOne)
+		}
+	}
+	return lo
+}
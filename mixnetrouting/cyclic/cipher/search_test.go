@@ -0,0 +1,47 @@
+package cipher
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+)
+
+func TestSearchFermat(t *testing.T) {
+	// Should rediscover the demo prime
+	p, err := SearchFermat(Demo.P.BitLen(), 2, 32, 500)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, Demo.P.Cmp(p.P))
+
+	p, err = SearchFermat(512, 2, 32, 0)
+	assert.NoError(t, err)
+	assert.True(t, p.P.BitLen() >= 512)
+	assert.True(t, p.P.ProbablyPrime(20))
+
+	_, err = SearchFermat(512, 3, 32, 0)
+	assert.Equal(t, ErrBadSearch, err)
+	_, err = SearchFermat(512, 4, 32, 0)
+	assert.Equal(t, ErrBadSearch, err)
+	_, err = SearchFermat(512, 2, 3, 0)
+	assert.Equal(t, ErrBadSearch, err)
+}
+
+func TestProve(t *testing.T) {
+	for _, p := range []*Params{Demo, Level1K} {
+		p.FillRoots(5)
+		assert.NoError(t, p.Prove())
+	}
+
+	// missing a factor
+	bad := NewParams(0, "", Demo.P, []*big.Int{big.NewInt(2)})
+	assert.Equal(t, ErrBadFactors, bad.Prove())
+
+	// composite with a "complete" factorization: 2^4+1 = 17 is prime, but
+	// 2^3*3+1 = 25 is not
+	bad = NewParams(0, "", big.NewInt(25), []*big.Int{big.NewInt(2), big.NewInt(3)})
+	assert.Equal(t, ErrNotPrime, bad.Prove())
+
+	// 2 is not a primitive root of the demo prime
+	bad = NewParams(0, "", Demo.P, Demo.Factors)
+	bad.Roots = []*big.Int{big.NewInt(2)}
+	assert.Equal(t, ErrBadRoot, bad.Prove())
+}
@@ -0,0 +1,21 @@
+package cyclic
+
+import (
+	"github.com/dist-ribut-us/docs/mixnetrouting/cyclic/cipher"
+)
+
+// NewDirectRoute creates a route with the peer as its only hop, for peers that
+// do not need to hide their locations from each other. The message is sealed
+// to the peer's exchange key and padded to a size class like any other
+// message, so the package cannot be told apart from routed traffic. A single
+// relay may be pushed in front of the peer. An error is returned if the peer
+// is not verified.
+func NewDirectRoute(peer *PubNode, p *cipher.Params) (*RouteBuilder, error) {
+	rb := NewRouteBuilder()
+	rb.Params = p
+	rb.BaseKey = peer.Key
+	if err := rb.Push(peer); err != nil {
+		return nil, err
+	}
+	return rb, nil
+}
@@ -0,0 +1,211 @@
+package cyclic
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/crypto"
+	"sort"
+	"time"
+)
+
+const (
+	// EpochTagLen is the length of the epoch tag in a Map packet
+	EpochTagLen = 4
+	// EpochPeriod is the length of an epoch. Every node uses the same schedule,
+	// so the tag in a packet only reveals the epoch it was built in.
+	EpochPeriod = time.Hour
+	// DefaultEpochsAhead is the number of future epochs that keys are published
+	// for, so that routes can be built before an epoch begins.
+	DefaultEpochsAhead = 2
+	// epochKeyLen is the marshaled length of an EpochKey
+	epochKeyLen = EpochTagLen + crypto.KeyLength
+)
+
+// EpochOf returns the epoch containing t
+func EpochOf(t time.Time) uint32 {
+	return uint32(t.Unix() / int64(EpochPeriod/time.Second))
+}
+
+// EpochKey is a public exchange key that is only valid during one epoch
+type EpochKey struct {
+	Epoch uint32
+	Key   *crypto.XchgPub
+}
+
+// Start of the epoch the key is valid for
+func (e EpochKey) Start() time.Time {
+	return time.Unix(int64(e.Epoch)*int64(EpochPeriod/time.Second), 0)
+}
+
+// End of the epoch the key is valid for
+func (e EpochKey) End() time.Time {
+	return e.Start().Add(EpochPeriod)
+}
+
+// EpochKey returns the key the node advertises for the epoch containing t or
+// nil.
+func (n *PubNode) EpochKey(t time.Time) *crypto.XchgPub {
+	epoch := EpochOf(t)
+	for _, e := range n.Epochs {
+		if e.Epoch == epoch {
+			return e.Key
+		}
+	}
+	return nil
+}
+
+// pushKey returns the key that Push seals a packet to and the tag for it. If
+// the node does not advertise a key for the current epoch, its static key is
+// used with a tag of 0.
+func (n *PubNode) pushKey(t time.Time) (uint32, *crypto.XchgPub) {
+	if key := n.EpochKey(t); key != nil {
+		return EpochOf(t), key
+	}
+	return 0, n.Key
+}
+
+func epochTag(epoch uint32) []byte {
+	tag := make([]byte, EpochTagLen)
+	binary.BigEndian.PutUint32(tag, epoch)
+	return tag
+}
+
+func marshalEpochs(b []byte, es []EpochKey) []byte {
+	for _, e := range es {
+		b = append(b, epochTag(e.Epoch)...)
+		b = append(b, e.Key.Slice()...)
+	}
+	return b
+}
+
+func unmarshalEpochs(b []byte) ([]EpochKey, bool) {
+	if len(b)%epochKeyLen != 0 {
+		return nil, false
+	}
+	var es []EpochKey
+	for ; len(b) > 0; b = b[epochKeyLen:] {
+		es = append(es, EpochKey{
+			Epoch: binary.BigEndian.Uint32(b),
+			Key:   crypto.XchgPubFromSlice(b[EpochTagLen:epochKeyLen]),
+		})
+	}
+	return es, true
+}
+
+// DefaultMaxSeen is the MaxSeen of a new PrivNode
+const DefaultMaxSeen = 1 << 16
+
+// seenKeys is the replay cache of one of the node's keys. It maps the ephemeral
+// key of each packet the key has opened to the shared key if the packet was
+// Reusable or to nil if it may only be routed once. It lives as long as the
+// key, so a packet cannot be replayed while the key can still open it.
+type seenKeys map[string]*crypto.Symmetric
+
+// record the shared key for an ephemeral key, nil for a packet that may only be
+// routed once. When the cache holds max keys a Reusable packet is not cached
+// and a single use packet is refused with ErrSeenFull.
+func (s seenKeys) record(ex *crypto.XchgPub, shared *crypto.Symmetric, max int) error {
+	if len(s) >= max {
+		if shared == nil {
+			return ErrSeenFull
+		}
+		return nil
+	}
+	s[string(ex.Slice())] = shared
+	return nil
+}
+
+// epochKey is the private key for an epoch and its replay cache
+type epochKey struct {
+	Key  *crypto.XchgPair
+	Seen seenKeys
+}
+
+func newEpochKey() *epochKey {
+	return &epochKey{
+		Key:  crypto.GenerateXchgPair(),
+		Seen: make(seenKeys),
+	}
+}
+
+func (k *epochKey) erase() {
+	zero(k.Key.Priv().Slice())
+	k.Key, k.Seen = nil, nil
+}
+
+func pubEpochs(keys map[uint32]*epochKey) []EpochKey {
+	if len(keys) == 0 {
+		return nil
+	}
+	es := make([]EpochKey, 0, len(keys))
+	for epoch, k := range keys {
+		es = append(es, EpochKey{
+			Epoch: epoch,
+			Key:   k.Key.Pub(),
+		})
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].Epoch < es[j].Epoch })
+	return es
+}
+
+// seenKey looks an ephemeral key up in the replay caches of the node's keys for
+// the epoch tag, the current key first and then the keys kept after Rotate. It
+// returns the recorded shared key and true if the ephemeral key was seen.
+func (n *PrivNode) seenKey(ex *crypto.XchgPub, epoch uint32) (*crypto.Symmetric, bool) {
+	if _, seen := keyFor(n.Key, n.seen, n.epochs, epoch); seen != nil {
+		if key, ok := seen[string(ex.Slice())]; ok {
+			return key, true
+		}
+	}
+	for _, o := range n.old {
+		if _, seen := keyFor(o.Key, o.Seen, o.Epochs, epoch); seen != nil {
+			if key, ok := seen[string(ex.Slice())]; ok {
+				return key, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// UpdateEpochs creates keys for the epoch containing now and the next ahead
+// epochs. Keys for epochs that ended before the previous epoch are erased along
+// with their replay caches, so a packet recorded in an old epoch cannot be
+// opened even if the node is later compromised. Once a node has epoch keys it
+// should call UpdateEpochs at least once an epoch and republish its PubNode.
+func (n *PrivNode) UpdateEpochs(now time.Time, ahead int) {
+	if n.epochs == nil {
+		n.epochs = make(map[uint32]*epochKey)
+	}
+	cur := EpochOf(now)
+	for e := cur; e <= cur+uint32(ahead); e++ {
+		if _, ok := n.epochs[e]; !ok {
+			n.epochs[e] = newEpochKey()
+		}
+	}
+	for e, k := range n.epochs {
+		if e+1 < cur {
+			k.erase()
+			delete(n.epochs, e)
+		}
+	}
+}
+
+// Epochs returns the epochs the node holds keys for, in order
+func (n *PrivNode) Epochs() []uint32 {
+	es := make([]uint32, 0, len(n.epochs))
+	for e := range n.epochs {
+		es = append(es, e)
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i] < es[j] })
+	return es
+}
+
+// keyFor returns the key and replay cache for an epoch tag
+func keyFor(key *crypto.XchgPair, seen seenKeys, epochs map[uint32]*epochKey, epoch uint32) (*crypto.XchgPair, seenKeys) {
+	if epoch == 0 {
+		return key, seen
+	}
+	if k, ok := epochs[epoch]; ok {
+		return k.Key, k.Seen
+	}
+	return nil, nil
+}
@@ -0,0 +1,99 @@
+package cyclic
+
+import (
+	"github.com/dist-ribut-us/docs/mixnetrouting/cyclic/cipher"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+)
+
+// fuzzMaxData keeps each exec fast, Route cycles every chunk of the cipher
+const fuzzMaxData = 16 * 1024
+
+// fuzzPackage copies the inputs, Route mutates the Map in place
+func fuzzPackage(m, data, acc []byte, id byte, nilCipher bool) *RoutePackage {
+	rm := &RouteMsg{Map: append([]byte(nil), m...)}
+	if !nilCipher {
+		rm.Cipher = &cipher.Cipher{
+			Data:     append([]byte(nil), data...),
+			Acc:      new(big.Int).SetBytes(acc),
+			ParamsID: id,
+		}
+	}
+	return &RoutePackage{RouteMsg: rm}
+}
+
+func FuzzRoute(f *testing.F) {
+	n, hop := NewPrivNode(), NewPrivNode()
+	rb := NewRouteBuilder()
+	rb.Params = n.Params
+	if err := rb.Push(hop.Pub()); err != nil {
+		f.Fatal(err)
+	}
+	if err := rb.Push(n.Pub()); err != nil {
+		f.Fatal(err)
+	}
+	rt, err := rb.GetRoute([]byte("fuzz"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(rt.Map, rt.Data, rt.Acc.Bytes(), rt.ParamsID, false)
+	f.Add([]byte{}, []byte{}, []byte{}, n.Params.ID, true)
+	f.Add(make([]byte, PacketLength-1), []byte{}, []byte{}, n.Params.ID, false)
+
+	f.Fuzz(func(t *testing.T, m, data, acc []byte, id byte, nilCipher bool) {
+		if len(data) > fuzzMaxData {
+			return
+		}
+		ln := len(m)
+		rp := fuzzPackage(m, data, acc, id, nilCipher)
+		if err := n.Route(rp); err == nil && rp.Map != nil && len(rp.Map) != ln {
+			t.Fatal("Route changed the length of the Map")
+		}
+	})
+}
+
+func FuzzOpen(f *testing.F) {
+	n, hop := NewPrivNode(), NewPrivNode()
+	rb := n.NewReceiveRoute()
+	if err := rb.Push(hop.Pub()); err != nil {
+		f.Fatal(err)
+	}
+	rt, err := rb.GetRoute([]byte("fuzz"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	if err := hop.Route(rt); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(rt.Map, rt.Data, rt.Acc.Bytes(), rt.ParamsID, false)
+	f.Add([]byte{}, []byte{}, []byte{}, n.Params.ID, true)
+
+	f.Fuzz(func(t *testing.T, m, data, acc []byte, id byte, nilCipher bool) {
+		if len(data) > fuzzMaxData {
+			return
+		}
+		n.Receive(fuzzPackage(m, data, acc, id, nilCipher))
+		// Open is also reached without Route
+		rp := fuzzPackage(m, data, acc, id, nilCipher)
+		rp.CK = m
+		n.Open(rp)
+	})
+}
+
+func TestMalformed(t *testing.T) {
+	n := NewPrivNode()
+	c := &cipher.Cipher{Acc: new(big.Int), ParamsID: n.Params.ID}
+	for _, rp := range []*RoutePackage{
+		nil,
+		{},
+		{RouteMsg: &RouteMsg{Map: make([]byte, PacketLength)}},
+		{RouteMsg: &RouteMsg{Map: make([]byte, PacketLength-1), Cipher: c}},
+	} {
+		assert.Equal(t, ErrBadMap, n.Route(rp))
+		_, err := n.Receive(rp)
+		assert.Equal(t, ErrBadMap, err)
+	}
+	_, err := n.Open(&RoutePackage{RouteMsg: &RouteMsg{}})
+	assert.Equal(t, ErrBadMap, err)
+}
@@ -0,0 +1,82 @@
+package cyclic
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/docs/mixnetrouting/nodeid"
+	"github.com/dist-ribut-us/docs/mixnetrouting/pow"
+	"github.com/dist-ribut-us/errors"
+)
+
+const (
+	// IDLen is the byte length of node IDs, set for every scheme by nodeid.Len
+	IDLen = nodeid.Len
+	// BoxIDLen is the byte length of the secret box containing the flags and
+	// the next ID
+	BoxIDLen = crypto.Overhead + 1 + IDLen
+	// PacketLength is the length of a single packet in the Route Map
+	PacketLength = crypto.KeyLength + EpochTagLen + StampLen + crypto.NonceLength + BoxIDLen
+)
+
+const (
+	// ErrUnverified is returned when a PubNode's ID does not match its keys
+	ErrUnverified errors.String = "PubNode ID does not match its keys"
+	// ErrInsufficientWork is returned when a PubNode's Work is not a proof for
+	// its ID at nodeid.Work
+	ErrInsufficientWork errors.String = "PubNode ID does not have enough proof-of-work"
+	// ErrBadNodeSig is returned when a PubNode is not signed by its SigningKey
+	ErrBadNodeSig errors.String = "PubNode is not signed by its SigningKey"
+)
+
+// eom is the Next value sealed in the first packet pushed onto a route. It
+// marks the end of the route in a way that is authenticated by the box.
+var eom = encode(make([]byte, IDLen))
+
+// NodeID returns the ID for an exchange key and a signing key, the first IDLen
+// bytes of the digest of both. Deriving the ID from the signing key binds it to
+// the node, so only the node can sign for its ID.
+func NodeID(key *crypto.XchgPub, signingKey ed25519.PublicKey) []byte {
+	dig := crypto.GetDigest(key.Slice(), signingKey)
+	return append([]byte(nil), dig.Slice()[:IDLen]...)
+}
+
+// workData is what the ID proof-of-work is computed over
+func workData(id []byte, key *crypto.XchgPub) []byte {
+	return append(append(make([]byte, 0, len(id)+crypto.KeyLength), id...), key.Slice()...)
+}
+
+// pubNodeLen is the length of a marshaled PubNode without epoch keys
+func pubNodeLen() int {
+	return IDLen + crypto.KeyLength + ed25519.PublicKeySize + pow.NonceLen + 1
+}
+
+// newIdentity generates an exchange key, a signing key, their ID and the
+// proof-of-work for the ID at the current nodeid.Work. It takes about
+// 2^nodeid.Work digests.
+func newIdentity() ([]byte, *crypto.XchgPair, ed25519.PrivateKey, uint64) {
+	key := crypto.GenerateXchgPair()
+	pub, signingKey, _ := ed25519.GenerateKey(nil)
+	id := NodeID(key.Pub(), pub)
+	return id, key, signingKey, pow.Solve(workData(id, key.Pub()), nodeid.Work())
+}
+
+// Verify that the PubNode's ID was derived from its Key and SigningKey and that
+// Work is a proof-of-work for the ID at nodeid.Work. StampWork must be a valid
+// difficulty and Sig must be the node's signature, which covers the epoch keys.
+func (n *PubNode) Verify() error {
+	if n.Key == nil || len(n.SigningKey) != ed25519.PublicKeySize ||
+		!bytes.Equal(n.ID, NodeID(n.Key, n.SigningKey)) {
+		return ErrUnverified
+	}
+	if !pow.Check(workData(n.ID, n.Key), n.Work, nodeid.Work()) {
+		return ErrInsufficientWork
+	}
+	if err := pow.Validate(n.StampWork); err != nil {
+		return err
+	}
+	if len(n.Sig) != ed25519.SignatureSize || !ed25519.Verify(n.SigningKey, n.body(), n.Sig) {
+		return ErrBadNodeSig
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package cyclic
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"time"
+)
+
+// DefaultGrace is how long a key is kept after Rotate so that packets already
+// in flight can finish.
+const DefaultGrace = 2 * time.Minute
+
+// oldKey is a key that has been rotated out with its replay cache and epoch
+// keys
+type oldKey struct {
+	ID     []byte
+	Key    *crypto.XchgPair
+	Seen   seenKeys
+	Epochs map[uint32]*epochKey
+	Until  time.Time
+}
+
+// Rotate gives the node a new overlay identity. A new exchange key, signing key
+// and ID are generated with proof-of-work at nodeid.Work, along with new keys
+// for the same epochs if the node has epoch keys. The old key is kept for Grace
+// so that packets already in flight can be routed, then it is erased. Routes
+// through the old identity stop working once it is erased, so the node should
+// publish its new PubNode and rebuild its receive routes.
+func (n *PrivNode) Rotate() {
+	n.old = append(n.old, &oldKey{
+		ID:     n.ID,
+		Key:    n.Key,
+		Seen:   n.seen,
+		Epochs: n.epochs,
+		Until:  n.Now().Add(n.Grace),
+	})
+	n.ID, n.Key, n.SigningKey, n.Work = newIdentity()
+	n.seen = make(seenKeys)
+	if n.epochs != nil {
+		epochs := make(map[uint32]*epochKey, len(n.epochs))
+		for e := range n.epochs {
+			epochs[e] = newEpochKey()
+		}
+		n.epochs = epochs
+	}
+	n.Erase()
+}
+
+// Erase the old keys whose grace period has ended at Now. Route and Open call
+// Erase first, so expired keys are never used and are erased as soon as the
+// node handles a message.
+func (n *PrivNode) Erase() {
+	if len(n.old) == 0 {
+		return
+	}
+	now := n.Now()
+	keep := n.old[:0]
+	for _, o := range n.old {
+		if now.Before(o.Until) {
+			keep = append(keep, o)
+			continue
+		}
+		zero(o.Key.Priv().Slice())
+		for _, k := range o.Epochs {
+			k.erase()
+		}
+		o.Key, o.Seen, o.Epochs = nil, nil, nil
+	}
+	for i := len(keep); i < len(n.old); i++ {
+		n.old[i] = nil
+	}
+	n.old = keep
+}
+
+// OldKeys returns the number of keys being kept after Rotate
+func (n *PrivNode) OldKeys() int {
+	return len(n.old)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// openPacket opens the box in a map packet with the node's key for the epoch
+// or, if that fails, with a key kept after Rotate. The replay cache of the key
+// that opened it is returned with the shared key.
+func (n *PrivNode) openPacket(ex *crypto.XchgPub, epoch uint32, box []byte, nonce *crypto.Nonce) (*crypto.Symmetric, []byte, seenKeys, error) {
+	if key, seen := keyFor(n.Key, n.seen, n.epochs, epoch); key != nil {
+		shared := key.Shared(ex)
+		if next, err := shared.NonceOpen(box, nonce); err == nil {
+			return shared, next, seen, nil
+		}
+	}
+	for _, o := range n.old {
+		if key, seen := keyFor(o.Key, o.Seen, o.Epochs, epoch); key != nil {
+			shared := key.Shared(ex)
+			if next, err := shared.NonceOpen(box, nonce); err == nil {
+				return shared, next, seen, nil
+			}
+		}
+	}
+	return nil, nil, nil, crypto.ErrDecryptionFailed
+}
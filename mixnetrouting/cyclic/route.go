@@ -1,38 +1,165 @@
 package cyclic
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"github.com/dist-ribut-us/crypto"
 	"github.com/dist-ribut-us/docs/mixnetrouting/cyclic/cipher"
+	"github.com/dist-ribut-us/docs/mixnetrouting/pow"
+	"github.com/dist-ribut-us/docs/mixnetrouting/sizeclass"
+	"github.com/dist-ribut-us/errors"
+	"time"
 )
 
 const (
-	// IDLen in bytes  just for demo
-	IDLen = 10
-	// BoxIDLen is the byte length of the secret box containing the next ID
-	BoxIDLen = crypto.Overhead + IDLen
+	// MaxHops is the number of packets in every Route Map. Shorter maps are
+	// padded so that the number of hops cannot be seen.
+	MaxHops = 16
+	// Reusable is set in the flags of a map packet that may be routed more
+	// than once, as the packets of a receive route are
+	Reusable byte = 1
 )
 
 var encode = base64.URLEncoding.EncodeToString
 
-// PrivNode is not shared
+// PrivNode is not shared. Cache holds the private base keys for the receive
+// routes the node has created, keyed by the cipher key of the node's own packet
+// in the route. If Blacklist is set, Route refuses to forward to a blocked
+// node. Grace is how long the previous key is kept after Rotate. StampWork is
+// the proof-of-work Route requires in the stamp of each map packet; it is
+// advertised in the PubNode. Now is the clock used for key expiry and can be
+// replaced for testing. MaxSeen limits the replay cache kept for each of the
+// node's keys.
 type PrivNode struct {
-	ID  []byte
-	Key *crypto.XchgPair
+	ID         []byte
+	Key        *crypto.XchgPair
+	SigningKey ed25519.PrivateKey
+	Work       uint64
+	StampWork  int
+	Params     *cipher.Params
+	Cache      map[string]*crypto.XchgPriv
+	Blacklist  Blacklist
+	Grace      time.Duration
+	Now        func() time.Time
+	MaxSeen    int
+	old        []*oldKey
+	seen       seenKeys
+	epochs     map[uint32]*epochKey
+}
+
+// Blacklist is a set of nodes that messages will not be forwarded to. It is
+// satisfied by the blacklist package and by path.Blacklist.
+type Blacklist interface {
+	Blocked(id string) bool
 }
 
 // NewPrivNode creates a PrivateNode with the ID set to the head of the digest
-// of the public exchange key.
+// of the public exchange key by NodeID and Work set to a proof-of-work for the
+// ID at nodeid.Work, so its PubNode will Verify.
 func NewPrivNode() *PrivNode {
-	id := make([]byte, IDLen)
-	key := crypto.GenerateXchgPair()
-	dig := crypto.DigestFromSlice(key.Pub().Slice())
-	copy(id, dig.Slice())
+	id, key, signingKey, work := newIdentity()
 	return &PrivNode{
-		ID:  id,
-		Key: key,
+		ID:         id,
+		Key:        key,
+		SigningKey: signingKey,
+		Work:       work,
+		Params:     cipher.Default,
+		Cache:      make(map[string]*crypto.XchgPriv),
+		Grace:      DefaultGrace,
+		Now:        time.Now,
+		MaxSeen:    DefaultMaxSeen,
+		seen:       make(seenKeys),
+	}
+}
+
+const (
+	// ErrUnknownRoute is returned when opening a message that did not arrive on
+	// one of the node's receive routes.
+	ErrUnknownRoute errors.String = "Message did not arrive on a known receive route"
+	// ErrNotDelivered is returned by Receive when the package was not addressed
+	// to the node and should be forwarded.
+	ErrNotDelivered errors.String = "Package must be forwarded to the next node"
+	// ErrBadPubNode is returned when unmarshaling a PubNode from a slice of the
+	// wrong length.
+	ErrBadPubNode errors.String = "PubNode must be ID | Key | SigningKey | Work | StampWork | Epochs | Sig"
+	// ErrTooManyHops is returned by GetRoute when more than MaxHops nodes have
+	// been pushed.
+	ErrTooManyHops errors.String = "Route cannot have more than MaxHops hops"
+	// ErrReplay is returned by Route when a packet that is not Reusable is
+	// routed again
+	ErrReplay errors.String = "Map packet has already been routed"
+	// ErrSeenFull is returned by Route when a packet that is not Reusable
+	// arrives for a key whose replay cache already holds MaxSeen ephemeral keys
+	ErrSeenFull errors.String = "Replay cache for the key is full"
+	// ErrBlocked is returned by Route when the next node is on the Blacklist
+	ErrBlocked errors.String = "Next node is blacklisted"
+	// ErrBadMap is returned when a RoutePackage is missing its RouteMsg or
+	// Cipher or the Map is shorter than a packet
+	ErrBadMap errors.String = "Map must hold at least one packet"
+)
+
+// NewReceiveRoute creates a RouteBuilder that leads to the node. A new base
+// exchange key is generated for the route and the public half is included in
+// the RouteBuilder, so that the sender seals the message before it is
+// ciphered. The private half is cached by the node so the message can be
+// opened and authenticated when it arrives; Cache is created if it is nil.
+func (n *PrivNode) NewReceiveRoute() *RouteBuilder {
+	rb := NewRouteBuilder()
+	rb.Params = n.Params
+	rb.Reusable = true
+	rb.Now = n.Now
+	rb.Push(n.Pub())
+	xchg := crypto.GenerateXchgPair()
+	rb.BaseKey = xchg.Pub()
+	if n.Cache == nil {
+		n.Cache = make(map[string]*crypto.XchgPriv)
+	}
+	n.Cache[encode(rb.Keys[0])] = xchg.Priv()
+	return rb
+}
+
+// Receive routes a package and if it was addressed to this node, opens it. If
+// the package needs to be forwarded to r.Next, ErrNotDelivered is returned.
+// Any other error means the package could not be routed or opened.
+func (n *PrivNode) Receive(r *RoutePackage) ([]byte, error) {
+	if err := n.Route(r); err != nil {
+		return nil, err
+	}
+	if r.Next != nil {
+		return nil, ErrNotDelivered
+	}
+	return n.Open(r)
+}
+
+// Open finishes the cipher of a RoutePackage that has been routed to this node
+// and opens the sealed message with the base key of the receive route it
+// arrived on. If it did not arrive on a receive route, it is opened with the
+// node's own key, which is how messages on a direct route are sealed.
+func (n *PrivNode) Open(r *RoutePackage) ([]byte, error) {
+	n.Erase()
+	if r == nil || r.RouteMsg == nil || r.Cipher == nil {
+		return nil, ErrBadMap
+	}
+	baseKey, ok := n.Cache[encode(r.CK)]
+	sealed, err := r.Final(n.Params)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return baseKey.AnonOpen(sealed)
+	}
+	msg, err := n.Key.AnonOpen(sealed)
+	if err != nil {
+		for _, o := range n.old {
+			if msg, err = o.Key.AnonOpen(sealed); err == nil {
+				return msg, nil
+			}
+		}
+		return nil, ErrUnknownRoute
 	}
+	return msg, nil
 }
 
 // String is used to generate map keys
@@ -40,18 +167,32 @@ func (n *PrivNode) String() string {
 	return encode(n.ID)
 }
 
-// Pub returns the PubNode of a Private node
+// Pub returns the PubNode of a Private node, signed by its SigningKey
 func (n *PrivNode) Pub() *PubNode {
-	return &PubNode{
-		ID:  n.ID,
-		Key: n.Key.Pub(),
+	pub := &PubNode{
+		ID:         n.ID,
+		Key:        n.Key.Pub(),
+		SigningKey: n.SigningKey.Public().(ed25519.PublicKey),
+		Work:       n.Work,
+		StampWork:  n.StampWork,
+		Epochs:     pubEpochs(n.epochs),
 	}
+	pub.Sig = ed25519.Sign(n.SigningKey, pub.body())
+	return pub
 }
 
-// PubNode represents the data that a Private node would publish to the network
+// PubNode represents the data that a Private node would publish to the network.
+// Epochs are the epoch keys the node advertises, in order. Sig is the node's
+// signature over everything else, so the epoch keys and StampWork cannot be
+// changed by whoever relays the PubNode.
 type PubNode struct {
-	ID  []byte
-	Key *crypto.XchgPub
+	ID         []byte
+	Key        *crypto.XchgPub
+	SigningKey ed25519.PublicKey
+	Work       uint64
+	StampWork  int
+	Epochs     []EpochKey
+	Sig        []byte
 }
 
 // String is used to generate map keys
@@ -59,28 +200,99 @@ func (n *PubNode) String() string {
 	return encode(n.ID)
 }
 
-// RouteBuilder is used when constructing a route
+// Marshal a PubNode so that it can be published as
+// ID | Key | SigningKey | Work | StampWork | Epochs | Sig
+// with 1 byte for StampWork.
+func (n *PubNode) Marshal() []byte {
+	return append(n.body(), n.Sig...)
+}
+
+// body marshals everything but the signature
+func (n *PubNode) body() []byte {
+	b := make([]byte, 0, pubNodeLen()+len(n.Epochs)*epochKeyLen+ed25519.SignatureSize)
+	b = append(append(b, n.ID...), n.Key.Slice()...)
+	b = append(b, n.SigningKey...)
+	b = append(b, pow.Marshal(n.Work)...)
+	b = append(b, byte(n.StampWork))
+	return marshalEpochs(b, n.Epochs)
+}
+
+// UnmarshalPubNode reverses PubNode.Marshal
+func UnmarshalPubNode(b []byte) (*PubNode, error) {
+	ln := pubNodeLen()
+	if len(b) < ln+ed25519.SignatureSize {
+		return nil, ErrBadPubNode
+	}
+	sig := len(b) - ed25519.SignatureSize
+	es, ok := unmarshalEpochs(b[ln:sig])
+	if !ok || pow.Validate(int(b[ln-1])) != nil {
+		return nil, ErrBadPubNode
+	}
+	sk := IDLen + crypto.KeyLength
+	return &PubNode{
+		ID:         append([]byte(nil), b[:IDLen]...),
+		Key:        crypto.XchgPubFromSlice(b[IDLen : IDLen+crypto.KeyLength]),
+		SigningKey: append(ed25519.PublicKey(nil), b[sk:sk+ed25519.PublicKeySize]...),
+		Work:       pow.Unmarshal(b[sk+ed25519.PublicKeySize:]),
+		StampWork:  int(b[ln-1]),
+		Epochs:     es,
+		Sig:        append([]byte(nil), b[sig:]...),
+	}, nil
+}
+
+// RouteBuilder is used when constructing a route. Every node on the route must
+// be using the same Params. If BaseKey is set, the message is sealed to it
+// before it is ciphered. If Reusable is set, the packets pushed may be routed
+// more than once; otherwise each node refuses a packet it has already routed
+// in the current epoch, so the route can carry a single message. MaxStampWork
+// is the most stamp work the builder will do for a hop; a node that advertises
+// more is refused by Push. Now is the clock Push uses to choose a node's epoch
+// key and can be replaced for testing.
 type RouteBuilder struct {
-	Next []byte
-	Data []byte
-	Keys [][]byte
+	Next         []byte
+	Data         []byte
+	Keys         [][]byte
+	Params       *cipher.Params
+	BaseKey      *crypto.XchgPub
+	Reusable     bool
+	MaxStampWork int
+	Now          func() time.Time
+	hops         [][]byte
 }
 
-// NewRouteBuilder creates an empty route
+// NewRouteBuilder creates an empty route using the default cipher Params. The
+// first node pushed will receive the end of message marker.
 func NewRouteBuilder() *RouteBuilder {
-	return &RouteBuilder{}
+	return &RouteBuilder{
+		Next:         make([]byte, IDLen),
+		Params:       cipher.Default,
+		MaxStampWork: DefaultMaxStampWork,
+		Now:          time.Now,
+	}
 }
 
-// GetRoute finishes the route building process.
+// GetRoute finishes the route building process. The first layer of encryption
+// must always be MAC'd, so if the route has a BaseKey the message is sealed to
+// it before the cipher is started. The map is padded with random bytes to
+// MaxHops packets and the message is padded to a size class.
 func (rb *RouteBuilder) GetRoute(msg []byte) (*RoutePackage, error) {
-	c, err := cipher.Start(rb.Keys, msg)
+	if len(rb.Data) > MaxHops*PacketLength {
+		return nil, ErrTooManyHops
+	}
+	if rb.BaseKey != nil {
+		msg = rb.BaseKey.AnonSeal(msg)
+	}
+	c, err := cipher.StartPadded(rb.Params, rb.Keys, msg, sizeclass.Of(cipher.LenHeader+len(msg)))
 	if err != nil {
 		return nil, err
 	}
 
+	m := make([]byte, MaxHops*PacketLength)
+	copy(m, rb.Data)
+	rand.Read(m[len(rb.Data):])
 	return &RoutePackage{
 		RouteMsg: &RouteMsg{
-			Map:    rb.Data,
+			Map:    m,
 			Cipher: c,
 		},
 		Next: rb.Next,
@@ -88,29 +300,68 @@ func (rb *RouteBuilder) GetRoute(msg []byte) (*RoutePackage, error) {
 }
 
 // SumKeys replaces the keys in the Route Builder with their sum allowing the
-// RouteBuilder to be shared without revealing the keys.
+// RouteBuilder to be shared without revealing the keys. Reusable is cleared, so
+// the nodes the sender pushes only route the packets once.
 func (rb *RouteBuilder) SumKeys() {
-	rb.Keys = [][]byte{cipher.SumKeys(rb.Keys)}
+	rb.Keys = [][]byte{cipher.SumKeys(rb.Params, rb.Keys)}
+	rb.Reusable = false
 }
 
-// Push a Node onto the route.
-func (rb *RouteBuilder) Push(n *PubNode) {
-	// C_x | Nonce | E(C_s, N_l) | E_umac(C_s, r)
+// Copy returns a RouteBuilder that can be pushed to without changing rb.
+func (rb *RouteBuilder) Copy() *RouteBuilder {
+	cp := *rb
+	cp.Next = append([]byte(nil), rb.Next...)
+	cp.Data = append([]byte(nil), rb.Data...)
+	cp.Keys = append([][]byte(nil), rb.Keys...)
+	cp.hops = append([][]byte(nil), rb.hops...)
+	return &cp
+}
+
+// Push a Node onto the route. Nodes whose ID was not derived from their keys
+// are rejected with ErrUnverified and nodes that require more stamp work than
+// MaxStampWork with ErrStampTooHard.
+func (rb *RouteBuilder) Push(n *PubNode) error {
+	if err := n.Verify(); err != nil {
+		return err
+	}
+	if n.StampWork > rb.MaxStampWork {
+		return ErrStampTooHard
+	}
+	// C_x | T | S | Nonce | E(C_s, F|N_l) | E_umac(C_s, r)
+	//   F : flags, Reusable if the route may be used more than once
 	// N_l : id of the next node
 	// C_x : exchange key for c
+	//   T : the epoch of the node's key, 0 for the node's static key
+	//   S : stamp, proof-of-work over C_x | ID | Nonce at the node's StampWork
 	// C_s : symmetric key with c
 	//   r : the remainder of the route
+	epoch, key := n.pushKey(rb.Now())
 	kp := crypto.GenerateXchgPair()
-	shared := kp.Shared(n.Key)
+	shared := kp.Shared(key)
 
 	nonce := crypto.RandomNonce()
 	rb.Data = shared.UnmacdSeal(rb.Data, nonce)
-	rb.Data = append(shared.Seal(rb.Next, nonce), rb.Data...)
+	fn := make([]byte, 1, 1+IDLen)
+	if rb.Reusable {
+		fn[0] = Reusable
+	}
+	rb.Data = append(shared.Seal(append(fn, rb.Next...), nonce), rb.Data...)
+	rb.Data = append(stamp(kp.Pub(), n.ID, nonce, n.StampWork), rb.Data...)
+	rb.Data = append(epochTag(epoch), rb.Data...)
 	rb.Data = append(kp.Pub().Slice(), rb.Data...)
 	rb.Next = n.ID
+	rb.hops = append(rb.hops, n.ID)
 
 	ck := cipherKey(shared, nonce)
 	rb.Keys = append(rb.Keys, ck)
+	return nil
+}
+
+// Hops returns the IDs of the nodes pushed onto the route by this
+// RouteBuilder. They are not marshaled, so a route received as an offer has no
+// Hops.
+func (rb *RouteBuilder) Hops() [][]byte {
+	return append([][]byte(nil), rb.hops...)
 }
 
 func cipherKey(shared *crypto.Symmetric, nonce *crypto.Nonce) []byte {
@@ -132,36 +383,83 @@ type RoutePackage struct {
 }
 
 // Route a package. The package will be mutated so that it contains the correct
-// Next ID and the RouteMsg to be sent.
+// Next ID and the RouteMsg to be sent. If the package was addressed to this
+// node, Next and Map will be nil. A map packet that cannot be opened is always
+// an error; it is never treated as the end of the route. If the cipher was not
+// started with the node's Params, cipher.ErrParamsMismatch is returned. The
+// stamp is checked against StampWork before any public key or cipher work and
+// ErrBadStamp is returned if it falls short. A packet that is not Reusable is
+// refused with ErrReplay if its ephemeral key was already seen by the key that
+// opens it, before the key exchange, and a repeated Reusable packet reuses the
+// shared key. Each key's replay cache lives as long as the key; once it holds
+// MaxSeen ephemeral keys a packet that is not Reusable is refused with
+// ErrSeenFull. A malformed package returns ErrBadMap and is not mutated.
 func (n *PrivNode) Route(r *RoutePackage) error {
+	n.Erase()
+	if r == nil || r.RouteMsg == nil || r.Cipher == nil || len(r.Map) < PacketLength {
+		return ErrBadMap
+	}
+	if r.ParamsID != n.Params.ID {
+		return cipher.ErrParamsMismatch
+	}
 	m := r.Map
-	shared := n.Key.Shared(crypto.XchgPubFromSlice(m[:crypto.KeyLength]))
+	ex := crypto.XchgPubFromSlice(m[:crypto.KeyLength])
 
 	m = m[crypto.KeyLength:]
+	epoch := binary.BigEndian.Uint32(m)
+
+	m = m[EpochTagLen:]
+	s := m[:StampLen]
+
+	m = m[StampLen:]
 	nonce := crypto.ExtractNonce(m)
 	if nonce == nil {
 		return crypto.ErrDecryptionFailed
 	}
+	if !n.checkStamp(ex.Slice(), s, nonce.Slice()) {
+		return ErrBadStamp
+	}
 	m = m[crypto.NonceLength:]
 
+	shared, seen := n.seenKey(ex, epoch)
+	if seen && shared == nil {
+		return ErrReplay
+	}
+	var fn []byte
+	var cache seenKeys
 	var err error
-	if len(r.Map) > BoxIDLen {
-		r.Next, err = shared.NonceOpen(m[:BoxIDLen], nonce)
-		// A decryption failure may not be an actual error, it may mean that we're
-		// done routing.
-		if err != nil {
-			r.Next = nil
-			r.Map = nil
-		} else {
-			m = shared.UnmacdOpen(m[BoxIDLen:], nonce)
-			copy(r.Map, m)
-			rand.Read(r.Map[len(m):])
-		}
+	if seen {
+		fn, err = shared.NonceOpen(m[:BoxIDLen], nonce)
 	} else {
+		shared, fn, cache, err = n.openPacket(ex, epoch, m[:BoxIDLen], nonce)
+	}
+	if err != nil || len(fn) != 1+IDLen {
+		return crypto.ErrDecryptionFailed
+	}
+	next := fn[1:]
+	if n.Blacklist != nil && n.Blacklist.Blocked(encode(next)) {
+		return ErrBlocked
+	}
+	if fn[0]&Reusable == Reusable {
+		if !seen {
+			cache.record(ex, shared, n.MaxSeen)
+		}
+	} else if seen {
+		return ErrReplay
+	} else if err := cache.record(ex, nil, n.MaxSeen); err != nil {
+		return err
+	}
+	if encode(next) == eom {
+		// The packet was addressed to this node, there is nothing left to route.
 		r.Next = nil
 		r.Map = nil
+	} else {
+		r.Next = next
+		m = shared.UnmacdOpen(m[BoxIDLen:], nonce)
+		copy(r.Map, m)
+		rand.Read(r.Map[len(m):])
 	}
 
 	r.CK = cipherKey(shared, nonce)
-	return r.Cycle(r.CK)
+	return r.Cycle(n.Params, r.CK)
 }
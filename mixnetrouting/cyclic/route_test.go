@@ -2,9 +2,16 @@ package cyclic
 
 import (
 	"crypto/rand"
+	"encoding/binary"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/docs/mixnetrouting/cyclic/cipher"
+	"github.com/dist-ribut-us/docs/mixnetrouting/nodeid"
+	"github.com/dist-ribut-us/docs/mixnetrouting/pow"
+	"github.com/dist-ribut-us/docs/mixnetrouting/sizeclass"
 	"github.com/stretchr/testify/assert"
 	mr "math/rand"
 	"testing"
+	"time"
 )
 
 func seedRand() {
@@ -42,7 +49,7 @@ func TestRouteEndToEnd(t *testing.T) {
 	for i := 0; i < hops; i++ {
 		hopID := ids[mr.Intn(totalNodes)]
 		hopIDs[i] = hopID
-		rb.Push(dht[hopID].Pub())
+		assert.NoError(t, rb.Push(dht[hopID].Pub()))
 	}
 	// Random message
 	msg := make([]byte, msgLen)
@@ -67,9 +74,9 @@ func TestRouteEndToEnd(t *testing.T) {
 	}
 
 	// Extract the message and check that it is correct
-	out, err := rt.Final()
+	out, err := rt.Final(cipher.Default)
 	assert.NoError(t, err)
-	assert.Equal(t, msg, out[:msgLen])
+	assert.Equal(t, msg, out)
 }
 
 func TestAliceToBob(t *testing.T) {
@@ -90,7 +97,6 @@ func TestAliceToBob(t *testing.T) {
 	alicesRoute := setupAlicesRoute(bobsRoute, dht, ids, alicesHops)
 
 	msg := []byte("Hi Bob, how was your vacation?")
-	msgLen := len(msg) // assume some sort of message encoding
 	rt, err := alicesRoute.GetRoute(msg)
 	assert.NoError(t, err)
 
@@ -105,16 +111,119 @@ func TestAliceToBob(t *testing.T) {
 	}
 
 	assert.Equal(t, bob, curNode.String())
-	out, err := rt.Final()
+	out, err := curNode.Open(rt)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, out)
+
+}
+
+func TestParamsMismatch(t *testing.T) {
+	dht, ids := setupDHT(5)
+	n := dht[ids[0]]
+	rb := NewRouteBuilder()
+	rb.Params = cipher.Level1K
+	assert.NoError(t, rb.Push(n.Pub()))
+	rt, err := rb.GetRoute([]byte("test"))
+	assert.NoError(t, err)
+	assert.Equal(t, cipher.ErrParamsMismatch, n.Route(rt))
+}
+
+func TestOpenAuthenticates(t *testing.T) {
+	totalNodes := 20
+	dht, ids := setupDHT(totalNodes)
+	bob := ids[mr.Intn(totalNodes)]
+
+	route := func(rb *RouteBuilder) (*PrivNode, *RoutePackage) {
+		rt, err := rb.GetRoute([]byte("Hi Bob"))
+		assert.NoError(t, err)
+		var curNode *PrivNode
+		for len(rt.Next) > 0 {
+			curNode = dht[encode(rt.Next)]
+			rt = &RoutePackage{
+				RouteMsg: rt.RouteMsg,
+			}
+			assert.NoError(t, curNode.Route(rt))
+		}
+		return curNode, rt
+	}
+
+	// Message sealed to the wrong key
+	rb := setupAlicesRoute(setupBobsRoute(bob, dht, ids, 2), dht, ids, 2)
+	rb.BaseKey = crypto.GenerateXchgPair().Pub()
+	n, rt := route(rb)
+	_, err := n.Open(rt)
+	assert.Equal(t, crypto.ErrDecryptionFailed, err)
+
+	// Message that was not sealed
+	rb = setupAlicesRoute(setupBobsRoute(bob, dht, ids, 2), dht, ids, 2)
+	rb.BaseKey = nil
+	n, rt = route(rb)
+	_, err = n.Open(rt)
+	assert.Equal(t, crypto.ErrDecryptionFailed, err)
+
+	// Route that Bob did not create
+	rb = NewRouteBuilder()
+	assert.NoError(t, rb.Push(dht[bob].Pub()))
+	assert.NoError(t, rb.Push(dht[ids[0]].Pub()))
+	n, rt = route(rb)
+	_, err = n.Open(rt)
+	assert.Equal(t, ErrUnknownRoute, err)
+}
+
+func TestReceive(t *testing.T) {
+	totalNodes := 20
+	dht, ids := setupDHT(totalNodes)
+	bob := ids[mr.Intn(totalNodes)]
+	rb := setupAlicesRoute(setupBobsRoute(bob, dht, ids, 3), dht, ids, 3)
+
+	msg := []byte("Hi Bob, how was your vacation?")
+	rt, err := rb.GetRoute(msg)
+	assert.NoError(t, err)
+
+	var out []byte
+	for err = ErrNotDelivered; err == ErrNotDelivered; {
+		curNode := dht[encode(rt.Next)]
+		rt = &RoutePackage{
+			RouteMsg: rt.RouteMsg,
+		}
+		out, err = curNode.Receive(rt)
+		if err == nil {
+			assert.Equal(t, bob, curNode.String())
+		}
+	}
 	assert.NoError(t, err)
-	assert.Equal(t, msg, out[:msgLen])
+	assert.Equal(t, msg, out)
 
+	// a node without a Cache gets one when it creates a receive route
+	n := dht[ids[0]]
+	n.Cache = nil
+	rt, err = n.NewReceiveRoute().GetRoute(msg)
+	assert.NoError(t, err)
+	out, err = n.Receive(rt)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, out)
+}
+
+func TestTamperedMap(t *testing.T) {
+	dht, ids := setupDHT(5)
+	bob := dht[ids[0]]
+	rb := bob.NewReceiveRoute()
+	assert.NoError(t, rb.Push(dht[ids[1]].Pub()))
+	rt, err := rb.GetRoute([]byte("Hi Bob"))
+	assert.NoError(t, err)
+
+	_, err = dht[ids[1]].Receive(rt)
+	assert.Equal(t, ErrNotDelivered, err)
+
+	// Corrupting Bob's packet must not look like a delivery
+	rt.Map[crypto.KeyLength+EpochTagLen+StampLen+crypto.NonceLength] ^= 1
+	_, err = bob.Receive(rt)
+	assert.Equal(t, crypto.ErrDecryptionFailed, err)
 }
 
 func setupBobsRoute(bob string, dht map[string]*PrivNode, ids []string, hops int) *RouteBuilder {
 	totalNodes := len(ids)
-	rb := NewRouteBuilder()
-	rb.Push(dht[bob].Pub())
+	rb := dht[bob].NewReceiveRoute()
 	for i := 0; i < hops; i++ {
 		hopID := ids[mr.Intn(totalNodes)]
 		rb.Push(dht[hopID].Pub())
@@ -131,3 +240,343 @@ func setupAlicesRoute(rb *RouteBuilder, dht map[string]*PrivNode, ids []string,
 	}
 	return rb
 }
+
+func TestDirectRoute(t *testing.T) {
+	dht, ids := setupDHT(20)
+	bob := dht[ids[0]]
+	msg := []byte("Hi Bob")
+
+	routed, err := setupAlicesRoute(setupBobsRoute(ids[0], dht, ids, 3), dht, ids, 3).GetRoute(msg)
+	assert.NoError(t, err)
+
+	// Straight to Bob
+	rb, err := NewDirectRoute(bob.Pub(), bob.Params)
+	assert.NoError(t, err)
+	rt, err := rb.GetRoute(msg)
+	assert.NoError(t, err)
+	assert.Len(t, rt.Map, len(routed.Map))
+	assert.Len(t, rt.Data, len(routed.Data))
+	assert.Equal(t, bob.ID, rt.Next)
+	out, err := bob.Receive(&RoutePackage{RouteMsg: rt.RouteMsg})
+	assert.NoError(t, err)
+	assert.Equal(t, msg, out)
+
+	// Through one relay
+	rb, err = NewDirectRoute(bob.Pub(), bob.Params)
+	assert.NoError(t, err)
+	assert.NoError(t, rb.Push(dht[ids[1]].Pub()))
+	rt, err = rb.GetRoute(msg)
+	assert.NoError(t, err)
+	assert.Len(t, rt.Map, len(routed.Map))
+	assert.Len(t, rt.Data, len(routed.Data))
+	rt = &RoutePackage{RouteMsg: rt.RouteMsg}
+	_, err = dht[ids[1]].Receive(rt)
+	assert.Equal(t, ErrNotDelivered, err)
+	assert.Equal(t, bob.ID, rt.Next)
+	out, err = bob.Receive(&RoutePackage{RouteMsg: rt.RouteMsg})
+	assert.NoError(t, err)
+	assert.Equal(t, msg, out)
+}
+
+func TestSizeClassBoundary(t *testing.T) {
+	dht, ids := setupDHT(1)
+	getRoute := func(ln int) *RoutePackage {
+		rb := NewRouteBuilder()
+		assert.NoError(t, rb.Push(dht[ids[0]].Pub()))
+		rt, err := rb.GetRoute(make([]byte, ln))
+		assert.NoError(t, err)
+		return rt
+	}
+	// the length header is counted in the size class
+	small := getRoute(1)
+	full := getRoute(sizeclass.Classes[0] - cipher.LenHeader)
+	over := getRoute(sizeclass.Classes[0] - cipher.LenHeader + 1)
+	assert.Len(t, full.Data, len(small.Data))
+	assert.True(t, len(over.Data) > len(full.Data))
+}
+
+func TestTooManyHops(t *testing.T) {
+	dht, ids := setupDHT(5)
+	rb := NewRouteBuilder()
+	for i := 0; i <= MaxHops; i++ {
+		assert.NoError(t, rb.Push(dht[ids[i%len(ids)]].Pub()))
+	}
+	_, err := rb.GetRoute([]byte("test"))
+	assert.Equal(t, ErrTooManyHops, err)
+}
+
+type blacklist map[string]bool
+
+func (bl blacklist) Blocked(id string) bool { return bl[id] }
+
+func TestBlacklist(t *testing.T) {
+	dht, ids := setupDHT(5)
+	a, bob := dht[ids[0]], dht[ids[1]]
+	rb := bob.NewReceiveRoute()
+	assert.NoError(t, rb.Push(a.Pub()))
+	rt, err := rb.GetRoute([]byte("Hi Bob"))
+	assert.NoError(t, err)
+
+	a.Blacklist = blacklist{bob.String(): true}
+	_, err = a.Receive(&RoutePackage{RouteMsg: rt.RouteMsg})
+	assert.Equal(t, ErrBlocked, err)
+
+	// Bob does not block his own delivery
+	bob.Blacklist = blacklist{bob.String(): true}
+	rt, err = bob.NewReceiveRoute().GetRoute([]byte("Hi Bob"))
+	assert.NoError(t, err)
+	out, err := bob.Receive(rt)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("Hi Bob"), out)
+}
+
+func TestRotate(t *testing.T) {
+	dht, ids := setupDHT(5)
+	a, bob := dht[ids[0]], dht[ids[1]]
+	oldPub, oldKey := a.Pub(), a.Key
+	route := func(pub *PubNode) *RoutePackage {
+		rb := bob.NewReceiveRoute()
+		assert.NoError(t, rb.Push(pub))
+		rt, err := rb.GetRoute([]byte("Hi Bob"))
+		assert.NoError(t, err)
+		return &RoutePackage{RouteMsg: rt.RouteMsg}
+	}
+	inFlight := route(oldPub)
+	rb, err := NewDirectRoute(oldPub, a.Params)
+	assert.NoError(t, err)
+	direct, err := rb.GetRoute([]byte("direct"))
+	assert.NoError(t, err)
+
+	a.Rotate()
+	assert.NotEqual(t, oldPub.ID, a.ID)
+	assert.Equal(t, 1, a.OldKeys())
+
+	// packets in flight are routed with the old key
+	_, err = a.Receive(inFlight)
+	assert.Equal(t, ErrNotDelivered, err)
+	out, err := bob.Receive(&RoutePackage{RouteMsg: inFlight.RouteMsg})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("Hi Bob"), out)
+	out, err = a.Receive(&RoutePackage{RouteMsg: direct.RouteMsg})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("direct"), out)
+
+	// the new identity works
+	_, err = a.Receive(route(a.Pub()))
+	assert.Equal(t, ErrNotDelivered, err)
+
+	// after the grace period the old key is erased by the next message, even
+	// if it does not need the old key
+	a.Now = func() time.Time { return time.Now().Add(a.Grace) }
+	_, err = a.Receive(route(a.Pub()))
+	assert.Equal(t, ErrNotDelivered, err)
+	assert.Equal(t, 0, a.OldKeys())
+	assert.Equal(t, make([]byte, crypto.KeyLength), oldKey.Priv().Slice())
+	_, err = a.Receive(route(oldPub))
+	assert.Equal(t, crypto.ErrDecryptionFailed, err)
+}
+
+func TestEpochs(t *testing.T) {
+	dht, ids := setupDHT(5)
+	a, bob := dht[ids[0]], dht[ids[1]]
+	now := time.Now()
+	cur := EpochOf(now)
+	a.UpdateEpochs(now, 1)
+	assert.Equal(t, []uint32{cur, cur + 1}, a.Epochs())
+	pub := a.Pub()
+	got, err := UnmarshalPubNode(pub.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, pub.Marshal(), got.Marshal())
+
+	// the epoch keys are signed by the node
+	got.Epochs[0].Key = bob.Key.Pub()
+	assert.Equal(t, ErrBadNodeSig, got.Verify())
+	assert.Equal(t, ErrBadNodeSig, bob.NewReceiveRoute().Push(got))
+
+	rb := bob.NewReceiveRoute()
+	assert.NoError(t, rb.Push(pub))
+	rt, err := rb.GetRoute([]byte("Hi Bob"))
+	assert.NoError(t, err)
+	assert.Equal(t, cur, binary.BigEndian.Uint32(rt.Map[crypto.KeyLength:]))
+	recorded := append([]byte(nil), rt.Map...)
+	_, err = a.Receive(&RoutePackage{RouteMsg: rt.RouteMsg})
+	assert.Equal(t, ErrNotDelivered, err)
+	out, err := bob.Receive(&RoutePackage{RouteMsg: rt.RouteMsg})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("Hi Bob"), out)
+
+	// two epochs later the key is erased
+	key := a.epochs[cur].Key
+	a.UpdateEpochs(now.Add(2*EpochPeriod), 1)
+	assert.Equal(t, []uint32{cur + 1, cur + 2, cur + 3}, a.Epochs())
+	assert.Equal(t, make([]byte, crypto.KeyLength), key.Priv().Slice())
+	rt.Map = recorded
+	_, err = a.Receive(&RoutePackage{RouteMsg: rt.RouteMsg})
+	assert.Equal(t, crypto.ErrDecryptionFailed, err)
+}
+
+func TestVerify(t *testing.T) {
+	dht, ids := setupDHT(2)
+	a, b := dht[ids[0]], dht[ids[1]]
+	assert.Len(t, a.ID, IDLen)
+	assert.NoError(t, a.Pub().Verify())
+
+	forged := &PubNode{ID: a.ID, Key: b.Key.Pub()}
+	assert.Equal(t, ErrUnverified, forged.Verify())
+	signing := &PubNode{ID: a.ID, Key: a.Key.Pub(), SigningKey: b.Pub().SigningKey}
+	assert.Equal(t, ErrUnverified, signing.Verify())
+	rb := NewRouteBuilder()
+	assert.Equal(t, ErrUnverified, rb.Push(forged))
+	assert.Len(t, rb.Keys, 0)
+	_, err := NewDirectRoute(forged, a.Params)
+	assert.Equal(t, ErrUnverified, err)
+}
+
+func TestIDWork(t *testing.T) {
+	defer nodeid.SetWork(0)
+	assert.NoError(t, nodeid.SetWork(8))
+	a := NewPrivNode()
+	pub := a.Pub()
+	assert.NoError(t, pub.Verify())
+	got, err := UnmarshalPubNode(pub.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, a.Work, got.Work)
+
+	for pub.Work++; pow.Check(workData(pub.ID, pub.Key), pub.Work, nodeid.Work()); pub.Work++ {
+	}
+	assert.Equal(t, ErrInsufficientWork, pub.Verify())
+	assert.Equal(t, ErrInsufficientWork, NewRouteBuilder().Push(pub))
+
+	a.Rotate()
+	assert.NoError(t, a.Pub().Verify())
+}
+
+func TestStamp(t *testing.T) {
+	dht, ids := setupDHT(5)
+	a, bob := dht[ids[0]], dht[ids[1]]
+	a.StampWork = 8
+	pub := a.Pub()
+	got, err := UnmarshalPubNode(pub.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, 8, got.StampWork)
+
+	route := func() *RoutePackage {
+		rb := bob.NewReceiveRoute()
+		assert.NoError(t, rb.Push(pub))
+		rt, err := rb.GetRoute([]byte("Hi Bob"))
+		assert.NoError(t, err)
+		return &RoutePackage{RouteMsg: rt.RouteMsg}
+	}
+	_, err = a.Receive(route())
+	assert.Equal(t, ErrNotDelivered, err)
+
+	rt := route()
+	ex := rt.Map[:crypto.KeyLength]
+	s := rt.Map[crypto.KeyLength+EpochTagLen : crypto.KeyLength+EpochTagLen+StampLen]
+	nonce := rt.Map[crypto.KeyLength+EpochTagLen+StampLen : PacketLength-BoxIDLen]
+	for v := uint64(0); a.checkStamp(ex, s, nonce); v++ {
+		copy(s, pow.Marshal(v))
+	}
+	assert.Equal(t, ErrBadStamp, a.Route(rt))
+
+	// a packet that is not Reusable is only routed once an epoch
+	rb := NewRouteBuilder()
+	assert.NoError(t, rb.Push(pub))
+	for _, want := range []error{nil, ErrReplay} {
+		rt, err := rb.GetRoute([]byte("Hi A"))
+		assert.NoError(t, err)
+		assert.Equal(t, want, a.Route(&RoutePackage{RouteMsg: rt.RouteMsg}))
+	}
+	// a receive route can be used again
+	rb = bob.NewReceiveRoute()
+	assert.NoError(t, rb.Push(pub))
+	for i := 0; i < 2; i++ {
+		rt, err := rb.GetRoute([]byte("Hi Bob"))
+		assert.NoError(t, err)
+		_, err = a.Receive(&RoutePackage{RouteMsg: rt.RouteMsg})
+		assert.Equal(t, ErrNotDelivered, err)
+	}
+
+	pub.StampWork = pow.MaxBits + 1
+	assert.Equal(t, pow.ErrBadDifficulty, NewRouteBuilder().Push(pub))
+
+	// the sender refuses more stamp work than its MaxStampWork
+	a.StampWork = pow.MaxBits
+	assert.Equal(t, ErrStampTooHard, NewRouteBuilder().Push(a.Pub()))
+	a.StampWork = 9
+	rb = NewRouteBuilder()
+	rb.MaxStampWork = 8
+	assert.Equal(t, ErrStampTooHard, rb.Push(a.Pub()))
+	assert.Len(t, rb.Hops(), 0)
+	rb.MaxStampWork = 9
+	assert.NoError(t, rb.Push(a.Pub()))
+}
+
+func TestReplayCache(t *testing.T) {
+	dht, ids := setupDHT(2)
+	a, bob := dht[ids[0]], dht[ids[1]]
+	rb := NewRouteBuilder()
+	assert.NoError(t, rb.Push(a.Pub()))
+	rt, err := rb.GetRoute([]byte("Hi A"))
+	assert.NoError(t, err)
+	recorded := append([]byte(nil), rt.Map...)
+	assert.NoError(t, a.Route(&RoutePackage{RouteMsg: rt.RouteMsg}))
+	// a replay is refused before the cipher is touched
+	replay := func() error {
+		m := append([]byte(nil), recorded...)
+		return a.Route(&RoutePackage{RouteMsg: &RouteMsg{Map: m, Cipher: rt.Cipher}})
+	}
+
+	// the static key keeps its replay cache across epochs and when other keys
+	// are erased
+	now := time.Now()
+	a.UpdateEpochs(now, 1)
+	a.UpdateEpochs(now.Add(3*EpochPeriod), 1)
+	assert.Equal(t, ErrReplay, replay())
+	// and after Rotate until it is erased
+	a.Rotate()
+	assert.Equal(t, ErrReplay, replay())
+	a.Now = func() time.Time { return time.Now().Add(a.Grace) }
+	assert.Equal(t, crypto.ErrDecryptionFailed, replay())
+
+	// a full cache refuses single use packets but still routes receive routes
+	a.Now = time.Now
+	a.MaxSeen = 0
+	rb = NewRouteBuilder()
+	assert.NoError(t, rb.Push(a.Pub()))
+	rt, err = rb.GetRoute([]byte("Hi A"))
+	assert.NoError(t, err)
+	assert.Equal(t, ErrSeenFull, a.Route(&RoutePackage{RouteMsg: rt.RouteMsg}))
+	rb = bob.NewReceiveRoute()
+	assert.NoError(t, rb.Push(a.Pub()))
+	rt, err = rb.GetRoute([]byte("Hi Bob"))
+	assert.NoError(t, err)
+	_, err = a.Receive(&RoutePackage{RouteMsg: rt.RouteMsg})
+	assert.Equal(t, ErrNotDelivered, err)
+}
+
+func TestPushClock(t *testing.T) {
+	dht, ids := setupDHT(2)
+	a := dht[ids[0]]
+	now := time.Now()
+	cur := EpochOf(now)
+	a.UpdateEpochs(now, 1)
+	pub := a.Pub()
+	next := pub.Epochs[1].Start()
+
+	// Push picks the key for the epoch on the builder's clock, either side of
+	// the boundary, and the static key once the advertised epochs run out
+	for at, tag := range map[time.Time]uint32{
+		next.Add(-time.Nanosecond): cur,
+		next:                       cur + 1,
+		next.Add(EpochPeriod):      0,
+	} {
+		rb := NewRouteBuilder()
+		rb.Now = func() time.Time { return at }
+		assert.NoError(t, rb.Push(pub))
+		rt, err := rb.GetRoute([]byte("Hi A"))
+		assert.NoError(t, err)
+		assert.Equal(t, tag, binary.BigEndian.Uint32(rt.Map[crypto.KeyLength:]))
+		assert.NoError(t, a.Route(&RoutePackage{RouteMsg: rt.RouteMsg}))
+	}
+}
@@ -0,0 +1,395 @@
+package descriptor
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/docs/mixnetrouting/cyclic"
+	"github.com/dist-ribut-us/docs/mixnetrouting/cyclic/cipher"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/dist-ribut-us/docs/mixnetrouting/path"
+	"github.com/dist-ribut-us/docs/mixnetrouting/sizeclass"
+	"github.com/dist-ribut-us/errors"
+	"time"
+)
+
+const (
+	// ErrBadDescriptor is returned when unmarshaling a malformed Descriptor
+	ErrBadDescriptor errors.String = "Bad node descriptor"
+	// ErrBadSignature is returned when a Descriptor is not signed by its
+	// SigningKey
+	ErrBadSignature errors.String = "Bad node descriptor signature"
+	// ErrExpired is returned when a Descriptor has expired
+	ErrExpired errors.String = "Node descriptor has expired"
+	// ErrInconsistent is returned when the fields of a Descriptor do not agree
+	// with each other
+	ErrInconsistent errors.String = "Node descriptor is inconsistent"
+	// ErrUnsupported is returned when asking for a scheme the node does not
+	// support
+	ErrUnsupported errors.String = "Node does not support the scheme"
+	// ErrKeyMismatch is returned by Sign when the key is not the SigningKey of
+	// the node the Descriptor is for
+	ErrKeyMismatch errors.String = "Node descriptor signed by a different key"
+)
+
+// MaxLifetime is the longest a Descriptor may be valid for. Nodes must
+// republish before it expires.
+const MaxLifetime = 7 * 24 * time.Hour
+
+var encode = base64.URLEncoding.EncodeToString
+
+// Scheme is a set of routing schemes
+type Scheme byte
+
+const (
+	// Onion is the classic onion routing scheme
+	Onion Scheme = 1 << iota
+	// Cyclic is the cyclic cipher scheme
+	Cyclic
+	allSchemes = Onion | Cyclic
+)
+
+// EpochKey is an exchange key valid for one epoch, as in onion.EpochKey and
+// cyclic.EpochKey.
+type EpochKey struct {
+	Epoch uint32
+	Key   *crypto.XchgPub
+}
+
+const epochKeyLen = 4 + crypto.KeyLength
+
+// Descriptor is what a node publishes to the directory. It holds the node's ID,
+// the proof-of-work for the ID and the node's exchange keys along with the
+// schemes it supports, the cipher Params IDs it accepts for the cyclic scheme,
+// the message size classes it routes, the proof-of-work it requires in the
+// stamp of each map packet and its bandwidth class, a relative measure where
+// higher is more. It is signed by the node's SigningKey, which the ID is
+// derived from, so only the node can sign a Descriptor for its ID. NodeSig is
+// the signature from the node's PubNode, so the PubNode can be rebuilt from the
+// Descriptor and still Verify.
+type Descriptor struct {
+	ID          []byte
+	Key         *crypto.XchgPub
+	Work        uint64
+	StampWork   byte
+	Epochs      []EpochKey
+	Schemes     Scheme
+	Params      []byte
+	SizeClasses []int
+	Bandwidth   byte
+	Expires     time.Time
+	SigningKey  ed25519.PublicKey
+	NodeSig     []byte
+	Sig         []byte
+}
+
+// ForOnion creates an unsigned Descriptor for an onion PubNode
+func ForOnion(pub *onion.PubNode, bandwidth byte, expires time.Time) *Descriptor {
+	d := &Descriptor{
+		ID:          pub.ID,
+		Key:         pub.Key,
+		SigningKey:  pub.SigningKey,
+		Work:        pub.Work,
+		StampWork:   byte(pub.StampWork),
+		Schemes:     Onion,
+		SizeClasses: sizeclass.Classes,
+		Bandwidth:   bandwidth,
+		Expires:     expires,
+		NodeSig:     pub.Sig,
+	}
+	for _, e := range pub.Epochs {
+		d.Epochs = append(d.Epochs, EpochKey{Epoch: e.Epoch, Key: e.Key})
+	}
+	return d
+}
+
+// ForCyclic creates an unsigned Descriptor for a cyclic PubNode that accepts
+// the given Params.
+func ForCyclic(pub *cyclic.PubNode, params []*cipher.Params, bandwidth byte, expires time.Time) *Descriptor {
+	d := &Descriptor{
+		ID:          pub.ID,
+		Key:         pub.Key,
+		SigningKey:  pub.SigningKey,
+		Work:        pub.Work,
+		StampWork:   byte(pub.StampWork),
+		Schemes:     Cyclic,
+		SizeClasses: sizeclass.Classes,
+		Bandwidth:   bandwidth,
+		Expires:     expires,
+		NodeSig:     pub.Sig,
+	}
+	for _, p := range params {
+		d.Params = append(d.Params, p.ID)
+	}
+	for _, e := range pub.Epochs {
+		d.Epochs = append(d.Epochs, EpochKey{Epoch: e.Epoch, Key: e.Key})
+	}
+	return d
+}
+
+// String is used to generate map keys, the same string used for the ID by the
+// onion and cyclic packages.
+func (d *Descriptor) String() string {
+	return encode(d.ID)
+}
+
+// body marshals everything but the signature as
+// len(ID) | ID | Key | Work | StampWork | Schemes | Bandwidth | Expires |
+// len(Params) | Params | len(SizeClasses) | SizeClasses | len(Epochs) |
+// Epochs | SigningKey | NodeSig
+// with 1 byte for each length and 4 bytes for each size class.
+func (d *Descriptor) body() ([]byte, error) {
+	if len(d.ID) > 255 || len(d.Params) > 255 || len(d.SizeClasses) > 255 ||
+		len(d.Epochs) > 255 || len(d.SigningKey) != ed25519.PublicKeySize || d.Key == nil ||
+		len(d.NodeSig) != ed25519.SignatureSize {
+		return nil, ErrBadDescriptor
+	}
+	for _, e := range d.Epochs {
+		if e.Key == nil {
+			return nil, ErrBadDescriptor
+		}
+	}
+	b := make([]byte, 0, 1+len(d.ID)+crypto.KeyLength+20+len(d.Params)+
+		1+4*len(d.SizeClasses)+1+epochKeyLen*len(d.Epochs)+ed25519.PublicKeySize+
+		ed25519.SignatureSize)
+	b = append(b, byte(len(d.ID)))
+	b = append(b, d.ID...)
+	b = append(b, d.Key.Slice()...)
+	b = appendUint64(b, d.Work)
+	b = append(b, d.StampWork)
+	b = append(b, byte(d.Schemes), d.Bandwidth)
+	b = appendUint64(b, uint64(d.Expires.Unix()))
+	b = append(b, byte(len(d.Params)))
+	b = append(b, d.Params...)
+	b = append(b, byte(len(d.SizeClasses)))
+	for _, c := range d.SizeClasses {
+		b = appendUint32(b, uint32(c))
+	}
+	b = append(b, byte(len(d.Epochs)))
+	for _, e := range d.Epochs {
+		b = appendUint32(b, e.Epoch)
+		b = append(b, e.Key.Slice()...)
+	}
+	b = append(b, d.SigningKey...)
+	return append(b, d.NodeSig...), nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// Sign the Descriptor with the node's signing key, setting Sig
+func (d *Descriptor) Sign(key ed25519.PrivateKey) error {
+	if !d.SigningKey.Equal(key.Public()) {
+		return ErrKeyMismatch
+	}
+	body, err := d.body()
+	if err != nil {
+		return err
+	}
+	d.Sig = ed25519.Sign(key, body)
+	return nil
+}
+
+// Marshal a signed Descriptor as body | Sig
+func (d *Descriptor) Marshal() ([]byte, error) {
+	if len(d.Sig) != ed25519.SignatureSize {
+		return nil, ErrBadSignature
+	}
+	body, err := d.body()
+	if err != nil {
+		return nil, err
+	}
+	return append(body, d.Sig...), nil
+}
+
+// reader reads the fields of a marshaled Descriptor and records if it ran out
+// of data.
+type reader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *reader) next(ln int) []byte {
+	if r.bad || len(r.b) < ln {
+		r.bad = true
+		return make([]byte, ln)
+	}
+	out := r.b[:ln]
+	r.b = r.b[ln:]
+	return out
+}
+
+func (r *reader) byte() byte { return r.next(1)[0] }
+
+// Unmarshal reverses Descriptor.Marshal. It does not Verify the Descriptor.
+func Unmarshal(b []byte) (*Descriptor, error) {
+	r := &reader{b: b}
+	d := &Descriptor{}
+	d.ID = append([]byte(nil), r.next(int(r.byte()))...)
+	d.Key = crypto.XchgPubFromSlice(r.next(crypto.KeyLength))
+	d.Work = binary.BigEndian.Uint64(r.next(8))
+	d.StampWork = r.byte()
+	d.Schemes = Scheme(r.byte())
+	d.Bandwidth = r.byte()
+	d.Expires = time.Unix(int64(binary.BigEndian.Uint64(r.next(8))), 0)
+	if ln := int(r.byte()); ln > 0 {
+		d.Params = append([]byte(nil), r.next(ln)...)
+	}
+	for i := int(r.byte()); i > 0; i-- {
+		d.SizeClasses = append(d.SizeClasses, int(binary.BigEndian.Uint32(r.next(4))))
+	}
+	for i := int(r.byte()); i > 0; i-- {
+		d.Epochs = append(d.Epochs, EpochKey{
+			Epoch: binary.BigEndian.Uint32(r.next(4)),
+			Key:   crypto.XchgPubFromSlice(r.next(crypto.KeyLength)),
+		})
+	}
+	d.SigningKey = append(ed25519.PublicKey(nil), r.next(ed25519.PublicKeySize)...)
+	d.NodeSig = append([]byte(nil), r.next(ed25519.SignatureSize)...)
+	d.Sig = append([]byte(nil), r.next(ed25519.SignatureSize)...)
+	if r.bad || len(r.b) != 0 {
+		return nil, ErrBadDescriptor
+	}
+	return d, nil
+}
+
+// Verify the signature and expiry of the Descriptor and that its fields are
+// consistent: at least one known scheme is supported, the PubNode verifies in
+// each supported scheme, the cyclic scheme is advertised with
+// registered Params and the size classes and epochs are in increasing order.
+func (d *Descriptor) Verify(now time.Time) error {
+	body, err := d.body()
+	if err != nil {
+		return err
+	}
+	if len(d.Sig) != ed25519.SignatureSize || !ed25519.Verify(d.SigningKey, body, d.Sig) {
+		return ErrBadSignature
+	}
+	if !now.Before(d.expires()) {
+		return ErrExpired
+	}
+	if d.expires().After(now.Add(MaxLifetime)) {
+		return ErrInconsistent
+	}
+	if !d.consistent() {
+		return ErrInconsistent
+	}
+	return nil
+}
+
+func (d *Descriptor) consistent() bool {
+	if d.Schemes == 0 || d.Schemes&^allSchemes != 0 {
+		return false
+	}
+	if pub, err := d.Onion(); err == nil && pub.Verify() != nil {
+		return false
+	}
+	if pub, err := d.Cyclic(); err == nil && pub.Verify() != nil {
+		return false
+	}
+	if (d.Schemes&Cyclic == 0) != (len(d.Params) == 0) {
+		return false
+	}
+	for _, id := range d.Params {
+		if _, err := cipher.Lookup(id); err != nil {
+			return false
+		}
+	}
+	if len(d.SizeClasses) == 0 {
+		return false
+	}
+	for i, c := range d.SizeClasses {
+		if c <= 0 || (i > 0 && c <= d.SizeClasses[i-1]) {
+			return false
+		}
+	}
+	for i, e := range d.Epochs {
+		if e.Epoch == 0 || (i > 0 && e.Epoch <= d.Epochs[i-1].Epoch) {
+			return false
+		}
+	}
+	return true
+}
+
+// expires returns Expires as it is signed, truncated to the second
+func (d *Descriptor) expires() time.Time {
+	return time.Unix(d.Expires.Unix(), 0)
+}
+
+// Onion returns the onion PubNode for the Descriptor
+func (d *Descriptor) Onion() (*onion.PubNode, error) {
+	if d.Schemes&Onion == 0 {
+		return nil, ErrUnsupported
+	}
+	pub := &onion.PubNode{
+		ID:         d.ID,
+		Key:        d.Key,
+		SigningKey: d.SigningKey,
+		Work:       d.Work,
+		StampWork:  int(d.StampWork),
+		Sig:        d.NodeSig,
+	}
+	for _, e := range d.Epochs {
+		pub.Epochs = append(pub.Epochs, onion.EpochKey{Epoch: e.Epoch, Key: e.Key})
+	}
+	return pub, nil
+}
+
+// Cyclic returns the cyclic PubNode for the Descriptor
+func (d *Descriptor) Cyclic() (*cyclic.PubNode, error) {
+	if d.Schemes&Cyclic == 0 {
+		return nil, ErrUnsupported
+	}
+	pub := &cyclic.PubNode{
+		ID:         d.ID,
+		Key:        d.Key,
+		SigningKey: d.SigningKey,
+		Work:       d.Work,
+		StampWork:  int(d.StampWork),
+		Sig:        d.NodeSig,
+	}
+	for _, e := range d.Epochs {
+		pub.Epochs = append(pub.Epochs, cyclic.EpochKey{Epoch: e.Epoch, Key: e.Key})
+	}
+	return pub, nil
+}
+
+// Accepts returns true if the node accepts the cyclic cipher Params
+func (d *Descriptor) Accepts(p *cipher.Params) bool {
+	return d.Schemes&Cyclic != 0 && bytes.IndexByte(d.Params, p.ID) >= 0
+}
+
+// Node returns a path.Node for the scheme with the Descriptor set, so that the
+// path.Verified constraint can check it. Capacity is the Bandwidth class.
+func (d *Descriptor) Node(s Scheme) (*path.Node, error) {
+	var pub path.PubNode
+	var err error
+	switch s {
+	case Onion:
+		pub, err = d.Onion()
+	case Cyclic:
+		pub, err = d.Cyclic()
+	default:
+		err = ErrUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &path.Node{
+		Pub:         pub,
+		Capacity:    float64(d.Bandwidth),
+		Reliability: 1,
+		Descriptor:  d,
+	}, nil
+}
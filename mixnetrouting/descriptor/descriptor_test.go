@@ -0,0 +1,217 @@
+package descriptor
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/docs/mixnetrouting/cyclic"
+	"github.com/dist-ribut-us/docs/mixnetrouting/cyclic/cipher"
+	"github.com/dist-ribut-us/docs/mixnetrouting/nodeid"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/dist-ribut-us/docs/mixnetrouting/path"
+	"github.com/dist-ribut-us/docs/mixnetrouting/pow"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func signed(t *testing.T, d *Descriptor, key ed25519.PrivateKey) (*Descriptor, ed25519.PrivateKey) {
+	assert.NoError(t, d.Sign(key))
+	return d, key
+}
+
+func onionDescriptor(t *testing.T) (*Descriptor, ed25519.PrivateKey) {
+	n := onion.NewPrivNode()
+	n.UpdateEpochs(time.Now(), 1)
+	return signed(t, ForOnion(n.Pub(), 3, time.Now().Add(time.Hour)), n.SigningKey)
+}
+
+func cyclicDescriptor(t *testing.T, n *cyclic.PrivNode, expires time.Time) *Descriptor {
+	d, _ := signed(t, ForCyclic(n.Pub(), []*cipher.Params{cipher.Default}, 1, expires), n.SigningKey)
+	return d
+}
+
+func TestMarshal(t *testing.T) {
+	d, _ := onionDescriptor(t)
+	b, err := d.Marshal()
+	assert.NoError(t, err)
+	got, err := Unmarshal(b)
+	assert.NoError(t, err)
+	assert.NoError(t, got.Verify(time.Now()))
+	gb, err := got.Marshal()
+	assert.NoError(t, err)
+	assert.Equal(t, b, gb)
+	assert.Equal(t, d.Expires.Unix(), got.Expires.Unix())
+
+	_, err = Unmarshal(b[:len(b)-1])
+	assert.Equal(t, ErrBadDescriptor, err)
+	_, err = Unmarshal(append(b, 0))
+	assert.Equal(t, ErrBadDescriptor, err)
+	_, err = Unmarshal(nil)
+	assert.Equal(t, ErrBadDescriptor, err)
+
+	_, err = ForOnion(onion.NewPrivNode().Pub(), 1, time.Now()).Marshal()
+	assert.Equal(t, ErrBadSignature, err)
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	d, _ := onionDescriptor(t)
+	assert.NoError(t, d.Verify(now))
+	assert.Equal(t, ErrExpired, d.Verify(now.Add(time.Hour)))
+
+	// any change breaks the signature
+	d.Bandwidth++
+	assert.Equal(t, ErrBadSignature, d.Verify(now))
+
+	inconsistent := map[string]func(d *Descriptor){
+		"id":       func(d *Descriptor) { d.ID = onion.NewPrivNode().ID },
+		"scheme":   func(d *Descriptor) { d.Schemes = 0 },
+		"unknown":  func(d *Descriptor) { d.Schemes |= 1 << 7 },
+		"params":   func(d *Descriptor) { d.Params = []byte{cipher.Default.ID} },
+		"cyclic":   func(d *Descriptor) { d.Schemes |= Cyclic },
+		"sizes":    func(d *Descriptor) { d.SizeClasses = []int{8192, 4096} },
+		"no sizes": func(d *Descriptor) { d.SizeClasses = nil },
+		"epochs":   func(d *Descriptor) { d.Epochs[0], d.Epochs[1] = d.Epochs[1], d.Epochs[0] },
+		"lifetime": func(d *Descriptor) { d.Expires = now.Add(2 * MaxLifetime) },
+		"stamp":    func(d *Descriptor) { d.StampWork = pow.MaxBits + 1 },
+	}
+	for name, fn := range inconsistent {
+		d, key := onionDescriptor(t)
+		fn(d)
+		assert.NoError(t, d.Sign(key))
+		assert.Equal(t, ErrInconsistent, d.Verify(now), name)
+	}
+}
+
+func TestIDWork(t *testing.T) {
+	defer nodeid.SetWork(0)
+	assert.NoError(t, nodeid.SetWork(8))
+	d, key := onionDescriptor(t)
+	b, err := d.Marshal()
+	assert.NoError(t, err)
+	got, err := Unmarshal(b)
+	assert.NoError(t, err)
+	assert.Equal(t, d.Work, got.Work)
+	assert.NoError(t, got.Verify(time.Now()))
+
+	// a node cannot skip the work by signing a descriptor without it
+	n := onion.NewPrivNode()
+	for n.Pub().Verify() == nil {
+		n.Work++
+	}
+	d, _ = signed(t, ForOnion(n.Pub(), 3, time.Now().Add(time.Hour)), n.SigningKey)
+	assert.Equal(t, ErrInconsistent, d.Verify(time.Now()))
+
+	// or change its PubNode after signing it
+	got.Work++
+	assert.NoError(t, got.Sign(key))
+	assert.Equal(t, ErrInconsistent, got.Verify(time.Now()))
+}
+
+func TestStampWork(t *testing.T) {
+	n := cyclic.NewPrivNode()
+	n.StampWork = 12
+	d := cyclicDescriptor(t, n, time.Now().Add(time.Hour))
+	b, err := d.Marshal()
+	assert.NoError(t, err)
+	got, err := Unmarshal(b)
+	assert.NoError(t, err)
+	assert.NoError(t, got.Verify(time.Now()))
+	pub, err := got.Cyclic()
+	assert.NoError(t, err)
+	assert.Equal(t, 12, pub.StampWork)
+}
+
+func TestSchemes(t *testing.T) {
+	d, _ := onionDescriptor(t)
+	pub, err := d.Onion()
+	assert.NoError(t, err)
+	assert.Equal(t, d.ID, pub.ID)
+	assert.Len(t, pub.Epochs, 2)
+	_, err = d.Cyclic()
+	assert.Equal(t, ErrUnsupported, err)
+	_, err = d.Node(Cyclic)
+	assert.Equal(t, ErrUnsupported, err)
+
+	cn := cyclic.NewPrivNode()
+	cd := cyclicDescriptor(t, cn, time.Now().Add(time.Hour))
+	assert.NoError(t, cd.Verify(time.Now()))
+	assert.True(t, cd.Accepts(cipher.Default))
+	assert.False(t, d.Accepts(cipher.Default))
+	n, err := cd.Node(Cyclic)
+	assert.NoError(t, err)
+	assert.Equal(t, cn.String(), n.ID())
+	assert.Equal(t, 1.0, n.Capacity)
+
+	// the cyclic PubNode can be routed through
+	rb := cyclic.NewRouteBuilder()
+	assert.NoError(t, rb.Push(n.Pub.(*cyclic.PubNode)))
+	rt, err := rb.GetRoute([]byte("test"))
+	assert.NoError(t, err)
+	assert.NoError(t, cn.Route(rt))
+}
+
+func TestDirectory(t *testing.T) {
+	now := time.Now()
+	dir := NewDirectory()
+	dir.Now = func() time.Time { return now }
+
+	d, key := onionDescriptor(t)
+	assert.NoError(t, dir.Add(d))
+	assert.Equal(t, d, dir.Get(d.String()))
+
+	// only the node's signing key can sign for its ID
+	forged := *d
+	pub, other, _ := ed25519.GenerateKey(rand.Reader)
+	forged.Expires = now.Add(2 * time.Hour)
+	assert.Equal(t, ErrKeyMismatch, forged.Sign(other))
+	forged.SigningKey = pub
+	assert.NoError(t, forged.Sign(other))
+	assert.Equal(t, ErrInconsistent, dir.Add(&forged))
+
+	// a later descriptor replaces it, an earlier one does not
+	later := *d
+	later.Expires = now.Add(2 * time.Hour)
+	assert.NoError(t, later.Sign(key))
+	b, err := later.Marshal()
+	assert.NoError(t, err)
+	_, err = dir.AddMarshaled(b)
+	assert.NoError(t, err)
+	assert.NoError(t, dir.Add(d))
+	assert.Equal(t, later.Expires.Unix(), dir.Get(d.String()).Expires.Unix())
+
+	bad := *d
+	bad.Bandwidth++
+	assert.Equal(t, ErrBadSignature, dir.Add(&bad))
+
+	for i := 0; i < 5; i++ {
+		d, _ := onionDescriptor(t)
+		assert.NoError(t, dir.Add(d))
+	}
+	cd := cyclicDescriptor(t, cyclic.NewPrivNode(), now.Add(time.Hour))
+	assert.NoError(t, dir.Add(cd))
+	assert.Len(t, dir.Path(Onion), 6)
+	assert.Len(t, dir.Path(Cyclic), 1)
+
+	// path selection only uses nodes that verify
+	pd := dir.Path(Onion)
+	pd = append(pd, &path.Node{Pub: onion.NewPrivNode().Pub(), Capacity: 1})
+	s := path.NewSelector(path.Verified(dir.Now))
+	assert.NoError(t, s.Select(pd, 6, path.NewSelection()))
+	assert.Equal(t, path.ErrNotEnoughNodes, s.Select(pd, 7, path.NewSelection()))
+
+	// only the later descriptor is still valid
+	now = now.Add(90 * time.Minute)
+	assert.NotNil(t, dir.Get(d.String()))
+	assert.Nil(t, dir.Get(cd.String()))
+	assert.Len(t, dir.Path(Onion), 1)
+	assert.Equal(t, path.ErrNotEnoughNodes, s.Select(pd, 2, path.NewSelection()))
+	dir.Expire()
+	assert.Len(t, dir.byID, 1)
+}
+
+func TestEpochKeyLen(t *testing.T) {
+	assert.Equal(t, onion.EpochTagLen+crypto.KeyLength, epochKeyLen)
+	assert.Equal(t, cyclic.EpochTagLen+crypto.KeyLength, epochKeyLen)
+}
@@ -0,0 +1,97 @@
+package descriptor
+
+import (
+	"github.com/dist-ribut-us/docs/mixnetrouting/path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Directory holds the verified descriptors of the network. A node's ID is
+// derived from its SigningKey, so every descriptor for an ID that verifies was
+// signed by the same node. A descriptor only replaces one that expires sooner.
+type Directory struct {
+	// Now can be replaced for testing
+	Now  func() time.Time
+	mux  sync.RWMutex
+	byID map[string]*Descriptor
+}
+
+// NewDirectory creates an empty Directory
+func NewDirectory() *Directory {
+	return &Directory{
+		Now:  time.Now,
+		byID: make(map[string]*Descriptor),
+	}
+}
+
+// Add a Descriptor after verifying it
+func (dir *Directory) Add(d *Descriptor) error {
+	if err := d.Verify(dir.Now()); err != nil {
+		return err
+	}
+	id := d.String()
+	dir.mux.Lock()
+	defer dir.mux.Unlock()
+	if cur, ok := dir.byID[id]; ok {
+		if !d.expires().After(cur.expires()) {
+			return nil
+		}
+	}
+	dir.byID[id] = d
+	return nil
+}
+
+// AddMarshaled unmarshals a Descriptor and adds it
+func (dir *Directory) AddMarshaled(b []byte) (*Descriptor, error) {
+	d, err := Unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return d, dir.Add(d)
+}
+
+// Get the Descriptor for an ID or nil if there is no valid Descriptor
+func (dir *Directory) Get(id string) *Descriptor {
+	dir.mux.RLock()
+	d := dir.byID[id]
+	dir.mux.RUnlock()
+	if d == nil || !dir.Now().Before(d.expires()) {
+		return nil
+	}
+	return d
+}
+
+// Expire removes expired descriptors
+func (dir *Directory) Expire() {
+	now := dir.Now()
+	dir.mux.Lock()
+	for id, d := range dir.byID {
+		if !now.Before(d.expires()) {
+			delete(dir.byID, id)
+		}
+	}
+	dir.mux.Unlock()
+}
+
+// Path returns a path.Directory of the nodes that support the scheme and have a
+// valid Descriptor, sorted by ID.
+func (dir *Directory) Path(s Scheme) path.Directory {
+	now := dir.Now()
+	dir.mux.RLock()
+	ds := make([]*Descriptor, 0, len(dir.byID))
+	for _, d := range dir.byID {
+		if d.Schemes&s != 0 && d.Verify(now) == nil {
+			ds = append(ds, d)
+		}
+	}
+	dir.mux.RUnlock()
+	sort.Slice(ds, func(i, j int) bool { return ds[i].String() < ds[j].String() })
+	pd := make(path.Directory, 0, len(ds))
+	for _, d := range ds {
+		if n, err := d.Node(s); err == nil {
+			pd = append(pd, n)
+		}
+	}
+	return pd
+}
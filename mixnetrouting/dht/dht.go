@@ -0,0 +1,456 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"github.com/dist-ribut-us/docs/mixnetrouting/memnet"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/dist-ribut-us/errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultK is the bucket size and the number of nodes a value is
+	// replicated to.
+	DefaultK = 8
+	// DefaultAlpha is the number of nodes queried in each round of a lookup
+	DefaultAlpha = 3
+	// DefaultMaxValueSize is large enough to hold a route map
+	DefaultMaxValueSize = 4096
+	// DefaultMaxValues is the number of values a single key can hold
+	DefaultMaxValues = 64
+	// DefaultMaxStoreSize is the total number of value bytes a node will hold
+	// for other nodes
+	DefaultMaxStoreSize = 16 << 20
+	// DefaultMaxTTL limits how long a value can be stored. Values in the DHT are
+	// meant to be short lived.
+	DefaultMaxTTL = time.Hour
+)
+
+const (
+	// ErrBadID is returned when an ID or key is not onion.IDLen bytes. The DHT
+	// uses the same IDs as the overlay so that nodes can be found by the ID
+	// they route with.
+	ErrBadID errors.String = "DHT IDs and keys must be IDLen bytes"
+	// ErrTooLarge is returned when a value exceeds MaxValueSize
+	ErrTooLarge errors.String = "Value is too large"
+	// ErrBadTTL is returned when a TTL is not positive
+	ErrBadTTL errors.String = "TTL must be positive"
+	// ErrKeyFull is returned when a key already holds MaxValues
+	ErrKeyFull errors.String = "Key holds too many values"
+	// ErrStoreFull is returned when storing a value would exceed MaxStoreSize
+	ErrStoreFull errors.String = "Store is full"
+	// ErrNotFound is returned by Get when no values are found
+	ErrNotFound errors.String = "No values found"
+	// ErrNotStored is returned by Put when no node stored the value
+	ErrNotStored errors.String = "Value was not stored"
+	// ErrBadMessage is returned when a DHT message cannot be decoded
+	ErrBadMessage errors.String = "Bad DHT message"
+)
+
+var encode = base64.URLEncoding.EncodeToString
+
+// Transport sends a request to an address and returns the response.
+// memnet.Endpoint is a Transport.
+type Transport interface {
+	Request(to string, req []byte) ([]byte, error)
+}
+
+// Node is a member of the DHT. The exported fields can be changed before the
+// node joins the network.
+type Node struct {
+	Contact
+	K            int
+	Alpha        int
+	MaxValueSize int
+	MaxValues    int
+	MaxStoreSize int
+	MaxTTL       time.Duration
+	// Now can be replaced for testing
+	Now       func() time.Time
+	transport Transport
+	mux       sync.Mutex
+	table     *table
+	store     *store
+}
+
+// New creates a Node with the given ID. Requests should be passed to Handle.
+func New(id []byte, addr string, t Transport) (*Node, error) {
+	if len(id) != onion.IDLen {
+		return nil, ErrBadID
+	}
+	return &Node{
+		Contact: Contact{
+			ID:   id,
+			Addr: addr,
+		},
+		K:            DefaultK,
+		Alpha:        DefaultAlpha,
+		MaxValueSize: DefaultMaxValueSize,
+		MaxValues:    DefaultMaxValues,
+		MaxStoreSize: DefaultMaxStoreSize,
+		MaxTTL:       DefaultMaxTTL,
+		Now:          time.Now,
+		transport:    t,
+		table:        newTable(id),
+		store:        newStore(),
+	}, nil
+}
+
+// Listen creates a Node on an in-memory network using the encoded ID as the
+// address.
+func Listen(net *memnet.Network, id []byte) (*Node, *memnet.Endpoint, error) {
+	if len(id) != onion.IDLen {
+		return nil, nil, ErrBadID
+	}
+	ep, err := net.Listen(encode(id), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := New(id, ep.Addr(), ep)
+	if err != nil {
+		return nil, nil, err
+	}
+	ep.Handle(n.Handle)
+	return n, ep, nil
+}
+
+const (
+	msgPing byte = iota
+	msgFindNode
+	msgFindValue
+	msgStore
+)
+
+type message struct {
+	Type     byte
+	ID       []byte
+	Key      []byte
+	Value    []byte
+	TTL      time.Duration
+	Contacts []Contact
+	Values   [][]byte
+	Err      string
+}
+
+func (m *message) marshal() []byte {
+	buf := &bytes.Buffer{}
+	gob.NewEncoder(buf).Encode(m)
+	return buf.Bytes()
+}
+
+func unmarshal(b []byte) (*message, error) {
+	m := &message{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(m); err != nil {
+		return nil, ErrBadMessage
+	}
+	if len(m.ID) != onion.IDLen {
+		return nil, ErrBadID
+	}
+	return m, nil
+}
+
+// Handle a request from another node. It satisfies memnet.Handler.
+func (n *Node) Handle(from string, req []byte) ([]byte, error) {
+	m, err := unmarshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp := &message{
+		Type: m.Type,
+		ID:   n.ID,
+	}
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.table.seen(Contact{
+		ID:   m.ID,
+		Addr: from,
+	}, n.K)
+	switch m.Type {
+	case msgPing:
+	case msgFindNode, msgFindValue:
+		if len(m.Key) != onion.IDLen {
+			return nil, ErrBadID
+		}
+		resp.Contacts = n.table.closest(m.Key, n.K)
+		if m.Type == msgFindValue {
+			resp.Values = n.store.get(encode(m.Key), n.Now())
+		}
+	case msgStore:
+		if err = n.storeLocal(m.Key, m.Value, m.TTL); err != nil {
+			resp.Err = err.Error()
+		}
+	default:
+		return nil, ErrBadMessage
+	}
+	return resp.marshal(), nil
+}
+
+// storeLocal validates and stores a value. The caller must hold the lock.
+func (n *Node) storeLocal(key, value []byte, ttl time.Duration) error {
+	if len(key) != onion.IDLen {
+		return ErrBadID
+	}
+	if len(value) > n.MaxValueSize {
+		return ErrTooLarge
+	}
+	if ttl <= 0 {
+		return ErrBadTTL
+	}
+	if ttl > n.MaxTTL {
+		ttl = n.MaxTTL
+	}
+	now := n.Now()
+	n.store.expire(now)
+	return n.store.put(encode(key), value, now.Add(ttl), n.MaxValues, n.MaxStoreSize)
+}
+
+// rpc sends a request to a contact. If the contact cannot be reached, it is
+// removed from the routing table.
+func (n *Node) rpc(c Contact, req *message) (*message, error) {
+	req.ID = n.ID
+	b, err := n.transport.Request(c.Addr, req.marshal())
+	if err == nil {
+		var resp *message
+		resp, err = unmarshal(b)
+		if err == nil && resp.Type == req.Type && bytes.Equal(resp.ID, c.ID) {
+			n.mux.Lock()
+			n.table.seen(c, n.K)
+			n.mux.Unlock()
+			if resp.Err != "" {
+				return nil, errors.String(resp.Err)
+			}
+			return resp, nil
+		}
+	}
+	n.mux.Lock()
+	n.table.failed(c.ID)
+	n.mux.Unlock()
+	if err == nil {
+		err = ErrBadMessage
+	}
+	return nil, err
+}
+
+// Join the network through a node at a known address and populate the routing
+// table by looking up the node's own ID.
+func (n *Node) Join(addr string) error {
+	b, err := n.transport.Request(addr, (&message{
+		Type: msgPing,
+		ID:   n.ID,
+	}).marshal())
+	if err != nil {
+		return err
+	}
+	resp, err := unmarshal(b)
+	if err != nil {
+		return err
+	}
+	n.mux.Lock()
+	n.table.seen(Contact{
+		ID:   resp.ID,
+		Addr: addr,
+	}, n.K)
+	n.mux.Unlock()
+	n.lookup(n.ID, msgFindNode)
+	return nil
+}
+
+// lookup performs an iterative search for the nodes closest to target. For
+// msgFindValue, the values returned by every node queried are collected. Unlike
+// a plain Kademlia lookup, it does not stop at the first value found so that
+// every value held under a key is returned.
+func (n *Node) lookup(target []byte, typ byte) ([]Contact, [][]byte) {
+	n.mux.Lock()
+	shortlist := n.table.closest(target, n.K)
+	n.mux.Unlock()
+
+	var values [][]byte
+	seenVals := make(map[string]bool)
+	queried := make(map[string]bool)
+	responded := make(map[string]bool)
+	known := make(map[string]bool)
+	known[encode(n.ID)] = true
+	for _, c := range shortlist {
+		known[encode(c.ID)] = true
+	}
+
+	for {
+		var batch []Contact
+		for i := 0; i < len(shortlist) && i < n.K && len(batch) < n.Alpha; i++ {
+			if !queried[encode(shortlist[i].ID)] {
+				batch = append(batch, shortlist[i])
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, c := range batch {
+			id := encode(c.ID)
+			queried[id] = true
+			resp, err := n.rpc(c, &message{
+				Type: typ,
+				Key:  target,
+			})
+			if err != nil {
+				if i := indexOf(shortlist, c.ID); i >= 0 {
+					shortlist = remove(shortlist, i)
+				}
+				continue
+			}
+			responded[id] = true
+			for _, rc := range resp.Contacts {
+				rid := encode(rc.ID)
+				if len(rc.ID) != onion.IDLen || known[rid] {
+					continue
+				}
+				known[rid] = true
+				shortlist = append(shortlist, rc)
+			}
+			for _, v := range resp.Values {
+				if vid := string(v); !seenVals[vid] {
+					seenVals[vid] = true
+					values = append(values, v)
+				}
+			}
+		}
+		sortByDistance(target, shortlist)
+	}
+
+	var closest []Contact
+	for _, c := range shortlist {
+		if len(closest) == n.K {
+			break
+		}
+		if responded[encode(c.ID)] {
+			closest = append(closest, c)
+		}
+	}
+	return closest, values
+}
+
+// Lookup returns the K closest reachable nodes to the target
+func (n *Node) Lookup(target []byte) ([]Contact, error) {
+	if len(target) != onion.IDLen {
+		return nil, ErrBadID
+	}
+	cs, _ := n.lookup(target, msgFindNode)
+	return cs, nil
+}
+
+// Put stores a value under a key on the K nodes closest to the key, including
+// this node if it is one of them. The TTL is limited by the MaxTTL of each node
+// that stores it. The value is copied, so the caller may reuse it.
+func (n *Node) Put(key, value []byte, ttl time.Duration) error {
+	if len(key) != onion.IDLen {
+		return ErrBadID
+	}
+	if len(value) > n.MaxValueSize {
+		return ErrTooLarge
+	}
+	if ttl <= 0 {
+		return ErrBadTTL
+	}
+	value = append([]byte(nil), value...)
+	cs, _ := n.lookup(key, msgFindNode)
+	stored := n.putTo(cs, key, value, ttl)
+	if stored == 0 {
+		return ErrNotStored
+	}
+	return nil
+}
+
+// putTo stores the value on this node, if it is among the K closest, and on
+// each contact. It returns the number of nodes that stored it.
+func (n *Node) putTo(cs []Contact, key, value []byte, ttl time.Duration) int {
+	stored := 0
+	if len(cs) < n.K || closer(key, n.ID, cs[len(cs)-1].ID) {
+		n.mux.Lock()
+		if n.storeLocal(key, value, ttl) == nil {
+			stored++
+		}
+		n.mux.Unlock()
+	}
+	for _, c := range cs {
+		_, err := n.rpc(c, &message{
+			Type:  msgStore,
+			Key:   key,
+			Value: value,
+			TTL:   ttl,
+		})
+		if err == nil {
+			stored++
+		}
+	}
+	return stored
+}
+
+// Get returns every value stored under a key by the nodes closest to it.
+func (n *Node) Get(key []byte) ([][]byte, error) {
+	if len(key) != onion.IDLen {
+		return nil, ErrBadID
+	}
+	_, values := n.lookup(key, msgFindValue)
+	n.mux.Lock()
+	local := n.store.get(encode(key), n.Now())
+	n.mux.Unlock()
+	for _, v := range local {
+		found := false
+		for _, fv := range values {
+			if bytes.Equal(v, fv) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return nil, ErrNotFound
+	}
+	return values, nil
+}
+
+// Expire removes the values that have expired
+func (n *Node) Expire() {
+	n.mux.Lock()
+	n.store.expire(n.Now())
+	n.mux.Unlock()
+}
+
+// Replicate expires old values and stores every value this node holds on the
+// nodes that are currently closest to its key, with the TTL it has remaining.
+// Calling it periodically keeps values available as nodes join and leave.
+func (n *Node) Replicate() {
+	type item struct {
+		key, value []byte
+		ttl        time.Duration
+	}
+	n.mux.Lock()
+	now := n.Now()
+	n.store.expire(now)
+	var items []item
+	for k, rs := range n.store.records {
+		key, _ := base64.URLEncoding.DecodeString(k)
+		for _, r := range rs {
+			items = append(items, item{key, r.value, r.expires.Sub(now)})
+		}
+	}
+	n.mux.Unlock()
+
+	for _, it := range items {
+		cs, _ := n.lookup(it.key, msgFindNode)
+		n.putTo(cs, it.key, it.value, it.ttl)
+	}
+}
+
+// Contacts returns the number of contacts in the routing table
+func (n *Node) Contacts() int {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.table.len()
+}
@@ -0,0 +1,231 @@
+package dht
+
+import (
+	"crypto/rand"
+	"github.com/dist-ribut-us/docs/mixnetrouting/memnet"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func randID() []byte {
+	id := make([]byte, onion.IDLen)
+	rand.Read(id)
+	return id
+}
+
+func setupNetwork(t *testing.T, size int) (*memnet.Network, []*Node, []*memnet.Endpoint) {
+	net := memnet.New()
+	nodes := make([]*Node, size)
+	eps := make([]*memnet.Endpoint, size)
+	for i := range nodes {
+		n, ep, err := Listen(net, randID())
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		nodes[i], eps[i] = n, ep
+		if i > 0 {
+			assert.NoError(t, n.Join(nodes[0].Addr))
+		}
+	}
+	return net, nodes, eps
+}
+
+func TestPrefixLen(t *testing.T) {
+	a := make([]byte, onion.IDLen)
+	b := make([]byte, onion.IDLen)
+	assert.Equal(t, onion.IDLen*8, prefixLen(a, b))
+	b[0] = 0x80
+	assert.Equal(t, 0, prefixLen(a, b))
+	b[0] = 0x01
+	assert.Equal(t, 7, prefixLen(a, b))
+	b[0], b[2] = 0, 0x10
+	assert.Equal(t, 19, prefixLen(a, b))
+}
+
+func TestTable(t *testing.T) {
+	self := make([]byte, onion.IDLen)
+	tbl := newTable(self)
+	tbl.seen(Contact{ID: self}, 2)
+	assert.Equal(t, 0, tbl.len())
+
+	// all share 0 bits with self, so land in the same bucket
+	cs := make([]Contact, 4)
+	for i := range cs {
+		id := make([]byte, onion.IDLen)
+		id[0] = 0x80 | byte(i)
+		cs[i] = Contact{ID: id}
+		tbl.seen(cs[i], 2)
+	}
+	assert.Equal(t, 2, tbl.len())
+	assert.Len(t, tbl.buckets[0].replacements, 2)
+
+	tbl.failed(cs[0].ID)
+	assert.Equal(t, 2, tbl.len())
+	closest := tbl.closest(self, 5)
+	assert.Equal(t, cs[1].ID, closest[0].ID)
+	assert.Equal(t, cs[3].ID, closest[1].ID)
+}
+
+func TestLookup(t *testing.T) {
+	_, nodes, _ := setupNetwork(t, 50)
+	for _, n := range nodes {
+		assert.True(t, n.Contacts() >= DefaultK)
+	}
+
+	target := randID()
+	cs, err := nodes[7].Lookup(target)
+	assert.NoError(t, err)
+	assert.Len(t, cs, DefaultK)
+
+	// Compare with the actual closest nodes, which excludes the node itself
+	var all []Contact
+	for i, n := range nodes {
+		if i != 7 {
+			all = append(all, n.Contact)
+		}
+	}
+	sortByDistance(target, all)
+	assert.Equal(t, all[:DefaultK], cs)
+
+	_, err = nodes[0].Lookup([]byte{1, 2, 3})
+	assert.Equal(t, ErrBadID, err)
+}
+
+func TestPutGet(t *testing.T) {
+	_, nodes, _ := setupNetwork(t, 40)
+	key := randID()
+
+	assert.NoError(t, nodes[3].Put(key, []byte("foo"), time.Minute))
+	assert.NoError(t, nodes[9].Put(key, []byte("bar"), time.Minute))
+	// storing the same value again does not duplicate it
+	assert.NoError(t, nodes[11].Put(key, []byte("bar"), time.Minute))
+
+	vs, err := nodes[20].Get(key)
+	assert.NoError(t, err)
+	assert.Len(t, vs, 2)
+	assert.Contains(t, vs, []byte("foo"))
+	assert.Contains(t, vs, []byte("bar"))
+
+	_, err = nodes[20].Get(randID())
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Equal(t, ErrTooLarge, nodes[0].Put(key, make([]byte, DefaultMaxValueSize+1), time.Minute))
+	assert.Equal(t, ErrBadTTL, nodes[0].Put(key, []byte("baz"), 0))
+
+	// a node stores its own copy of the value, here under its own ID so that
+	// it is one of the closest nodes
+	v := []byte("qux")
+	assert.NoError(t, nodes[5].Put(nodes[5].ID, v, time.Minute))
+	copy(v, "zzz")
+	vs, err = nodes[5].Get(nodes[5].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("qux")}, vs)
+}
+
+func TestPubNode(t *testing.T) {
+	_, nodes, _ := setupNetwork(t, 20)
+	pn := onion.NewPrivNode().Pub()
+	assert.NoError(t, nodes[5].Put(pn.ID, pn.Marshal(), time.Minute))
+
+	vs, err := nodes[15].Get(pn.ID)
+	assert.NoError(t, err)
+	got, err := onion.UnmarshalPubNode(vs[0])
+	assert.NoError(t, err)
+	assert.Equal(t, pn.ID, got.ID)
+	assert.Equal(t, pn.Key.Slice(), got.Key.Slice())
+}
+
+func TestTTL(t *testing.T) {
+	_, nodes, _ := setupNetwork(t, 20)
+	now := time.Now()
+	for _, n := range nodes {
+		n.Now = func() time.Time { return now }
+		n.MaxTTL = time.Minute
+	}
+	key := randID()
+	// the TTL is limited by MaxTTL
+	assert.NoError(t, nodes[1].Put(key, []byte("foo"), time.Hour))
+	_, err := nodes[2].Get(key)
+	assert.NoError(t, err)
+
+	now = now.Add(2 * time.Minute)
+	_, err = nodes[2].Get(key)
+	assert.Equal(t, ErrNotFound, err)
+	for _, n := range nodes {
+		n.Expire()
+		assert.Equal(t, 0, n.store.len())
+	}
+}
+
+func TestMaxValues(t *testing.T) {
+	_, nodes, _ := setupNetwork(t, 10)
+	for _, n := range nodes {
+		n.MaxValues = 2
+	}
+	key := randID()
+	assert.NoError(t, nodes[1].Put(key, []byte("a"), time.Minute))
+	assert.NoError(t, nodes[1].Put(key, []byte("b"), time.Minute))
+	assert.Equal(t, ErrNotStored, nodes[1].Put(key, []byte("c"), time.Minute))
+}
+
+func TestMaxStoreSize(t *testing.T) {
+	_, nodes, _ := setupNetwork(t, 10)
+	for _, n := range nodes {
+		n.MaxStoreSize = 3
+	}
+	assert.Equal(t, ErrNotStored, nodes[1].Put(randID(), []byte("abcd"), time.Minute))
+
+	n := nodes[2]
+	key := randID()
+	n.mux.Lock()
+	assert.NoError(t, n.storeLocal(key, []byte("ab"), time.Minute))
+	assert.Equal(t, ErrStoreFull, n.storeLocal(randID(), []byte("cd"), time.Minute))
+	// a value already held can still be refreshed
+	assert.NoError(t, n.storeLocal(key, []byte("ab"), time.Minute))
+	n.mux.Unlock()
+
+	n.Now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	n.Expire()
+	assert.Equal(t, 0, n.store.size)
+	n.mux.Lock()
+	assert.NoError(t, n.storeLocal(randID(), []byte("cd"), time.Minute))
+	n.mux.Unlock()
+}
+
+func TestReplicate(t *testing.T) {
+	net, nodes, eps := setupNetwork(t, 40)
+	key := randID()
+	assert.NoError(t, nodes[0].Put(key, []byte("foo"), time.Minute))
+
+	// take down every node holding the value but one
+	var holders []int
+	for i, n := range nodes {
+		if n.store.len() > 0 {
+			holders = append(holders, i)
+		}
+	}
+	assert.True(t, len(holders) > 1)
+	for _, i := range holders[1:] {
+		eps[i].SetDown(true)
+	}
+
+	// new nodes join near the key
+	for i := 0; i < 10; i++ {
+		id := append([]byte(nil), key...)
+		rand.Read(id[onion.IDLen/2:])
+		n, _, err := Listen(net, id)
+		assert.NoError(t, err)
+		assert.NoError(t, n.Join(nodes[holders[0]].Addr))
+		nodes = append(nodes, n)
+	}
+
+	nodes[holders[0]].Replicate()
+	eps[holders[0]].SetDown(true)
+
+	reader := nodes[len(nodes)-1]
+	vs, err := reader.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("foo")}, vs)
+}
@@ -0,0 +1,87 @@
+package dht
+
+import (
+	"bytes"
+	"time"
+)
+
+type record struct {
+	value   []byte
+	expires time.Time
+}
+
+// store holds the values for each key. A key can hold several values, which
+// allows a mailbox to collect records from many senders. size is the total
+// length of the values held.
+type store struct {
+	records map[string][]*record
+	size    int
+}
+
+func newStore() *store {
+	return &store{
+		records: make(map[string][]*record),
+	}
+}
+
+// put adds a value or extends the expiration if it is already held. It returns
+// ErrKeyFull if the key already holds max values and ErrStoreFull if adding
+// the value would take the store over maxSize bytes.
+func (s *store) put(key string, value []byte, expires time.Time, max, maxSize int) error {
+	rs := s.records[key]
+	for _, r := range rs {
+		if bytes.Equal(r.value, value) {
+			if expires.After(r.expires) {
+				r.expires = expires
+			}
+			return nil
+		}
+	}
+	if len(rs) >= max {
+		return ErrKeyFull
+	}
+	if s.size+len(value) > maxSize {
+		return ErrStoreFull
+	}
+	s.records[key] = append(rs, &record{
+		value:   value,
+		expires: expires,
+	})
+	s.size += len(value)
+	return nil
+}
+
+// get returns the unexpired values for a key
+func (s *store) get(key string, now time.Time) [][]byte {
+	var vs [][]byte
+	for _, r := range s.records[key] {
+		if now.Before(r.expires) {
+			vs = append(vs, r.value)
+		}
+	}
+	return vs
+}
+
+// expire removes every record that has expired
+func (s *store) expire(now time.Time) {
+	for key, rs := range s.records {
+		keep := rs[:0]
+		for _, r := range rs {
+			if now.Before(r.expires) {
+				keep = append(keep, r)
+			} else {
+				s.size -= len(r.value)
+			}
+		}
+		if len(keep) == 0 {
+			delete(s.records, key)
+		} else {
+			s.records[key] = keep
+		}
+	}
+}
+
+// len returns the number of keys held
+func (s *store) len() int {
+	return len(s.records)
+}
@@ -0,0 +1,154 @@
+package dht
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Contact is the ID and transport address of a DHT node
+type Contact struct {
+	ID   []byte
+	Addr string
+}
+
+// bucket holds up to k contacts ordered from least to most recently seen.
+// When the bucket is full, new contacts are held as replacements and promoted
+// when a contact fails to respond.
+type bucket struct {
+	contacts     []Contact
+	replacements []Contact
+}
+
+func indexOf(cs []Contact, id []byte) int {
+	for i, c := range cs {
+		if bytes.Equal(c.ID, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+func remove(cs []Contact, i int) []Contact {
+	return append(cs[:i], cs[i+1:]...)
+}
+
+// table is a Kademlia routing table with one bucket for each bit of the ID.
+// Bucket i holds contacts that share exactly i leading bits with self.
+type table struct {
+	self    []byte
+	buckets []bucket
+}
+
+func newTable(self []byte) *table {
+	return &table{
+		self:    self,
+		buckets: make([]bucket, len(self)*8),
+	}
+}
+
+// prefixLen returns the number of leading bits that a and b share
+func prefixLen(a, b []byte) int {
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			continue
+		}
+		l := i * 8
+		for ; x&0x80 == 0; x <<= 1 {
+			l++
+		}
+		return l
+	}
+	return len(a) * 8
+}
+
+// closer returns true if a is closer to target than b
+func closer(target, a, b []byte) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+func sortByDistance(target []byte, cs []Contact) {
+	sort.Slice(cs, func(i, j int) bool {
+		return closer(target, cs[i].ID, cs[j].ID)
+	})
+}
+
+func (t *table) bucket(id []byte) *bucket {
+	pl := prefixLen(t.self, id)
+	if pl == len(t.buckets) {
+		return nil
+	}
+	return &t.buckets[pl]
+}
+
+// seen moves a contact to the tail of its bucket, adding it if there are fewer
+// than k contacts and otherwise holding it as a replacement.
+func (t *table) seen(c Contact, k int) {
+	b := t.bucket(c.ID)
+	if b == nil {
+		return
+	}
+	if i := indexOf(b.contacts, c.ID); i >= 0 {
+		b.contacts = append(remove(b.contacts, i), c)
+		return
+	}
+	if len(b.contacts) < k {
+		b.contacts = append(b.contacts, c)
+		return
+	}
+	if i := indexOf(b.replacements, c.ID); i >= 0 {
+		b.replacements = remove(b.replacements, i)
+	}
+	b.replacements = append(b.replacements, c)
+	if len(b.replacements) > k {
+		b.replacements = b.replacements[1:]
+	}
+}
+
+// failed removes a contact that did not respond, promoting the most recently
+// seen replacement.
+func (t *table) failed(id []byte) {
+	b := t.bucket(id)
+	if b == nil {
+		return
+	}
+	if i := indexOf(b.replacements, id); i >= 0 {
+		b.replacements = remove(b.replacements, i)
+	}
+	i := indexOf(b.contacts, id)
+	if i < 0 {
+		return
+	}
+	b.contacts = remove(b.contacts, i)
+	if ln := len(b.replacements); ln > 0 {
+		b.contacts = append(b.contacts, b.replacements[ln-1])
+		b.replacements = b.replacements[:ln-1]
+	}
+}
+
+// closest returns up to n contacts ordered by distance to target
+func (t *table) closest(target []byte, n int) []Contact {
+	var cs []Contact
+	for _, b := range t.buckets {
+		cs = append(cs, b.contacts...)
+	}
+	sortByDistance(target, cs)
+	if len(cs) > n {
+		cs = cs[:n]
+	}
+	return cs
+}
+
+func (t *table) len() int {
+	l := 0
+	for _, b := range t.buckets {
+		l += len(b.contacts)
+	}
+	return l
+}
@@ -0,0 +1,238 @@
+package mailbox
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/docs/mixnetrouting/dht"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/dist-ribut-us/errors"
+	"time"
+)
+
+const (
+	// DefaultPeriod is the length of an epoch. Bob polls more often than this,
+	// about once a minute, and checks the previous epoch as well as the current
+	// one so introductions posted just before the epoch changes are not missed.
+	DefaultPeriod = 10 * time.Minute
+)
+
+const (
+	// ErrBadIntro is returned when unmarshaling a malformed Intro
+	ErrBadIntro errors.String = "Bad introduction record"
+	// ErrBadBundle is returned when unmarshaling a malformed Bundle
+	ErrBadBundle errors.String = "Bad route bundle"
+)
+
+// Key derives the DHT key of a mailbox from the identity key of its owner and
+// the epoch. Anyone who knows Bob's identity key can find his mailbox, but the
+// key changes every epoch so the DHT nodes holding it change as well.
+func Key(identity *crypto.XchgPub, epoch int64) []byte {
+	e := make([]byte, 8)
+	binary.BigEndian.PutUint64(e, uint64(epoch))
+	return crypto.GetDigest(identity.Slice(), e).Slice()[:onion.IDLen]
+}
+
+// Epoch returns the epoch containing t
+func Epoch(t time.Time, period time.Duration) int64 {
+	return t.UnixNano() / int64(period)
+}
+
+// Intro is the record Alice leaves in Bob's mailbox. From is Alice's identity
+// key and Offer is a return route that leads to her. It is sealed to Bob's
+// identity key, so only he can read it, but it is not signed; Bob should treat
+// From as a claim until Alice proves it over the route.
+type Intro struct {
+	From  *crypto.XchgPub
+	Offer *onion.RouteBuilder
+}
+
+// Marshal an Intro as From | Offer
+func (i *Intro) Marshal() ([]byte, error) {
+	offer, err := i.Offer.MarshalOffer()
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(nil), i.From.Slice()...), offer...), nil
+}
+
+// UnmarshalIntro reverses Intro.Marshal
+func UnmarshalIntro(b []byte) (*Intro, error) {
+	if len(b) < crypto.KeyLength {
+		return nil, ErrBadIntro
+	}
+	offer, err := onion.UnmarshalOffer(b[crypto.KeyLength:])
+	if err != nil {
+		return nil, ErrBadIntro
+	}
+	return &Intro{
+		From:  crypto.XchgPubFromSlice(b[:crypto.KeyLength]),
+		Offer: offer,
+	}, nil
+}
+
+// Post seals an Intro to Bob's identity key and stores it in his mailbox for
+// the current epoch. It is stored for two epochs so that it is still available
+// when Bob checks the previous epoch.
+func Post(n *dht.Node, to *crypto.XchgPub, intro *Intro, period time.Duration) error {
+	b, err := intro.Marshal()
+	if err != nil {
+		return err
+	}
+	key := Key(to, Epoch(n.Now(), period))
+	return n.Put(key, to.AnonSeal(b), 2*period)
+}
+
+// Mailbox is Bob's side of the introduction protocol.
+type Mailbox struct {
+	Identity *crypto.XchgPair
+	DHT      *dht.Node
+	Period   time.Duration
+	// seen holds the records already returned by Poll for each epoch
+	seen map[int64]map[string]bool
+}
+
+// New creates a Mailbox for an identity that polls through a DHT node
+func New(identity *crypto.XchgPair, n *dht.Node) *Mailbox {
+	return &Mailbox{
+		Identity: identity,
+		DHT:      n,
+		Period:   DefaultPeriod,
+		seen:     make(map[int64]map[string]bool),
+	}
+}
+
+// Key returns the DHT key of the mailbox for the current epoch
+func (m *Mailbox) Key() []byte {
+	return Key(m.Identity.Pub(), Epoch(m.DHT.Now(), m.Period))
+}
+
+// Poll checks the mailbox for the current and previous epoch and returns the
+// introductions that have not been returned before. Anyone can write to the
+// mailbox, so records that cannot be opened are ignored.
+func (m *Mailbox) Poll() ([]*Intro, error) {
+	cur := Epoch(m.DHT.Now(), m.Period)
+	for e := range m.seen {
+		if e < cur-1 {
+			delete(m.seen, e)
+		}
+	}
+
+	var intros []*Intro
+	for e := cur - 1; e <= cur; e++ {
+		vs, err := m.DHT.Get(Key(m.Identity.Pub(), e))
+		if err == dht.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		seen := m.seen[e]
+		if seen == nil {
+			seen = make(map[string]bool)
+			m.seen[e] = seen
+		}
+		for _, v := range vs {
+			id := string(crypto.GetDigest(v).Slice())
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			b, err := m.Identity.AnonOpen(v)
+			if err != nil {
+				continue
+			}
+			intro, err := UnmarshalIntro(b)
+			if err != nil {
+				continue
+			}
+			intros = append(intros, intro)
+		}
+	}
+	return intros, nil
+}
+
+// Bundle is the set of route offers Bob returns to Alice. Key optionally holds
+// a session key for end-to-end encryption on the routes, up to 255 bytes.
+type Bundle struct {
+	Key    []byte
+	Offers []*onion.RouteBuilder
+}
+
+// BundleFrom creates a Bundle from the fresh routes of a RouteManager
+func BundleFrom(rm *onion.RouteManager) (*Bundle, error) {
+	fresh, err := rm.Fresh()
+	if err != nil {
+		return nil, err
+	}
+	b := &Bundle{
+		Offers: make([]*onion.RouteBuilder, len(fresh)),
+	}
+	for i, r := range fresh {
+		b.Offers[i] = r.Offer.Copy()
+	}
+	return b, nil
+}
+
+// Marshal a Bundle as the length prefixed Key followed by a sequence of length
+// prefixed offers
+func (b *Bundle) Marshal() ([]byte, error) {
+	if len(b.Key) > 255 {
+		return nil, ErrBadBundle
+	}
+	out := append([]byte{byte(len(b.Key))}, b.Key...)
+	ln := make([]byte, 4)
+	for _, o := range b.Offers {
+		offer, err := o.MarshalOffer()
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(ln, uint32(len(offer)))
+		out = append(out, ln...)
+		out = append(out, offer...)
+	}
+	return out, nil
+}
+
+// UnmarshalBundle reverses Bundle.Marshal
+func UnmarshalBundle(b []byte) (*Bundle, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, ErrBadBundle
+	}
+	bundle := &Bundle{}
+	if b[0] > 0 {
+		bundle.Key = append([]byte(nil), b[1:1+b[0]]...)
+	}
+	b = b[1+b[0]:]
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, ErrBadBundle
+		}
+		ln := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		if uint64(ln) > uint64(len(b)) {
+			return nil, ErrBadBundle
+		}
+		offer, err := onion.UnmarshalOffer(b[:ln])
+		if err != nil {
+			return nil, ErrBadBundle
+		}
+		bundle.Offers = append(bundle.Offers, offer)
+		b = b[ln:]
+	}
+	return bundle, nil
+}
+
+// Reply sends a Bundle back to Alice on the return route in her Intro. The
+// Offer is copied and extend should push Bob's own hops onto it, so that the
+// route hides him from the hops Alice chose.
+func Reply(intro *Intro, b *Bundle, extend func(*onion.RouteBuilder) error) (*onion.RoutePackage, error) {
+	msg, err := b.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	rb := intro.Offer.Copy()
+	if err = extend(rb); err != nil {
+		return nil, err
+	}
+	return rb.Send(msg), nil
+}
@@ -0,0 +1,132 @@
+package mailbox
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/dist-ribut-us/docs/mixnetrouting/sim"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	id := crypto.GenerateXchgPair().Pub()
+	assert.Len(t, Key(id, 5), onion.IDLen)
+	assert.Equal(t, Key(id, 5), Key(id, 5))
+	assert.NotEqual(t, Key(id, 5), Key(id, 6))
+	assert.NotEqual(t, Key(id, 5), Key(crypto.GenerateXchgPair().Pub(), 5))
+
+	now := time.Now()
+	assert.Equal(t, Epoch(now, time.Minute)+1, Epoch(now.Add(time.Minute), time.Minute))
+}
+
+func TestIntroduction(t *testing.T) {
+	s, err := sim.New(40)
+	assert.NoError(t, err)
+	alice, bob := s.Nodes[5], s.Nodes[25]
+	aliceID, bobID := crypto.GenerateXchgPair(), crypto.GenerateXchgPair()
+	aliceRoutes := alice.ManageRoutes(1, 3, time.Hour)
+	bobRoutes := bob.ManageRoutes(3, 3, time.Hour)
+
+	// Alice posts an introduction with a return route to Bob's mailbox
+	fresh, err := aliceRoutes.Fresh()
+	assert.NoError(t, err)
+	returnRoute := fresh[0]
+	assert.NoError(t, Post(alice.DHT, bobID.Pub(), &Intro{
+		From:  aliceID.Pub(),
+		Offer: returnRoute.Offer.Copy(),
+	}, DefaultPeriod))
+	// anyone can write junk to the mailbox
+	mb := New(bobID, bob.DHT)
+	assert.NoError(t, s.Nodes[0].DHT.Put(mb.Key(), []byte("junk"), time.Minute))
+
+	// Bob polls and finds it once
+	intros, err := mb.Poll()
+	assert.NoError(t, err)
+	if !assert.Len(t, intros, 1) {
+		return
+	}
+	assert.Equal(t, aliceID.Pub().Slice(), intros[0].From.Slice())
+	again, err := mb.Poll()
+	assert.NoError(t, err)
+	assert.Len(t, again, 0)
+
+	// Bob replies with a bundle of his routes
+	bundle, err := BundleFrom(bobRoutes)
+	assert.NoError(t, err)
+	rp, err := Reply(intros[0], bundle, func(rb *onion.RouteBuilder) error {
+		return s.Extend(rb, 3)
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, bob.Send(rp))
+
+	in := alice.Inbox()
+	if !assert.Len(t, in, 1) {
+		return
+	}
+	assert.Equal(t, returnRoute.ID, in[0].RouteID)
+	got, err := UnmarshalBundle(in[0].Msg)
+	assert.NoError(t, err)
+	assert.Len(t, got.Offers, 3)
+
+	// Alice can now reach Bob on any of his routes
+	msg := []byte("Hi Bob")
+	for _, offer := range got.Offers {
+		assert.NoError(t, s.Extend(offer, 3))
+		assert.NoError(t, alice.Send(offer.Send(msg)))
+	}
+	in = bob.Inbox()
+	assert.Len(t, in, 3)
+	for _, d := range in {
+		assert.Equal(t, msg, d.Msg)
+		assert.Equal(t, 1, bobRoutes.Route(d.RouteID).Uses)
+	}
+}
+
+func TestPollPreviousEpoch(t *testing.T) {
+	s, err := sim.New(20)
+	assert.NoError(t, err)
+	alice, bob := s.Nodes[2], s.Nodes[12]
+	bobID := crypto.GenerateXchgPair()
+	fresh, err := alice.ManageRoutes(1, 2, time.Hour).Fresh()
+	assert.NoError(t, err)
+
+	assert.NoError(t, Post(alice.DHT, bobID.Pub(), &Intro{
+		From:  crypto.GenerateXchgPair().Pub(),
+		Offer: fresh[0].Offer.Copy(),
+	}, DefaultPeriod))
+
+	// Bob first polls in the next epoch
+	now := time.Now().Add(DefaultPeriod)
+	bob.DHT.Now = func() time.Time { return now }
+	mb := New(bobID, bob.DHT)
+	intros, err := mb.Poll()
+	assert.NoError(t, err)
+	assert.Len(t, intros, 1)
+
+	// Two epochs later it is no longer checked
+	now = now.Add(2 * DefaultPeriod)
+	mb = New(bobID, bob.DHT)
+	intros, err = mb.Poll()
+	assert.NoError(t, err)
+	assert.Len(t, intros, 0)
+}
+
+func TestBundle(t *testing.T) {
+	_, err := UnmarshalBundle([]byte{0, 0, 0, 0, 5, 1})
+	assert.Equal(t, ErrBadBundle, err)
+	_, err = UnmarshalBundle([]byte{3, 1, 2})
+	assert.Equal(t, ErrBadBundle, err)
+	_, err = UnmarshalBundle(nil)
+	assert.Equal(t, ErrBadBundle, err)
+
+	key := []byte("session key")
+	bs, err := (&Bundle{Key: key}).Marshal()
+	assert.NoError(t, err)
+	b, err := UnmarshalBundle(bs)
+	assert.NoError(t, err)
+	assert.Equal(t, key, b.Key)
+	assert.Len(t, b.Offers, 0)
+	_, err = UnmarshalIntro([]byte("short"))
+	assert.Equal(t, ErrBadIntro, err)
+}
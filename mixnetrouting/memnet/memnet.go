@@ -0,0 +1,105 @@
+package memnet
+
+import (
+	"github.com/dist-ribut-us/errors"
+	"sync"
+)
+
+const (
+	// ErrUnreachable is returned when sending to an address that is not
+	// listening or is down.
+	ErrUnreachable errors.String = "Address is unreachable"
+	// ErrAddrInUse is returned by Listen when the address is taken.
+	ErrAddrInUse errors.String = "Address is already in use"
+)
+
+// Handler processes a request from an address and returns the response.
+type Handler func(from string, req []byte) ([]byte, error)
+
+// Network is an in-memory network that delivers requests between Endpoints.
+// Requests are delivered synchronously by calling the handler of the
+// destination, so a whole network can be simulated offline and
+// deterministically. Every byte sent is copied so that endpoints cannot share
+// memory.
+type Network struct {
+	mux       sync.RWMutex
+	endpoints map[string]*Endpoint
+	// Sent counts the requests delivered
+	Sent int
+}
+
+// New creates an empty Network
+func New() *Network {
+	return &Network{
+		endpoints: make(map[string]*Endpoint),
+	}
+}
+
+// Endpoint is an address on a Network
+type Endpoint struct {
+	addr    string
+	net     *Network
+	handler Handler
+	down    bool
+}
+
+// Listen creates an Endpoint on the Network. Requests to the address will be
+// passed to the handler, which may be set later with Handle.
+func (n *Network) Listen(addr string, h Handler) (*Endpoint, error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if _, ok := n.endpoints[addr]; ok {
+		return nil, ErrAddrInUse
+	}
+	ep := &Endpoint{
+		addr:    addr,
+		net:     n,
+		handler: h,
+	}
+	n.endpoints[addr] = ep
+	return ep, nil
+}
+
+// Addr returns the address of the Endpoint
+func (ep *Endpoint) Addr() string { return ep.addr }
+
+// Handle sets the handler for requests to the Endpoint
+func (ep *Endpoint) Handle(h Handler) {
+	ep.net.mux.Lock()
+	ep.handler = h
+	ep.net.mux.Unlock()
+}
+
+// SetDown simulates the Endpoint dropping off of, or returning to, the network.
+// While it is down it can neither send nor receive.
+func (ep *Endpoint) SetDown(down bool) {
+	ep.net.mux.Lock()
+	ep.down = down
+	ep.net.mux.Unlock()
+}
+
+// Close removes the Endpoint from the network
+func (ep *Endpoint) Close() {
+	ep.net.mux.Lock()
+	delete(ep.net.endpoints, ep.addr)
+	ep.net.mux.Unlock()
+}
+
+// Request sends req to the address and returns the response.
+func (ep *Endpoint) Request(to string, req []byte) ([]byte, error) {
+	ep.net.mux.Lock()
+	dst, ok := ep.net.endpoints[to]
+	if !ok || dst.down || dst.handler == nil || ep.down {
+		ep.net.mux.Unlock()
+		return nil, ErrUnreachable
+	}
+	ep.net.Sent++
+	h := dst.handler
+	ep.net.mux.Unlock()
+
+	resp, err := h(ep.addr, append([]byte(nil), req...))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), resp...), nil
+}
@@ -0,0 +1,44 @@
+package memnet
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRequest(t *testing.T) {
+	n := New()
+	a, err := n.Listen("a", nil)
+	assert.NoError(t, err)
+	b, err := n.Listen("b", func(from string, req []byte) ([]byte, error) {
+		req[0] = 'x'
+		return append([]byte(from+":"), req...), nil
+	})
+	assert.NoError(t, err)
+	_, err = n.Listen("b", nil)
+	assert.Equal(t, ErrAddrInUse, err)
+
+	req := []byte("hello")
+	resp, err := a.Request("b", req)
+	assert.NoError(t, err)
+	assert.Equal(t, "a:xello", string(resp))
+	// the request was copied
+	assert.Equal(t, "hello", string(req))
+	assert.Equal(t, 1, n.Sent)
+
+	// a has no handler
+	_, err = b.Request("a", req)
+	assert.Equal(t, ErrUnreachable, err)
+
+	b.SetDown(true)
+	_, err = a.Request("b", req)
+	assert.Equal(t, ErrUnreachable, err)
+	b.SetDown(false)
+	_, err = a.Request("b", req)
+	assert.NoError(t, err)
+
+	b.Close()
+	_, err = a.Request("b", req)
+	assert.Equal(t, ErrUnreachable, err)
+	_, err = a.Request("c", req)
+	assert.Equal(t, ErrUnreachable, err)
+}
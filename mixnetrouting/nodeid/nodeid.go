@@ -0,0 +1,43 @@
+package nodeid
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/docs/mixnetrouting/pow"
+	"sync/atomic"
+)
+
+const (
+	// Len is the byte length of node IDs. It is shared by the onion and cyclic
+	// schemes and the DHT so a node has one ID on every layer. It is a build
+	// constant, not a network setting: it is not carried in descriptors or
+	// PubNodes, so every node on a network must be built with the same Len. It
+	// must be between MinLen and MaxLen.
+	Len = 16
+	// MinLen is the shortest usable ID. Shorter IDs make it cheap to find a key
+	// that collides with another node's ID.
+	MinLen = 8
+	// MaxLen is the longest usable ID, the length of the digest it is taken
+	// from.
+	MaxLen = crypto.DigestLength
+)
+
+// work is the number of leading zero bits of proof-of-work a node needs for its
+// ID, 0, no work, by default
+var work atomic.Int32
+
+// Work returns the proof-of-work required for node IDs in every scheme. It is
+// safe to call while SetWork is running.
+func Work() int {
+	return int(work.Load())
+}
+
+// SetWork sets the proof-of-work required for node IDs. Every node on a network
+// must use the same value. Raising it invalidates the IDs of nodes that did
+// less work.
+func SetWork(bits int) error {
+	if err := pow.Validate(bits); err != nil {
+		return err
+	}
+	work.Store(int32(bits))
+	return nil
+}
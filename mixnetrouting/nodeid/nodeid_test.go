@@ -0,0 +1,21 @@
+package nodeid
+
+import (
+	"github.com/dist-ribut-us/docs/mixnetrouting/pow"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLen(t *testing.T) {
+	assert.True(t, Len >= MinLen)
+	assert.True(t, Len <= MaxLen)
+}
+
+func TestSetWork(t *testing.T) {
+	defer SetWork(0)
+	assert.Equal(t, 0, Work())
+	assert.Error(t, SetWork(-1))
+	assert.Error(t, SetWork(pow.MaxBits+1))
+	assert.NoError(t, SetWork(8))
+	assert.Equal(t, 8, Work())
+}
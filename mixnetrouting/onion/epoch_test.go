@@ -0,0 +1,105 @@
+package onion
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEpochs(t *testing.T) {
+	a, b := NewPrivNode(), NewPrivNode()
+	now := time.Now()
+	cur := EpochOf(now)
+	a.UpdateEpochs(now, 2)
+	assert.Equal(t, []uint32{cur, cur + 1, cur + 2}, a.Epochs())
+
+	pub := a.Pub()
+	assert.Len(t, pub.Epochs, 3)
+	assert.Equal(t, a.epochs[cur].Key.Pub().Slice(), pub.EpochKey(now).Slice())
+	assert.True(t, pub.Epochs[0].Start().Unix() <= now.Unix())
+	assert.True(t, pub.Epochs[0].End().After(now))
+	got, err := UnmarshalPubNode(pub.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, pub.Marshal(), got.Marshal())
+	_, err = UnmarshalPubNode(pub.Marshal()[1:])
+	assert.Equal(t, ErrBadPubNode{}, err)
+
+	// the epoch keys are signed by the node
+	got.Epochs[0].Key = b.Key.Pub()
+	assert.Equal(t, ErrBadNodeSig{}, got.Verify())
+	assert.Equal(t, ErrBadNodeSig{}, NewSendRoute().Push(got))
+
+	send := func(pub *PubNode) *RoutePackage {
+		rb := NewSendRoute()
+		assert.NoError(t, rb.Push(b.Pub()))
+		assert.NoError(t, rb.Push(pub))
+		return rb.Send([]byte("test"))
+	}
+	copyRP := func(rp *RoutePackage) *RoutePackage {
+		return &RoutePackage{RouteMsg: &RouteMsg{
+			Map:  append([]byte(nil), rp.Map...),
+			Data: append([]byte(nil), rp.Data...),
+		}}
+	}
+
+	// Push uses the current epoch key and tags the packet
+	rp := send(pub)
+	assert.Equal(t, cur, binary.BigEndian.Uint32(rp.Map[crypto.KeyLength:]))
+	recorded := copyRP(rp)
+	replay := copyRP(rp)
+	assert.NoError(t, a.Route(rp))
+	assert.Equal(t, b.ID, rp.Next)
+	// the replay cache is kept per epoch
+	assert.Equal(t, ErrReplay{}, a.Route(replay))
+	assert.Len(t, a.Count, 0)
+
+	// without epoch keys the static key is used
+	static := &PubNode{ID: a.ID, Key: a.Key.Pub(), SigningKey: pub.SigningKey}
+	static.Sig = ed25519.Sign(a.SigningKey, static.body())
+	rp = send(static)
+	assert.Equal(t, uint32(0), binary.BigEndian.Uint32(rp.Map[crypto.KeyLength:]))
+	assert.NoError(t, a.Route(rp))
+	assert.Len(t, a.Count, 1)
+
+	// two epochs later the key is erased along with its replay cache
+	key := a.epochs[cur].Key
+	a.UpdateEpochs(now.Add(2*EpochPeriod), 2)
+	assert.Equal(t, []uint32{cur + 1, cur + 2, cur + 3, cur + 4}, a.Epochs())
+	assert.Equal(t, make([]byte, crypto.KeyLength), key.Priv().Slice())
+	assert.Equal(t, crypto.ErrDecryptionFailed, a.Route(recorded))
+
+	// Rotate replaces the epoch keys
+	pub = a.Pub()
+	a.Rotate()
+	assert.Equal(t, []uint32{cur + 1, cur + 2, cur + 3, cur + 4}, a.Epochs())
+	assert.NotEqual(t, pub.Epochs[0].Key.Slice(), a.Pub().Epochs[0].Key.Slice())
+}
+
+func TestPushClock(t *testing.T) {
+	a, b := NewPrivNode(), NewPrivNode()
+	now := time.Now()
+	cur := EpochOf(now)
+	a.UpdateEpochs(now, 1)
+	pub := a.Pub()
+	next := pub.Epochs[1].Start()
+
+	// Push picks the key for the epoch on the builder's clock, either side of
+	// the boundary, and the static key once the advertised epochs run out
+	for at, tag := range map[time.Time]uint32{
+		next.Add(-time.Nanosecond): cur,
+		next:                       cur + 1,
+		next.Add(EpochPeriod):      0,
+	} {
+		rb := NewSendRoute()
+		rb.Now = func() time.Time { return at }
+		assert.NoError(t, rb.Push(b.Pub()))
+		assert.NoError(t, rb.Push(pub))
+		rp := rb.Send([]byte("test"))
+		assert.Equal(t, tag, binary.BigEndian.Uint32(rp.Map[crypto.KeyLength:]))
+		assert.NoError(t, a.Route(rp))
+		assert.Equal(t, b.ID, rp.Next)
+	}
+}
@@ -0,0 +1,95 @@
+package onion
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// fuzzRoute returns a node with a receive route, the KeySet for the route and
+// a message sent on it that has arrived at the node.
+func fuzzRoute(tb testing.TB) (*PrivNode, KeySet, *RoutePackage) {
+	n, hop := NewPrivNode(), NewPrivNode()
+	rb := n.NewReceiveRoute()
+	if err := rb.Push(hop.Pub()); err != nil {
+		tb.Fatal(err)
+	}
+	id, ks := rb.Receive()
+	n.Cache = map[string]KeySet{id: ks}
+	rp := rb.Send([]byte("fuzz"))
+	if err := hop.Route(rp); err != nil {
+		tb.Fatal(err)
+	}
+	return n, ks, rp
+}
+
+func FuzzRoute(f *testing.F) {
+	n := NewPrivNode()
+	rb := NewSendRoute()
+	if err := rb.Push(n.Pub()); err != nil {
+		f.Fatal(err)
+	}
+	rp := rb.Send([]byte("fuzz"))
+	f.Add(rp.Map, rp.Data)
+	direct, err := NewDirectRoute(n.Pub())
+	if err != nil {
+		f.Fatal(err)
+	}
+	rp = direct.Send([]byte("fuzz"))
+	f.Add(rp.Map, rp.Data)
+	f.Add([]byte{}, []byte{})
+	f.Add(make([]byte, PacketLength-1), []byte{})
+
+	f.Fuzz(func(t *testing.T, m, data []byte) {
+		ln := len(m)
+		rp := &RoutePackage{RouteMsg: &RouteMsg{Map: m, Data: data}}
+		if _, err := n.Deliver(rp); err == nil && len(rp.Map) != ln {
+			t.Fatal("Route changed the length of the Map")
+		}
+	})
+}
+
+func FuzzOpen(f *testing.F) {
+	n, ks, rp := fuzzRoute(f)
+	next := rp.Next
+	f.Add(rp.Map, rp.Data)
+	f.Add([]byte{}, []byte{})
+
+	f.Fuzz(func(t *testing.T, m, data []byte) {
+		cp := func() *RoutePackage {
+			return &RoutePackage{
+				RouteMsg: &RouteMsg{
+					Map:  append([]byte(nil), m...),
+					Data: append([]byte(nil), data...),
+				},
+				Next: next,
+			}
+		}
+		cp().Open(ks)
+		n.Open(cp())
+		rp := cp()
+		rp.Next = nil
+		n.Open(rp)
+	})
+}
+
+func TestMalformed(t *testing.T) {
+	n := NewPrivNode()
+	for _, rp := range []*RoutePackage{
+		nil,
+		{},
+		{RouteMsg: &RouteMsg{}},
+		{RouteMsg: &RouteMsg{Map: make([]byte, PacketLength-1)}},
+		{RouteMsg: &RouteMsg{Map: make([]byte, PacketLength+1)}},
+	} {
+		assert.Equal(t, ErrBadMap{}, n.Route(rp))
+		_, err := n.Deliver(rp)
+		assert.Equal(t, ErrBadMap{}, err)
+	}
+	_, err := n.Open(nil)
+	assert.Equal(t, ErrBadMap{}, err)
+
+	_, ks, rp := fuzzRoute(t)
+	rp.Map = rp.Map[:len(ks.KNs)*PacketLength-1]
+	_, err = rp.Open(ks)
+	assert.Equal(t, ErrBadMap{}, err)
+}
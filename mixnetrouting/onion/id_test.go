@@ -0,0 +1,51 @@
+package onion
+
+import (
+	"github.com/dist-ribut-us/docs/mixnetrouting/nodeid"
+	"github.com/dist-ribut-us/docs/mixnetrouting/pow"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	a, b := NewPrivNode(), NewPrivNode()
+	assert.Len(t, a.ID, IDLen)
+	assert.NoError(t, a.Pub().Verify())
+
+	// an ID claimed for someone else's key
+	forged := &PubNode{ID: a.ID, Key: b.Key.Pub()}
+	assert.Equal(t, ErrUnverified{}, forged.Verify())
+	assert.Equal(t, ErrUnverified{}, (&PubNode{ID: a.ID}).Verify())
+	// or for someone else's signing key
+	signing := &PubNode{ID: a.ID, Key: a.Key.Pub(), SigningKey: b.Pub().SigningKey}
+	assert.Equal(t, ErrUnverified{}, signing.Verify())
+	rb := NewSendRoute()
+	assert.Equal(t, ErrUnverified{}, rb.Push(forged))
+	assert.Len(t, rb.KNs, 0)
+	_, err := NewDirectRoute(forged)
+	assert.Equal(t, ErrUnverified{}, err)
+}
+
+func TestIDWork(t *testing.T) {
+	defer nodeid.SetWork(0)
+	assert.NoError(t, nodeid.SetWork(8))
+	a, b := NewPrivNode(), NewPrivNode()
+	pub := a.Pub()
+	assert.NoError(t, pub.Verify())
+	got, err := UnmarshalPubNode(pub.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, a.Work, got.Work)
+	assert.NoError(t, got.Verify())
+
+	// find a Work that is not a proof
+	for pub.Work++; pow.Check(workData(pub.ID, pub.Key), pub.Work, nodeid.Work()); pub.Work++ {
+	}
+	assert.Equal(t, ErrInsufficientWork{}, pub.Verify())
+	rb := NewSendRoute()
+	assert.Equal(t, ErrInsufficientWork{}, rb.Push(pub))
+
+	// Rotate does the work for the new ID
+	b.Rotate()
+	assert.NoError(t, b.Pub().Verify())
+	assert.NoError(t, rb.Push(b.Pub()))
+}
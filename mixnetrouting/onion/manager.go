@@ -0,0 +1,175 @@
+package onion
+
+import (
+	"sort"
+	"time"
+)
+
+// ErrRevoked is returned by RouteManager.Deliver when a message arrives on a
+// route that has been revoked or has expired.
+type ErrRevoked struct{}
+
+func (ErrRevoked) Error() string {
+	return "Route has been revoked"
+}
+
+// ManagedRoute is a receive route tracked by a RouteManager. Offer is the send
+// RouteBuilder to give to a peer; it should be copied before pushing to it.
+type ManagedRoute struct {
+	ID      string
+	Offer   *RouteBuilder
+	Created time.Time
+	Uses    int
+}
+
+// RouteManager keeps a PrivNode stocked with receive routes. It populates the
+// node's Cache, expires routes after TTL and builds new routes with the hops
+// returned by Hops. A route is fresh for the first half of its TTL; after that
+// it can still receive messages, but it is no longer offered and a replacement
+// is built so that Target fresh routes are always available. The manager does
+// not run on its own: routes are only built by Maintain and Fresh, so the
+// caller must call Maintain at least once every TTL/2, and after Revoke, to
+// keep Target fresh routes on offer.
+type RouteManager struct {
+	Node   *PrivNode
+	Target int
+	TTL    time.Duration
+	Hops   func() ([]*PubNode, error)
+	// Now can be replaced for testing
+	Now     func() time.Time
+	routes  map[string]*ManagedRoute
+	revoked map[string]time.Time
+}
+
+// NewRouteManager creates a RouteManager for the node. It does not build any
+// routes until Maintain or Fresh is called.
+func NewRouteManager(n *PrivNode, target int, ttl time.Duration, hops func() ([]*PubNode, error)) *RouteManager {
+	if n.Cache == nil {
+		n.Cache = make(map[string]KeySet)
+	}
+	return &RouteManager{
+		Node:    n,
+		Target:  target,
+		TTL:     ttl,
+		Hops:    hops,
+		Now:     time.Now,
+		routes:  make(map[string]*ManagedRoute),
+		revoked: make(map[string]time.Time),
+	}
+}
+
+// Build a new receive route and add it to the node's Cache.
+func (m *RouteManager) Build() (*ManagedRoute, error) {
+	hops, err := m.Hops()
+	if err != nil {
+		return nil, err
+	}
+	rb := m.Node.NewReceiveRoute()
+	for _, h := range hops {
+		if err = rb.Push(h); err != nil {
+			return nil, err
+		}
+	}
+	id, ks := rb.Receive()
+	m.Node.Cache[id] = ks
+	mr := &ManagedRoute{
+		ID:      id,
+		Offer:   rb,
+		Created: m.Now(),
+	}
+	m.routes[id] = mr
+	return mr, nil
+}
+
+// Revoke a route. It is removed from the node's Cache and any message that
+// later arrives on it will be dropped. No replacement is built until the next
+// Maintain.
+func (m *RouteManager) Revoke(id string) {
+	delete(m.routes, id)
+	delete(m.Node.Cache, id)
+	m.revoked[id] = m.Now()
+}
+
+// Expire revokes every route older than TTL. Revoked IDs are forgotten once
+// they have been revoked for a TTL, by which point the hops in the route
+// will have changed their overlay IDs. Like Revoke, it does not build
+// replacements; Maintain does.
+func (m *RouteManager) Expire() {
+	now := m.Now()
+	for id, r := range m.routes {
+		if now.Sub(r.Created) >= m.TTL {
+			m.Revoke(id)
+		}
+	}
+	for id, t := range m.revoked {
+		if now.Sub(t) >= m.TTL {
+			delete(m.revoked, id)
+		}
+	}
+}
+
+func (m *RouteManager) isFresh(r *ManagedRoute, now time.Time) bool {
+	return now.Sub(r.Created) < m.TTL/2
+}
+
+// Maintain expires old routes and builds new routes until there are Target
+// fresh routes.
+func (m *RouteManager) Maintain() error {
+	m.Expire()
+	now := m.Now()
+	fresh := 0
+	for _, r := range m.routes {
+		if m.isFresh(r, now) {
+			fresh++
+		}
+	}
+	for ; fresh < m.Target; fresh++ {
+		if _, err := m.Build(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fresh maintains the routes and returns the fresh routes, newest first.
+func (m *RouteManager) Fresh() ([]*ManagedRoute, error) {
+	if err := m.Maintain(); err != nil {
+		return nil, err
+	}
+	now := m.Now()
+	var fresh []*ManagedRoute
+	for _, r := range m.routes {
+		if m.isFresh(r, now) {
+			fresh = append(fresh, r)
+		}
+	}
+	sort.Slice(fresh, func(i, j int) bool {
+		return fresh[i].Created.After(fresh[j].Created)
+	})
+	return fresh, nil
+}
+
+// Route returns the ManagedRoute for an ID or nil if the manager is not
+// tracking it.
+func (m *RouteManager) Route(id string) *ManagedRoute {
+	return m.routes[id]
+}
+
+// Deliver calls Deliver on the node, dropping messages on revoked routes and
+// counting the uses of each route.
+func (m *RouteManager) Deliver(rp *RoutePackage) (*Delivery, error) {
+	d, err := m.Node.Deliver(rp)
+	if err != nil {
+		return nil, err
+	}
+	if d.Forward {
+		if _, ok := m.revoked[encode(d.Next)]; ok {
+			return nil, ErrRevoked{}
+		}
+		return d, nil
+	}
+	if r, ok := m.routes[d.RouteID]; ok {
+		r.Uses++
+	}
+	return d, nil
+}
@@ -0,0 +1,109 @@
+package onion
+
+import (
+	"github.com/stretchr/testify/assert"
+	mr "math/rand"
+	"testing"
+	"time"
+)
+
+func setupManager(dht map[string]*PrivNode, ids []string, bob string) (*RouteManager, *time.Time) {
+	now := time.Now()
+	m := NewRouteManager(dht[bob], 3, time.Minute, func() ([]*PubNode, error) {
+		hops := make([]*PubNode, 3)
+		for i := range hops {
+			hops[i] = dht[ids[mr.Intn(len(ids))]].Pub()
+		}
+		return hops, nil
+	})
+	m.Now = func() time.Time { return now }
+	return m, &now
+}
+
+func sendOnOffer(t *testing.T, dht map[string]*PrivNode, ids []string, m *RouteManager, r *ManagedRoute, msg []byte) (*Delivery, error) {
+	rb, err := setupAlicesRoute(r.Offer.Copy(), dht, ids, 2)
+	assert.NoError(t, err)
+	rp := rb.Send(msg)
+	for {
+		rp = &RoutePackage{
+			RouteMsg: rp.RouteMsg,
+			Next:     rp.Next,
+		}
+		n := dht[encode(rp.Next)]
+		var d *Delivery
+		if n == m.Node {
+			d, err = m.Deliver(rp)
+		} else {
+			d, err = n.Deliver(rp)
+		}
+		if err != nil || !d.Forward {
+			return d, err
+		}
+		if _, ok := dht[encode(d.Next)]; !ok {
+			t.Error("forwarded to unknown node")
+			return nil, nil
+		}
+	}
+}
+
+func TestRouteManager(t *testing.T) {
+	dht, ids := setupDHT(30)
+	bob := ids[mr.Intn(len(ids))]
+	m, now := setupManager(dht, ids, bob)
+
+	fresh, err := m.Fresh()
+	assert.NoError(t, err)
+	assert.Len(t, fresh, 3)
+	assert.Len(t, m.Node.Cache, 3)
+
+	msg := []byte("Hi Bob")
+	d, err := sendOnOffer(t, dht, ids, m, fresh[0], msg)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, d.Msg)
+	assert.Equal(t, fresh[0].ID, d.RouteID)
+	assert.Equal(t, 1, m.Route(fresh[0].ID).Uses)
+
+	// After half the TTL, the routes are aging and new ones are built
+	*now = now.Add(40 * time.Second)
+	aged := fresh
+	fresh, err = m.Fresh()
+	assert.NoError(t, err)
+	assert.Len(t, fresh, 3)
+	assert.Len(t, m.Node.Cache, 6)
+	for _, r := range fresh {
+		assert.NotEqual(t, aged[0].ID, r.ID)
+	}
+
+	// Aging routes can still receive
+	d, err = sendOnOffer(t, dht, ids, m, aged[1], msg)
+	assert.NoError(t, err)
+	assert.Equal(t, aged[1].ID, d.RouteID)
+
+	// After the TTL they are expired and dropped
+	*now = now.Add(40 * time.Second)
+	assert.NoError(t, m.Maintain())
+	assert.Nil(t, m.Route(aged[2].ID))
+	_, err = sendOnOffer(t, dht, ids, m, aged[2], msg)
+	assert.Equal(t, ErrRevoked{}, err)
+}
+
+func TestRouteManagerRevoke(t *testing.T) {
+	dht, ids := setupDHT(30)
+	bob := ids[mr.Intn(len(ids))]
+	m, _ := setupManager(dht, ids, bob)
+
+	fresh, err := m.Fresh()
+	assert.NoError(t, err)
+	m.Revoke(fresh[0].ID)
+	assert.Len(t, m.routes, 2)
+
+	_, err = sendOnOffer(t, dht, ids, m, fresh[0], []byte("Hi Bob"))
+	assert.Equal(t, ErrRevoked{}, err)
+
+	// The next Maintain replaces the route
+	assert.NoError(t, m.Maintain())
+	assert.Len(t, m.routes, 3)
+	fresh, err = m.Fresh()
+	assert.NoError(t, err)
+	assert.Len(t, fresh, 3)
+}
@@ -0,0 +1,76 @@
+package onion
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/crypto"
+	"time"
+)
+
+// ErrBadOffer is returned when marshaling a RouteBuilder that is not a send
+// route offer or unmarshaling an offer that is malformed.
+type ErrBadOffer struct{}
+
+func (ErrBadOffer) Error() string {
+	return "Not a valid route offer"
+}
+
+// ErrBadRouteMsg is returned when unmarshaling a RouteMsg that is malformed
+type ErrBadRouteMsg struct{}
+
+func (ErrBadRouteMsg) Error() string {
+	return "Not a valid RouteMsg"
+}
+
+// MarshalOffer serializes a send RouteBuilder returned by Receive so that it
+// can be given to a peer. The keys for the route never leave the node that
+// built it, so only the Next ID, the base key and the map are included as
+// Next | BaseKey | Map.
+func (rb *RouteBuilder) MarshalOffer() ([]byte, error) {
+	if !rb.SendMode || len(rb.KNs) > 0 || rb.BaseKey == nil || len(rb.Next) != IDLen || len(rb.Data)%PacketLength != 0 {
+		return nil, ErrBadOffer{}
+	}
+	b := make([]byte, 0, IDLen+crypto.KeyLength+len(rb.Data))
+	b = append(b, rb.Next...)
+	b = append(b, rb.BaseKey.Slice()...)
+	return append(b, rb.Data...), nil
+}
+
+// UnmarshalOffer reverses MarshalOffer. The returned RouteBuilder can be pushed
+// to and sent on.
+func UnmarshalOffer(b []byte) (*RouteBuilder, error) {
+	if len(b) < IDLen+crypto.KeyLength || (len(b)-IDLen-crypto.KeyLength)%PacketLength != 0 {
+		return nil, ErrBadOffer{}
+	}
+	return &RouteBuilder{
+		Next:         append([]byte(nil), b[:IDLen]...),
+		BaseKey:      crypto.XchgPubFromSlice(b[IDLen : IDLen+crypto.KeyLength]),
+		Data:         append([]byte(nil), b[IDLen+crypto.KeyLength:]...),
+		SendMode:     true,
+		MaxStampWork: DefaultMaxStampWork,
+		Now:          time.Now,
+	}, nil
+}
+
+// Marshal a RouteMsg for transmission as len(Map) | Map | Data
+func (r *RouteMsg) Marshal() []byte {
+	b := make([]byte, 4, 4+len(r.Map)+len(r.Data))
+	binary.BigEndian.PutUint32(b, uint32(len(r.Map)))
+	b = append(b, r.Map...)
+	return append(b, r.Data...)
+}
+
+// UnmarshalRouteMsg reverses RouteMsg.Marshal
+func UnmarshalRouteMsg(b []byte) (*RouteMsg, error) {
+	if len(b) < 4 {
+		return nil, ErrBadRouteMsg{}
+	}
+	ln := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint64(ln) > uint64(len(b)) || ln%uint32(PacketLength) != 0 {
+		return nil, ErrBadRouteMsg{}
+	}
+	return &RouteMsg{
+		Map:  append([]byte(nil), b[:ln]...),
+		Data: append([]byte(nil), b[ln:]...),
+	}, nil
+}
@@ -0,0 +1,52 @@
+package onion
+
+import (
+	"github.com/stretchr/testify/assert"
+	mr "math/rand"
+	"testing"
+)
+
+func TestMarshalOffer(t *testing.T) {
+	dht, ids := setupDHT(30)
+	bob := ids[mr.Intn(len(ids))]
+	bobsRoute, err := setupBobsRoute(bob, dht, ids, 3)
+	assert.NoError(t, err)
+
+	offer, err := bobsRoute.MarshalOffer()
+	assert.NoError(t, err)
+	rb, err := UnmarshalOffer(offer)
+	assert.NoError(t, err)
+
+	rb, err = setupAlicesRoute(rb, dht, ids, 2)
+	assert.NoError(t, err)
+	msg := []byte("Hi Bob")
+	rp := rb.Send(msg)
+
+	// the RouteMsg is marshaled between each hop
+	d := &Delivery{
+		Forward: true,
+		Next:    rp.Next,
+	}
+	for d.Forward {
+		rm, err := UnmarshalRouteMsg(rp.RouteMsg.Marshal())
+		if !assert.NoError(t, err) {
+			return
+		}
+		rp = &RoutePackage{
+			RouteMsg: rm,
+		}
+		d, err = dht[encode(d.Next)].Deliver(rp)
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+	assert.Equal(t, msg, d.Msg)
+
+	// receive routes and bad offers are rejected
+	_, err = dht[bob].NewReceiveRoute().MarshalOffer()
+	assert.Equal(t, ErrBadOffer{}, err)
+	_, err = UnmarshalOffer(offer[:len(offer)-1])
+	assert.Equal(t, ErrBadOffer{}, err)
+	_, err = UnmarshalRouteMsg([]byte{0, 0, 1, 0})
+	assert.Equal(t, ErrBadRouteMsg{}, err)
+}
@@ -1,52 +1,82 @@
 package onion
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/binary"
 	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/docs/mixnetrouting/pow"
+	"time"
 )
 
 const (
-	// IDLen in bytes  just for demo
-	IDLen = 10
-	// BoxIDLen is the byte length of the secret box containing the next ID
-	BoxIDLen = crypto.Overhead + IDLen + 1
 	// RemoveEncryption indicates that during routing a layer of encryption shoud
 	// be removed
 	RemoveEncryption byte = 0
 	// AddEncryption indicates that during routing a layer of encryption shoud be
 	// added
 	AddEncryption byte = 1
-	// PacketLength is the total length of a Map package
-	PacketLength = crypto.KeyLength + crypto.NonceLength + BoxIDLen
+	// Hold is set with the direction to indicate a low-urgency hop across a
+	// bridge. The node may hold the message until it has other traffic for the
+	// next node.
+	Hold byte = 2
+	// MaxHops is the number of packets in every Route Map. Shorter maps are
+	// padded so that the number of hops cannot be seen.
+	MaxHops = 8
 )
 
 var encode = base64.URLEncoding.EncodeToString
 
-// PrivNode is not shared
+// PrivNode is not shared. If OnMessage is set, it is called by Deliver for
+// every message delivered to the node. If Blacklist is set, Route refuses to
+// forward to a blocked node. Grace is how long the previous key is kept after
+// Rotate. StampWork is the proof-of-work Route requires in the stamp of each
+// map packet; it is advertised in the PubNode. Now is the clock used for key
+// expiry and can be replaced for testing. MaxSeen limits the ephemeral keys
+// Route remembers each epoch.
 type PrivNode struct {
-	ID    []byte
-	Key   *crypto.XchgPair
-	Cache map[string]KeySet
-	Count map[crypto.Nonce]byte
+	ID         []byte
+	Key        *crypto.XchgPair
+	SigningKey ed25519.PrivateKey
+	Work       uint64
+	StampWork  int
+	Cache      map[string]KeySet
+	Count      map[crypto.Nonce]byte
+	OnMessage  func(*Delivery)
+	Blacklist  Blacklist
+	Grace      time.Duration
+	Now        func() time.Time
+	MaxSeen    int
+	old        []*oldKey
+	epochs     map[uint32]*epochKey
+	seen       map[string]*crypto.Symmetric
+	seenEpoch  uint32
+}
+
+// Blacklist is a set of nodes that messages will not be forwarded to. It is
+// satisfied by the blacklist package and by path.Blacklist.
+type Blacklist interface {
+	Blocked(id string) bool
 }
 
 // NewPrivNode creates a PrivateNode with the ID set to the head of the digest
-// of the public exchange key.
+// of the public exchange key by NodeID and Work set to a proof-of-work for the
+// ID at nodeid.Work, so its PubNode will Verify.
 func NewPrivNode() *PrivNode {
-	id := make([]byte, IDLen)
-	key := crypto.GenerateXchgPair()
-	dig := crypto.DigestFromSlice(key.Pub().Slice())
-	copy(id, dig.Slice())
+	id, key, signingKey, work := newIdentity()
 	return &PrivNode{
-		ID:    id,
-		Key:   key,
-		Count: make(map[crypto.Nonce]byte),
+		ID:         id,
+		Key:        key,
+		SigningKey: signingKey,
+		Work:       work,
+		Count:      make(map[crypto.Nonce]byte),
+		Grace:      DefaultGrace,
+		Now:        time.Now,
+		MaxSeen:    DefaultMaxSeen,
 	}
 }
 
-var zeroID = encode(make([]byte, IDLen))
-
 // ShouldContinue returns false if the next address is Zero or in the cache
 func (n *PrivNode) ShouldContinue(next []byte) bool {
 	s := encode(next)
@@ -63,13 +93,78 @@ func (n *PrivNode) ShouldContinue(next []byte) bool {
 // Open a route package. Uses the KeySet if there is one in the cache, otherwise
 // uses the nodes exchange key.
 func (n *PrivNode) Open(routePackage *RoutePackage) ([]byte, error) {
+	n.Erase()
+	if routePackage == nil || routePackage.RouteMsg == nil {
+		return nil, ErrBadMap{}
+	}
 	if n.Cache != nil {
 		ks, ok := n.Cache[encode(routePackage.Next)]
 		if ok {
 			return routePackage.Open(ks)
 		}
 	}
-	return n.Key.AnonOpen(routePackage.Data)
+	msg, err := n.Key.AnonOpen(routePackage.Data)
+	if err != nil {
+		for _, o := range n.old {
+			if msg, err = o.Key.AnonOpen(routePackage.Data); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unpad(msg)
+}
+
+// Delivery is the result of Deliver. If Forward is true, the package was routed
+// and the RouteMsg must be sent on to Next. Otherwise the message was delivered
+// to this node; RouteID is the receive route it arrived on or empty if it was
+// sent directly to the node's exchange key.
+type Delivery struct {
+	Forward bool
+	Next    []byte
+	RouteID string
+	Msg     []byte
+	Arrived time.Time
+	// Size is the length of the data as it was received
+	Size int
+	// Hold is true if the forward is low-urgency and may be held
+	Hold bool
+}
+
+// Deliver handles an incoming RoutePackage. It routes the package and if the
+// next ID is zero or one of the node's cached receive routes, the message is
+// opened and delivered. Otherwise the Delivery is a forward instruction.
+func (n *PrivNode) Deliver(rp *RoutePackage) (*Delivery, error) {
+	if err := rp.check(); err != nil {
+		return nil, err
+	}
+	d := &Delivery{
+		Arrived: n.Now(),
+		Size:    len(rp.Data),
+	}
+	if err := n.Route(rp); err != nil {
+		return nil, err
+	}
+	if n.ShouldContinue(rp.Next) {
+		d.Forward = true
+		d.Next = rp.Next
+		d.Hold = rp.Hold
+		return d, nil
+	}
+	if encode(rp.Next) != zeroID {
+		d.RouteID = encode(rp.Next)
+	}
+	msg, err := n.Open(rp)
+	if err != nil {
+		return nil, err
+	}
+	d.Msg = msg
+	if n.OnMessage != nil {
+		n.OnMessage(d)
+	}
+	return d, nil
 }
 
 // String is used to generate map keys
@@ -77,18 +172,32 @@ func (n *PrivNode) String() string {
 	return encode(n.ID)
 }
 
-// PubNode represents the data that a Private node would publish to the network
+// PubNode represents the data that a Private node would publish to the network.
+// Epochs are the epoch keys the node advertises, in order. Sig is the node's
+// signature over everything else, so the epoch keys and StampWork cannot be
+// changed by whoever relays the PubNode.
 type PubNode struct {
-	ID  []byte
-	Key *crypto.XchgPub
+	ID         []byte
+	Key        *crypto.XchgPub
+	SigningKey ed25519.PublicKey
+	Work       uint64
+	StampWork  int
+	Epochs     []EpochKey
+	Sig        []byte
 }
 
-// Pub returns the PubNode of a Private node
+// Pub returns the PubNode of a Private node, signed by its SigningKey
 func (n *PrivNode) Pub() *PubNode {
-	return &PubNode{
-		ID:  n.ID,
-		Key: n.Key.Pub(),
+	pub := &PubNode{
+		ID:         n.ID,
+		Key:        n.Key.Pub(),
+		SigningKey: n.SigningKey.Public().(ed25519.PublicKey),
+		Work:       n.Work,
+		StampWork:  n.StampWork,
+		Epochs:     pubEpochs(n.epochs),
 	}
+	pub.Sig = ed25519.Sign(n.SigningKey, pub.body())
+	return pub
 }
 
 // String is used to generate map keys
@@ -96,6 +205,54 @@ func (n *PubNode) String() string {
 	return encode(n.ID)
 }
 
+// ErrBadPubNode is returned when unmarshaling a PubNode from a slice of the
+// wrong length.
+type ErrBadPubNode struct{}
+
+func (ErrBadPubNode) Error() string {
+	return "PubNode must be ID | Key | SigningKey | Work | StampWork | Epochs | Sig"
+}
+
+// Marshal a PubNode so that it can be published as
+// ID | Key | SigningKey | Work | StampWork | Epochs | Sig
+// with 1 byte for StampWork.
+func (n *PubNode) Marshal() []byte {
+	return append(n.body(), n.Sig...)
+}
+
+// body marshals everything but the signature
+func (n *PubNode) body() []byte {
+	b := make([]byte, 0, pubNodeLen()+len(n.Epochs)*epochKeyLen+ed25519.SignatureSize)
+	b = append(append(b, n.ID...), n.Key.Slice()...)
+	b = append(b, n.SigningKey...)
+	b = append(b, pow.Marshal(n.Work)...)
+	b = append(b, byte(n.StampWork))
+	return marshalEpochs(b, n.Epochs)
+}
+
+// UnmarshalPubNode reverses PubNode.Marshal
+func UnmarshalPubNode(b []byte) (*PubNode, error) {
+	ln := pubNodeLen()
+	if len(b) < ln+ed25519.SignatureSize {
+		return nil, ErrBadPubNode{}
+	}
+	sig := len(b) - ed25519.SignatureSize
+	es, ok := unmarshalEpochs(b[ln:sig])
+	if !ok || pow.Validate(int(b[ln-1])) != nil {
+		return nil, ErrBadPubNode{}
+	}
+	sk := IDLen + crypto.KeyLength
+	return &PubNode{
+		ID:         append([]byte(nil), b[:IDLen]...),
+		Key:        crypto.XchgPubFromSlice(b[IDLen : IDLen+crypto.KeyLength]),
+		SigningKey: append(ed25519.PublicKey(nil), b[sk:sk+ed25519.PublicKeySize]...),
+		Work:       pow.Unmarshal(b[sk+ed25519.PublicKeySize:]),
+		StampWork:  int(b[ln-1]),
+		Epochs:     es,
+		Sig:        append([]byte(nil), b[sig:]...),
+	}, nil
+}
+
 // KN is used to store key/nonce pairs
 type KN struct {
 	Key   *crypto.Symmetric
@@ -141,7 +298,12 @@ type KeySet struct {
 }
 
 // Open removes onion layers from the receive route and applies the base key.
+// Each layer removes a packet from the Map, so it must hold at least one packet
+// per layer.
 func (rp *RoutePackage) Open(ks KeySet) ([]byte, error) {
+	if rp == nil || rp.RouteMsg == nil || len(rp.Map) < len(ks.KNs)*PacketLength || ks.BaseKey == nil {
+		return nil, ErrBadMap{}
+	}
 	for _, kn := range ks.KNs {
 		err := kn.SealPackets(rp.Map)
 		if err != nil {
@@ -153,35 +315,63 @@ func (rp *RoutePackage) Open(ks KeySet) ([]byte, error) {
 
 		rp.Data = kn.Key.UnmacdOpen(rp.Data, nonce)
 	}
-	return ks.BaseKey.AnonOpen(rp.Data)
+	msg, err := ks.BaseKey.AnonOpen(rp.Data)
+	if err != nil {
+		return nil, err
+	}
+	return unpad(msg)
 }
 
-// RouteBuilder is used when constructing a route
+// RouteBuilder is used when constructing a route. MaxStampWork is the most
+// stamp work the builder will do for a hop; a node that advertises more is
+// refused by Push. Now is the clock Push uses to choose a node's epoch key and
+// can be replaced for testing.
 type RouteBuilder struct {
-	Next     []byte
-	Data     []byte
-	KNs      []KN
-	ID       string
-	SendMode bool
-	BaseKey  *crypto.XchgPub
+	Next         []byte
+	Data         []byte
+	KNs          []KN
+	ID           string
+	SendMode     bool
+	BaseKey      *crypto.XchgPub
+	MaxStampWork int
+	Now          func() time.Time
+	hops         [][]byte
 }
 
 // NewSendRoute creates a RouteBuilder for direct sending
 func NewSendRoute() *RouteBuilder {
 	return &RouteBuilder{
-		Next:     make([]byte, IDLen),
-		SendMode: true,
+		Next:         make([]byte, IDLen),
+		SendMode:     true,
+		MaxStampWork: DefaultMaxStampWork,
+		Now:          time.Now,
 	}
 }
 
+// NewDirectRoute creates a route that leads straight to a known peer, for peers
+// that do not need to hide their locations from each other. The message is
+// sealed to the peer's exchange key and the peer is the only hop, so on the
+// wire the package looks the same as routed traffic. A single relay may be
+// pushed in front of the peer.
+func NewDirectRoute(peer *PubNode) (*RouteBuilder, error) {
+	rb := NewSendRoute()
+	rb.BaseKey = peer.Key
+	if err := rb.Push(peer); err != nil {
+		return nil, err
+	}
+	return rb, nil
+}
+
 // NewReceiveRoute creates a RouteBuilder for creating a receive route
 func (n *PrivNode) NewReceiveRoute() *RouteBuilder {
 	id := make([]byte, IDLen)
 	rand.Read(id)
 	rb := &RouteBuilder{
-		ID:       encode(id),
-		SendMode: false,
-		Next:     id,
+		ID:           encode(id),
+		SendMode:     false,
+		Next:         id,
+		MaxStampWork: DefaultMaxStampWork,
+		Now:          n.Now,
 	}
 	rb.Push(n.Pub())
 	return rb
@@ -203,10 +393,61 @@ func (rb *RouteBuilder) Receive() (string, KeySet) {
 	return id, ks
 }
 
-// Push a Node onto the route.
+// Copy returns a RouteBuilder that can be pushed to without changing rb. This
+// allows the same receive route to be offered more than once.
+func (rb *RouteBuilder) Copy() *RouteBuilder {
+	cp := *rb
+	cp.Next = append([]byte(nil), rb.Next...)
+	cp.Data = append([]byte(nil), rb.Data...)
+	cp.KNs = append([]KN(nil), rb.KNs...)
+	cp.hops = append([][]byte(nil), rb.hops...)
+	return &cp
+}
+
+// Hops returns the IDs of the nodes pushed onto the route by this
+// RouteBuilder. They are not marshaled, so a route received as an offer has no
+// Hops.
+func (rb *RouteBuilder) Hops() [][]byte {
+	return append([][]byte(nil), rb.hops...)
+}
+
+// Push a Node onto the route. The PubNode must Verify and its StampWork must
+// not be more than MaxStampWork.
 func (rb *RouteBuilder) Push(n *PubNode) error {
-	// EX | Nonce | Enc(ES, Next|Dir ) | EncUnMAC( R )
+	return rb.push(n, 0)
+}
+
+// PushBridge pushes the two ends of a bridge onto the route so that the
+// message crosses from a to b. The hop is low-urgency, so a may hold the
+// message until it has other traffic for b.
+func (rb *RouteBuilder) PushBridge(a, b *PubNode) error {
+	if err := rb.push(b, 0); err != nil {
+		return err
+	}
+	return rb.push(a, Hold)
+}
+
+// ErrTooManyHops is returned when pushing more than MaxHops nodes onto a route
+type ErrTooManyHops struct{}
+
+func (ErrTooManyHops) Error() string {
+	return "Route cannot have more than MaxHops hops"
+}
+
+func (rb *RouteBuilder) push(n *PubNode, flags byte) error {
+	if err := n.Verify(); err != nil {
+		return err
+	}
+	if n.StampWork > rb.MaxStampWork {
+		return ErrStampTooHard{}
+	}
+	if len(rb.Data) > (MaxHops-1)*PacketLength {
+		return ErrTooManyHops{}
+	}
+	// EX | Tag | Stamp | Nonce | Enc(ES, Next|Dir ) | EncUnMAC( R )
 	// EX   : ephemeral exchange key
+	// Tag  : the epoch of the node's key, 0 for the node's static key
+	// Stamp: proof-of-work over EX | ID | Nonce at the node's StampWork
 	// Nonce: Makes process non-deterministic. Same nonce is used for all 3
 	//        cryptographic operations.
 	// ES   : shared key computed from ephemeral exchange key
@@ -214,9 +455,10 @@ func (rb *RouteBuilder) Push(n *PubNode) error {
 	// Dir  : the encryption direction
 	// R    : the rest of the route
 
+	epoch, key := n.pushKey(rb.Now())
 	kp := crypto.GenerateXchgPair()
 	kn := KN{
-		Key:   kp.Shared(n.Key),
+		Key:   kp.Shared(key),
 		Nonce: crypto.RandomNonce(),
 	}
 
@@ -227,6 +469,7 @@ func (rb *RouteBuilder) Push(n *PubNode) error {
 	} else {
 		nd[0] = AddEncryption
 	}
+	nd[0] |= flags
 	copy(nd[1:], rb.Next)
 
 	err := kn.SealPackets(rb.Data)
@@ -234,9 +477,12 @@ func (rb *RouteBuilder) Push(n *PubNode) error {
 		return err
 	}
 	rb.Data = append(kn.Key.Seal(nd, kn.Nonce), rb.Data...)
+	rb.Data = append(stamp(kp.Pub(), n.ID, kn.Nonce, n.StampWork), rb.Data...)
+	rb.Data = append(epochTag(epoch), rb.Data...)
 	rb.Data = append(kp.Pub().Slice(), rb.Data...)
 	rb.Next = n.ID
 	rb.KNs = append(rb.KNs, kn)
+	rb.hops = append(rb.hops, n.ID)
 	return nil
 }
 
@@ -246,25 +492,29 @@ type RouteMsg struct {
 	Data []byte
 }
 
-// RoutePackage represents a message in the process of being routed.
+// RoutePackage represents a message in the process of being routed. Hold is
+// set by Route if the hop to Next is low-urgency.
 type RoutePackage struct {
 	*RouteMsg
 	Next []byte
 	KN   KN
+	Hold bool
 }
 
 // Send finishes the route building process and uses the route to construct a
-// RoutePackage
+// RoutePackage. The map is padded with random bytes to MaxHops packets and if
+// the message is sealed to a BaseKey, it is first padded to a size class.
 func (rb *RouteBuilder) Send(msg []byte) *RoutePackage {
 	if rb.BaseKey != nil {
-		msg = rb.BaseKey.AnonSeal(msg)
+		msg = rb.BaseKey.AnonSeal(pad(msg))
 	}
 	for _, kn := range rb.KNs {
 		msg = kn.Key.UnmacdSeal(msg, kn.Nonce)
 	}
 
-	cp := make([]byte, len(rb.Data))
+	cp := make([]byte, MaxHops*PacketLength)
 	copy(cp, rb.Data)
+	rand.Read(cp[len(rb.Data):])
 
 	return &RoutePackage{
 		RouteMsg: &RouteMsg{
@@ -275,36 +525,94 @@ func (rb *RouteBuilder) Send(msg []byte) *RoutePackage {
 	}
 }
 
-// ErrReplay is returned if a send route is reused
+// ErrReplay is returned if a send route packet is reused
 type ErrReplay struct{}
 
 func (ErrReplay) Error() string {
 	return "Route has exhausted it's replay count"
 }
 
+// ErrBlocked is returned by Route when the next node is on the Blacklist
+type ErrBlocked struct{}
+
+func (ErrBlocked) Error() string {
+	return "Next node is blacklisted"
+}
+
+// ErrBadMap is returned when a RoutePackage is missing its RouteMsg or the Map
+// is not a whole number of packets
+type ErrBadMap struct{}
+
+func (ErrBadMap) Error() string {
+	return "Map must be a whole number of packets"
+}
+
+// check that a RoutePackage can be routed: the Map must hold at least one
+// packet and be a whole number of packets.
+func (r *RoutePackage) check() error {
+	if r == nil || r.RouteMsg == nil || len(r.Map) < PacketLength || len(r.Map)%PacketLength != 0 {
+		return ErrBadMap{}
+	}
+	return nil
+}
+
 // Route a package. The package will be mutated so that it contains the correct
-// Next ID and the RouteMsg to be sent.
+// Next ID and the RouteMsg to be sent. The stamp is checked against StampWork
+// before any public key work and ErrBadStamp is returned if it falls short. A
+// send route packet whose ephemeral key was already seen in the current epoch
+// is refused with ErrReplay before the key exchange, and a repeated receive
+// route packet reuses the shared key. A malformed package returns ErrBadMap and
+// is not mutated.
 func (n *PrivNode) Route(r *RoutePackage) error {
+	n.Erase()
+	if err := r.check(); err != nil {
+		return err
+	}
 	var kn KN
 	m := r.Map
-	kn.Key = n.Key.Shared(crypto.XchgPubFromSlice(m[:crypto.KeyLength]))
+	ex := crypto.XchgPubFromSlice(m[:crypto.KeyLength])
 
 	m = m[crypto.KeyLength:]
+	epoch := binary.BigEndian.Uint32(m)
+
+	m = m[EpochTagLen:]
+	s := m[:StampLen]
+
+	m = m[StampLen:]
 	kn.Nonce = crypto.ExtractNonce(m)
 	if kn.Nonce == nil {
 		return crypto.ErrDecryptionFailed
 	}
+	if !n.checkStamp(ex.Slice(), s, kn.Nonce.Slice()) {
+		return ErrBadStamp{}
+	}
 
 	m = m[crypto.NonceLength:]
-	nd, err := kn.Key.NonceOpen(m[:BoxIDLen], kn.Nonce)
-	if err != nil || len(nd) == 0 {
+	var nd []byte
+	var count map[crypto.Nonce]byte
+	var err error
+	key, seen := n.seenKey(ex)
+	if seen && key == nil {
+		return ErrReplay{}
+	} else if seen {
+		kn.Key = key
+		nd, err = key.NonceOpen(m[:BoxIDLen], kn.Nonce)
+	} else {
+		kn.Key, nd, count, err = n.openPacket(ex, epoch, m[:BoxIDLen], kn.Nonce)
+	}
+	if err != nil || len(nd) != IDLen+1 {
 		return crypto.ErrDecryptionFailed
 	}
 
 	m = m[BoxIDLen:]
 
+	if n.Blacklist != nil && n.Blacklist.Blocked(encode(nd[1:])) {
+		return ErrBlocked{}
+	}
 	r.Next = nd[1:]
-	if nd[0] == AddEncryption {
+	r.Hold = nd[0]&Hold == Hold
+	if nd[0]&^Hold == AddEncryption {
+		n.remember(ex, kn.Key)
 		mgsNonce := crypto.RandomNonce()
 		r.Data = kn.Key.UnmacdSeal(r.Data, mgsNonce)
 		copy(r.Map, m)
@@ -313,11 +621,12 @@ func (n *PrivNode) Route(r *RoutePackage) error {
 		rand.Read(r.Map[ln+crypto.NonceLength:])
 		err = kn.OpenPackets(r.Map)
 	} else {
-		if c, ok := n.Count[*kn.Nonce]; ok && c == 0 {
+		if c, ok := count[*kn.Nonce]; seen || (ok && c == 0) {
 			return ErrReplay{}
 		}
+		n.remember(ex, nil)
 		r.Data = kn.Key.UnmacdOpen(r.Data, kn.Nonce)
-		n.Count[*kn.Nonce] = 0
+		count[*kn.Nonce] = 0
 		err = kn.OpenPackets(m)
 		copy(r.Map, m)
 		rand.Read(r.Map[len(m):])
@@ -154,6 +154,45 @@ func TestAliceToBob(t *testing.T) {
 
 }
 
+func TestDeliver(t *testing.T) {
+	totalNodes := 50
+	dht, ids := setupDHT(totalNodes)
+	bob := ids[mr.Intn(totalNodes)]
+
+	bobsRoute, err := setupBobsRoute(bob, dht, ids, 3)
+	assert.NoError(t, err)
+	var routeID string
+	for id := range dht[bob].Cache {
+		routeID = id
+	}
+	var delivered *Delivery
+	dht[bob].OnMessage = func(d *Delivery) { delivered = d }
+
+	alicesRoute, err := setupAlicesRoute(bobsRoute, dht, ids, 3)
+	assert.NoError(t, err)
+	msg := []byte("Hi Bob, how was your vacation?")
+	rp := alicesRoute.Send(msg)
+
+	d := &Delivery{
+		Forward: true,
+		Next:    rp.Next,
+	}
+	for d.Forward {
+		rp = &RoutePackage{
+			RouteMsg: rp.RouteMsg,
+		}
+		d, err = dht[encode(d.Next)].Deliver(rp)
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	assert.Equal(t, routeID, d.RouteID)
+	assert.Equal(t, msg, d.Msg)
+	assert.Equal(t, d, delivered)
+	assert.False(t, d.Arrived.IsZero())
+}
+
 func setupBobsRoute(bob string, dht map[string]*PrivNode, ids []string, hops int) (*RouteBuilder, error) {
 	totalNodes := len(ids)
 	bobNode := dht[bob]
@@ -228,3 +267,48 @@ func TestReplay(t *testing.T) {
 		t.Error("Should be ErrReplay: ", err.Error())
 	}
 }
+
+func TestPushBridge(t *testing.T) {
+	dht, ids := setupDHT(10)
+	a, b, c := dht[ids[0]], dht[ids[1]], dht[ids[2]]
+
+	rb := NewSendRoute()
+	rb.BaseKey = c.Pub().Key
+	assert.NoError(t, rb.Push(c.Pub()))
+	assert.NoError(t, rb.PushBridge(a.Pub(), b.Pub()))
+	msg := []byte("across the bridge")
+	rp := rb.Send(msg)
+
+	// only the hop from a to b is low-urgency
+	for _, n := range []*PrivNode{a, b} {
+		d, err := n.Deliver(&RoutePackage{RouteMsg: rp.RouteMsg})
+		assert.NoError(t, err)
+		assert.True(t, d.Forward)
+		assert.Equal(t, n == a, d.Hold)
+	}
+	d, err := c.Deliver(&RoutePackage{RouteMsg: rp.RouteMsg})
+	assert.NoError(t, err)
+	assert.Equal(t, msg, d.Msg)
+}
+
+type blacklist map[string]bool
+
+func (bl blacklist) Blocked(id string) bool { return bl[id] }
+
+func TestBlacklist(t *testing.T) {
+	dht, ids := setupDHT(5)
+	a, b := dht[ids[0]], dht[ids[1]]
+	rb := NewSendRoute()
+	assert.NoError(t, rb.Push(b.Pub()))
+	assert.NoError(t, rb.Push(a.Pub()))
+	rp := rb.Send([]byte("test"))
+
+	a.Blacklist = blacklist{b.String(): true}
+	_, err := a.Deliver(&RoutePackage{RouteMsg: rp.RouteMsg})
+	assert.Equal(t, ErrBlocked{}, err)
+
+	a.Blacklist = blacklist{}
+	d, err := a.Deliver(&RoutePackage{RouteMsg: rp.RouteMsg})
+	assert.NoError(t, err)
+	assert.Equal(t, b.ID, d.Next)
+}
@@ -0,0 +1,39 @@
+package onion
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/docs/mixnetrouting/sizeclass"
+)
+
+// ErrBadPadding is returned when a message does not have valid padding
+type ErrBadPadding struct{}
+
+func (ErrBadPadding) Error() string {
+	return "Message padding is not valid"
+}
+
+// pad frames the message with its length and pads it with zeros to a size
+// class
+func pad(msg []byte) []byte {
+	out := make([]byte, sizeclass.Of(4+len(msg)))
+	binary.BigEndian.PutUint32(out, uint32(len(msg)))
+	copy(out[4:], msg)
+	return out
+}
+
+// unpad reverses pad
+func unpad(b []byte) ([]byte, error) {
+	if len(b) < 4 {
+		return nil, ErrBadPadding{}
+	}
+	ln := binary.BigEndian.Uint32(b)
+	if uint64(ln) > uint64(len(b)-4) {
+		return nil, ErrBadPadding{}
+	}
+	for _, c := range b[4+ln:] {
+		if c != 0 {
+			return nil, ErrBadPadding{}
+		}
+	}
+	return b[4 : 4+ln], nil
+}
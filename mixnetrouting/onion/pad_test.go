@@ -0,0 +1,73 @@
+package onion
+
+import (
+	"github.com/stretchr/testify/assert"
+	mr "math/rand"
+	"testing"
+)
+
+func TestPad(t *testing.T) {
+	msg := []byte("padded")
+	p := pad(msg)
+	assert.Len(t, p, 4096)
+	out, err := unpad(p)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, out)
+
+	p[len(p)-1] = 1
+	_, err = unpad(p)
+	assert.Equal(t, ErrBadPadding{}, err)
+	_, err = unpad([]byte{0, 0, 1, 0, 0})
+	assert.Equal(t, ErrBadPadding{}, err)
+}
+
+func TestDirectRoute(t *testing.T) {
+	dht, ids := setupDHT(20)
+	bob := dht[ids[0]]
+	relay := dht[ids[1]]
+	msg := []byte("Hi Bob, it's Alice. No need to hide.")
+
+	// a routed package for comparison
+	bobsRoute, err := setupBobsRoute(bob.String(), dht, ids[2:], 3)
+	assert.NoError(t, err)
+	routed, err := setupAlicesRoute(bobsRoute, dht, ids[2:], 3)
+	assert.NoError(t, err)
+	rrp := routed.Send(msg)
+
+	for relays := 0; relays < 2; relays++ {
+		rb, err := NewDirectRoute(bob.Pub())
+		assert.NoError(t, err)
+		if relays == 1 {
+			assert.NoError(t, rb.Push(relay.Pub()))
+		}
+		rp := rb.Send(msg)
+		assert.Len(t, rp.Map, len(rrp.Map))
+		assert.Len(t, rp.Data, len(rrp.Data))
+
+		d := &Delivery{
+			Forward: true,
+			Next:    rp.Next,
+		}
+		for d.Forward {
+			rp = &RoutePackage{
+				RouteMsg: rp.RouteMsg,
+			}
+			d, err = dht[encode(d.Next)].Deliver(rp)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Len(t, rp.Map, MaxHops*PacketLength)
+		}
+		assert.Equal(t, msg, d.Msg)
+		assert.Equal(t, "", d.RouteID)
+	}
+}
+
+func TestTooManyHops(t *testing.T) {
+	dht, ids := setupDHT(MaxHops + 1)
+	rb := NewSendRoute()
+	for i := 0; i < MaxHops; i++ {
+		assert.NoError(t, rb.Push(dht[ids[mr.Intn(len(ids))]].Pub()))
+	}
+	assert.Equal(t, ErrTooManyHops{}, rb.Push(dht[ids[0]].Pub()))
+}
@@ -0,0 +1,106 @@
+package onion
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"time"
+)
+
+// DefaultGrace is how long a key is kept after Rotate so that packets already
+// in flight can finish.
+const DefaultGrace = 2 * time.Minute
+
+// oldKey is a key that has been rotated out with its epoch keys. Count is its
+// replay cache.
+type oldKey struct {
+	ID     []byte
+	Key    *crypto.XchgPair
+	Count  map[crypto.Nonce]byte
+	Epochs map[uint32]*epochKey
+	Until  time.Time
+}
+
+// Rotate gives the node a new overlay identity. A new exchange key, signing key
+// and ID are generated, with proof-of-work at nodeid.Work, and the replay cache
+// starts empty. If the node has epoch keys, new keys are generated for the same
+// epochs. The old key is kept for Grace so that packets already in flight can
+// be routed, then it is erased along with its replay cache. Routes through the
+// old identity stop working once it is erased, so the node should publish its
+// new PubNode and rebuild its receive routes.
+func (n *PrivNode) Rotate() {
+	n.old = append(n.old, &oldKey{
+		ID:     n.ID,
+		Key:    n.Key,
+		Count:  n.Count,
+		Epochs: n.epochs,
+		Until:  n.Now().Add(n.Grace),
+	})
+	n.ID, n.Key, n.SigningKey, n.Work = newIdentity()
+	n.Count = make(map[crypto.Nonce]byte)
+	if n.epochs != nil {
+		epochs := make(map[uint32]*epochKey, len(n.epochs))
+		for e := range n.epochs {
+			epochs[e] = newEpochKey()
+		}
+		n.epochs = epochs
+	}
+	n.Erase()
+}
+
+// Erase the old keys whose grace period has ended at Now. Route and Open call
+// Erase first, so expired keys are never used and are erased as soon as the
+// node handles a message.
+func (n *PrivNode) Erase() {
+	if len(n.old) == 0 {
+		return
+	}
+	now := n.Now()
+	keep := n.old[:0]
+	for _, o := range n.old {
+		if now.Before(o.Until) {
+			keep = append(keep, o)
+			continue
+		}
+		zero(o.Key.Priv().Slice())
+		for _, k := range o.Epochs {
+			k.erase()
+		}
+		o.Key, o.Count, o.Epochs = nil, nil, nil
+		n.seen = nil
+	}
+	for i := len(keep); i < len(n.old); i++ {
+		n.old[i] = nil
+	}
+	n.old = keep
+}
+
+// OldKeys returns the number of keys being kept after Rotate
+func (n *PrivNode) OldKeys() int {
+	return len(n.old)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// openPacket opens the box in a map packet with the node's key for the epoch
+// or, if that fails, with a key kept after Rotate. The replay cache of the key
+// that opened the box is returned.
+func (n *PrivNode) openPacket(ex *crypto.XchgPub, epoch uint32, box []byte, nonce *crypto.Nonce) (*crypto.Symmetric, []byte, map[crypto.Nonce]byte, error) {
+	if key, count := keyFor(n.Key, n.Count, n.epochs, epoch); key != nil {
+		shared := key.Shared(ex)
+		if nd, err := shared.NonceOpen(box, nonce); err == nil {
+			return shared, nd, count, nil
+		}
+	}
+	for _, o := range n.old {
+		if key, count := keyFor(o.Key, o.Count, o.Epochs, epoch); key != nil {
+			shared := key.Shared(ex)
+			if nd, err := shared.NonceOpen(box, nonce); err == nil {
+				return shared, nd, count, nil
+			}
+		}
+	}
+	return nil, nil, nil, crypto.ErrDecryptionFailed
+}
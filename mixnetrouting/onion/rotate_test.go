@@ -0,0 +1,53 @@
+package onion
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRotate(t *testing.T) {
+	a, b := NewPrivNode(), NewPrivNode()
+	send := func(pub *PubNode) *RoutePackage {
+		rb := NewSendRoute()
+		assert.NoError(t, rb.Push(b.Pub()))
+		assert.NoError(t, rb.Push(pub))
+		return rb.Send([]byte("test"))
+	}
+	oldPub, oldKey := a.Pub(), a.Key
+	inFlight := send(oldPub)
+	replay := &RouteMsg{
+		Map:  append([]byte(nil), inFlight.Map...),
+		Data: append([]byte(nil), inFlight.Data...),
+	}
+	direct, err := NewDirectRoute(oldPub)
+	assert.NoError(t, err)
+	directRP := direct.Send([]byte("direct"))
+
+	a.Rotate()
+	assert.NotEqual(t, oldPub.ID, a.ID)
+	assert.NotEqual(t, oldPub.Key.Slice(), a.Key.Pub().Slice())
+	assert.Len(t, a.Count, 0)
+	assert.Equal(t, 1, a.OldKeys())
+
+	// packets in flight are routed with the old key and it keeps its replay
+	// cache
+	assert.NoError(t, a.Route(inFlight))
+	assert.Equal(t, b.ID, inFlight.Next)
+	assert.Equal(t, ErrReplay{}, a.Route(&RoutePackage{RouteMsg: replay}))
+	d, err := a.Deliver(directRP)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("direct"), d.Msg)
+
+	// the new identity works
+	assert.NoError(t, a.Route(send(a.Pub())))
+
+	// after the grace period the old key is erased by the next message, even
+	// if it does not need the old key
+	a.Now = func() time.Time { return time.Now().Add(a.Grace) }
+	assert.NoError(t, a.Route(send(a.Pub())))
+	assert.Equal(t, 0, a.OldKeys())
+	assert.Equal(t, make([]byte, crypto.KeyLength), oldKey.Priv().Slice())
+	assert.Equal(t, crypto.ErrDecryptionFailed, a.Route(send(oldPub)))
+}
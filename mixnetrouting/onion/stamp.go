@@ -0,0 +1,59 @@
+package onion
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/docs/mixnetrouting/pow"
+)
+
+// StampLen is the byte length of the stamp in a map packet. A stamp is a
+// proof-of-work over the packet's ephemeral key, the ID of the node it is for
+// and the packet's nonce, so it cannot be moved to a packet for another node. A
+// node with StampWork set checks the stamp before doing any public key work, so
+// sending it garbage maps costs about 2^StampWork digests per packet.
+const StampLen = pow.NonceLen
+
+// DefaultMaxStampWork is the MaxStampWork of a new RouteBuilder, about 2^24
+// digests for a stamp.
+const DefaultMaxStampWork = 24
+
+// ErrStampTooHard is returned by Push when a node requires more stamp work than
+// the RouteBuilder's MaxStampWork
+type ErrStampTooHard struct{}
+
+func (ErrStampTooHard) Error() string {
+	return "Node requires more stamp work than MaxStampWork"
+}
+
+// ErrBadStamp is returned by Route when the stamp in a map packet is not a
+// proof-of-work for the packet at the node's StampWork
+type ErrBadStamp struct{}
+
+func (ErrBadStamp) Error() string {
+	return "Map packet stamp does not have enough proof-of-work"
+}
+
+// stampData is what a stamp is a proof-of-work over: EX | ID | Nonce
+func stampData(ex, id, nonce []byte) []byte {
+	b := make([]byte, 0, len(ex)+len(id)+len(nonce))
+	return append(append(append(b, ex...), id...), nonce...)
+}
+
+// stamp finds a proof-of-work for a map packet to the node with the given ID
+func stamp(ex *crypto.XchgPub, id []byte, nonce *crypto.Nonce, bits int) []byte {
+	return pow.Marshal(pow.Solve(stampData(ex.Slice(), id, nonce.Slice()), bits))
+}
+
+// checkStamp costs a single digest for the node's ID and one for each old ID
+// still in its grace period
+func (n *PrivNode) checkStamp(ex, stamp, nonce []byte) bool {
+	s := pow.Unmarshal(stamp)
+	if pow.Check(stampData(ex, n.ID, nonce), s, n.StampWork) {
+		return true
+	}
+	for _, o := range n.old {
+		if pow.Check(stampData(ex, o.ID, nonce), s, n.StampWork) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package onion
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/docs/mixnetrouting/pow"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStamp(t *testing.T) {
+	a, b := NewPrivNode(), NewPrivNode()
+	b.StampWork = 8
+	pub := b.Pub()
+	assert.Equal(t, 8, pub.StampWork)
+	got, err := UnmarshalPubNode(pub.Marshal())
+	assert.NoError(t, err)
+	assert.Equal(t, 8, got.StampWork)
+
+	send := func() *RoutePackage {
+		rb := NewSendRoute()
+		assert.NoError(t, rb.Push(a.Pub()))
+		assert.NoError(t, rb.Push(pub))
+		return rb.Send([]byte("test"))
+	}
+	rp := send()
+	assert.NoError(t, b.Route(rp))
+	assert.Equal(t, a.ID, rp.Next)
+
+	// a stamp without enough work is rejected before the key exchange
+	rp = send()
+	ex := rp.Map[:crypto.KeyLength]
+	s := rp.Map[crypto.KeyLength+EpochTagLen : crypto.KeyLength+EpochTagLen+StampLen]
+	nonce := rp.Map[crypto.KeyLength+EpochTagLen+StampLen : PacketLength-BoxIDLen]
+	for v := uint64(0); b.checkStamp(ex, s, nonce); v++ {
+		copy(s, pow.Marshal(v))
+	}
+	assert.Equal(t, ErrBadStamp{}, b.Route(rp))
+
+	// an ephemeral key seen this epoch is refused before the key exchange, even
+	// without the nonce in the replay cache
+	rp = send()
+	replay := &RoutePackage{RouteMsg: &RouteMsg{
+		Map:  append([]byte(nil), rp.Map...),
+		Data: append([]byte(nil), rp.Data...),
+	}}
+	assert.NoError(t, b.Route(rp))
+	b.Count = make(map[crypto.Nonce]byte)
+	assert.Equal(t, ErrReplay{}, b.Route(replay))
+
+	// once MaxSeen keys are remembered the nonce still refuses a replay
+	b.MaxSeen = len(b.seen)
+	rp = send()
+	replay = &RoutePackage{RouteMsg: &RouteMsg{
+		Map:  append([]byte(nil), rp.Map...),
+		Data: append([]byte(nil), rp.Data...),
+	}}
+	assert.NoError(t, b.Route(rp))
+	assert.Len(t, b.seen, b.MaxSeen)
+	assert.Equal(t, ErrReplay{}, b.Route(replay))
+
+	// StampWork is checked when the PubNode is accepted
+	pub.StampWork = pow.MaxBits + 1
+	assert.Equal(t, pow.ErrBadDifficulty, pub.Verify())
+	assert.Equal(t, pow.ErrBadDifficulty, NewSendRoute().Push(pub))
+	b.StampWork = pow.MaxBits + 1
+	_, err = UnmarshalPubNode(b.Pub().Marshal())
+	assert.Equal(t, ErrBadPubNode{}, err)
+
+	// the sender refuses more stamp work than its MaxStampWork
+	b.StampWork = pow.MaxBits
+	assert.Equal(t, ErrStampTooHard{}, NewSendRoute().Push(b.Pub()))
+	b.StampWork = 9
+	rb := NewSendRoute()
+	rb.MaxStampWork = 8
+	assert.Equal(t, ErrStampTooHard{}, rb.Push(b.Pub()))
+	assert.Len(t, rb.Hops(), 0)
+	rb.MaxStampWork = 9
+	assert.NoError(t, rb.Push(b.Pub()))
+
+	// and only takes StampWork signed by the node
+	pub = b.Pub()
+	pub.StampWork = 8
+	assert.Equal(t, ErrBadNodeSig{}, NewSendRoute().Push(pub))
+}
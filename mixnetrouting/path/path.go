@@ -0,0 +1,309 @@
+package path
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/dist-ribut-us/docs/mixnetrouting/cyclic"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/dist-ribut-us/errors"
+	"time"
+)
+
+const (
+	// ErrNotEnoughNodes is returned when the directory does not have enough
+	// nodes that satisfy the constraints.
+	ErrNotEnoughNodes errors.String = "Not enough nodes satisfy the constraints"
+	// ErrWrongScheme is returned when a node in the directory does not belong
+	// to the scheme of the route being built.
+	ErrWrongScheme errors.String = "Node does not match the route scheme"
+)
+
+var encode = base64.URLEncoding.EncodeToString
+
+// PubNode is satisfied by both onion.PubNode and cyclic.PubNode
+type PubNode interface {
+	String() string
+}
+
+// Verifier is satisfied by a signed node descriptor. Verify returns an error
+// if the descriptor is expired, forged or inconsistent at the given time.
+type Verifier interface {
+	Verify(now time.Time) error
+}
+
+// Node is an entry in the directory. Capacity is the capacity the node
+// advertises and Reliability is the measured fraction of messages it has
+// routed successfully. Descriptor is the signed descriptor the node was
+// published with, if any.
+type Node struct {
+	Pub         PubNode
+	Capacity    float64
+	Reliability float64
+	Descriptor  Verifier
+}
+
+// ID of the node, the same string used by the onion and cyclic packages.
+func (n *Node) ID() string { return n.Pub.String() }
+
+// Directory holds the nodes available for routing
+type Directory []*Node
+
+// Selection is the state of one half of a route while it is being selected. It
+// holds the hops chosen so far and the IDs that belong to the other half of the
+// route.
+type Selection struct {
+	Hops  []*Node
+	other map[string]bool
+}
+
+// NewSelection creates a Selection that avoids the hops in other selections.
+func NewSelection(other ...*Selection) *Selection {
+	s := &Selection{
+		other: make(map[string]bool),
+	}
+	for _, o := range other {
+		for _, n := range o.Hops {
+			s.other[n.ID()] = true
+		}
+	}
+	return s
+}
+
+// Avoid adds IDs to the other half of the route.
+func (s *Selection) Avoid(ids ...string) {
+	for _, id := range ids {
+		s.other[id] = true
+	}
+}
+
+// Has returns true if the ID has been selected as a hop
+func (s *Selection) Has(id string) bool {
+	for _, n := range s.Hops {
+		if n.ID() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// InOther returns true if the ID is in the other half of the route
+func (s *Selection) InOther(id string) bool {
+	return s.other[id]
+}
+
+// Constraint decides if a node may be added to a selection
+type Constraint interface {
+	Allow(n *Node, s *Selection) bool
+}
+
+// ConstraintFunc allows a function to be used as a Constraint
+type ConstraintFunc func(n *Node, s *Selection) bool
+
+// Allow calls the function
+func (fn ConstraintFunc) Allow(n *Node, s *Selection) bool { return fn(n, s) }
+
+var (
+	// Distinct prevents a node from being used more than once in a selection
+	Distinct Constraint = ConstraintFunc(func(n *Node, s *Selection) bool {
+		return !s.Has(n.ID())
+	})
+	// Disjoint prevents a node from being used if it is in the other half of
+	// the route
+	Disjoint Constraint = ConstraintFunc(func(n *Node, s *Selection) bool {
+		return !s.InOther(n.ID())
+	})
+)
+
+// Exclude creates a Constraint that never allows the IDs
+func Exclude(ids ...string) Constraint {
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return ConstraintFunc(func(n *Node, s *Selection) bool {
+		return !set[n.ID()]
+	})
+}
+
+// Blacklist is a set of nodes that should not be used
+type Blacklist interface {
+	Blocked(id string) bool
+}
+
+// Blacklisted creates a Constraint that does not allow nodes in the Blacklist
+func Blacklisted(bl Blacklist) Constraint {
+	return ConstraintFunc(func(n *Node, s *Selection) bool {
+		return !bl.Blocked(n.ID())
+	})
+}
+
+// Verified creates a Constraint that only allows nodes with a Descriptor that
+// verifies at the time returned by now.
+func Verified(now func() time.Time) Constraint {
+	return ConstraintFunc(func(n *Node, s *Selection) bool {
+		return n.Descriptor != nil && n.Descriptor.Verify(now()) == nil
+	})
+}
+
+// Weight returns the relative chance of choosing a node. A node with a weight
+// of zero or less is never chosen.
+type Weight func(n *Node) float64
+
+var (
+	// Uniform gives every node the same chance of being chosen
+	Uniform Weight = func(*Node) float64 { return 1 }
+	// ByCapacity weights nodes by their advertised capacity
+	ByCapacity Weight = func(n *Node) float64 { return n.Capacity }
+	// ByReliability weights nodes by their measured reliability
+	ByReliability Weight = func(n *Node) float64 { return n.Reliability }
+)
+
+// Selector chooses hops. Rand returns a random value in [0,1), by default it
+// uses crypto/rand so that the choice cannot be predicted.
+type Selector struct {
+	Constraints []Constraint
+	Weight      Weight
+	Rand        func() float64
+}
+
+// NewSelector creates a Selector with the Distinct and Disjoint constraints,
+// any additional constraints and Uniform weighting.
+func NewSelector(constraints ...Constraint) *Selector {
+	return &Selector{
+		Constraints: append([]Constraint{Distinct, Disjoint}, constraints...),
+		Weight:      Uniform,
+		Rand:        cryptoFloat,
+	}
+}
+
+func cryptoFloat() float64 {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return float64(binary.BigEndian.Uint64(b)>>11) / (1 << 53)
+}
+
+func (s *Selector) allow(n *Node, sel *Selection) bool {
+	for _, c := range s.Constraints {
+		if !c.Allow(n, sel) {
+			return false
+		}
+	}
+	return true
+}
+
+// Select adds hops to the Selection. Constraints are checked against the
+// selection as it grows, so each hop is chosen knowing the ones before it. The
+// hops are only added if all of them can be chosen.
+func (s *Selector) Select(dir Directory, hops int, sel *Selection) error {
+	grow := &Selection{
+		Hops:  append([]*Node(nil), sel.Hops...),
+		other: sel.other,
+	}
+	weights := make([]float64, len(dir))
+	for i := 0; i < hops; i++ {
+		var total float64
+		for j, n := range dir {
+			weights[j] = 0
+			if s.allow(n, grow) {
+				if w := s.Weight(n); w > 0 {
+					weights[j] = w
+					total += w
+				}
+			}
+		}
+		if total == 0 {
+			return ErrNotEnoughNodes
+		}
+		r := s.Rand() * total
+		chosen := -1
+		for j, w := range weights {
+			if w == 0 {
+				continue
+			}
+			chosen = j
+			if r < w {
+				break
+			}
+			r -= w
+		}
+		grow.Hops = append(grow.Hops, dir[chosen])
+	}
+	sel.Hops = grow.Hops
+	return nil
+}
+
+// avoidRoute adds the node a route leads to and every node already pushed onto
+// it to the other half of the Selection.
+func (sel *Selection) avoidRoute(next []byte, hops [][]byte) {
+	sel.Avoid(encode(next))
+	for _, id := range hops {
+		sel.Avoid(encode(id))
+	}
+}
+
+// Onion selects hops and pushes them onto an onion route. The node the route
+// currently leads to and every node already pushed onto it are avoided. The
+// returned Selection can be passed to NewSelection when choosing the other half
+// of the route. The hops are pushed onto a copy of rb that replaces it only if
+// every push succeeds, so if an error is returned neither rb nor sel is
+// changed.
+func (s *Selector) Onion(rb *onion.RouteBuilder, dir Directory, hops int, sel *Selection) (*Selection, error) {
+	if sel == nil {
+		sel = NewSelection()
+	}
+	sel.avoidRoute(rb.Next, rb.Hops())
+	start := len(sel.Hops)
+	if err := s.Select(dir, hops, sel); err != nil {
+		return nil, err
+	}
+	pubs := make([]*onion.PubNode, 0, hops)
+	for _, n := range sel.Hops[start:] {
+		pub, ok := n.Pub.(*onion.PubNode)
+		if !ok {
+			sel.Hops = sel.Hops[:start]
+			return nil, ErrWrongScheme
+		}
+		pubs = append(pubs, pub)
+	}
+	cp := rb.Copy()
+	for _, pub := range pubs {
+		if err := cp.Push(pub); err != nil {
+			sel.Hops = sel.Hops[:start]
+			return nil, err
+		}
+	}
+	*rb = *cp
+	return sel, nil
+}
+
+// Cyclic selects hops and pushes them onto a cyclic route in the same way as
+// Onion.
+func (s *Selector) Cyclic(rb *cyclic.RouteBuilder, dir Directory, hops int, sel *Selection) (*Selection, error) {
+	if sel == nil {
+		sel = NewSelection()
+	}
+	sel.avoidRoute(rb.Next, rb.Hops())
+	start := len(sel.Hops)
+	if err := s.Select(dir, hops, sel); err != nil {
+		return nil, err
+	}
+	pubs := make([]*cyclic.PubNode, 0, hops)
+	for _, n := range sel.Hops[start:] {
+		pub, ok := n.Pub.(*cyclic.PubNode)
+		if !ok {
+			sel.Hops = sel.Hops[:start]
+			return nil, ErrWrongScheme
+		}
+		pubs = append(pubs, pub)
+	}
+	cp := rb.Copy()
+	for _, pub := range pubs {
+		if err := cp.Push(pub); err != nil {
+			sel.Hops = sel.Hops[:start]
+			return nil, err
+		}
+	}
+	*rb = *cp
+	return sel, nil
+}
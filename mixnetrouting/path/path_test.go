@@ -0,0 +1,211 @@
+package path
+
+import (
+	"github.com/dist-ribut-us/docs/mixnetrouting/blacklist"
+	"github.com/dist-ribut-us/docs/mixnetrouting/cyclic"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func setupOnion(nodes int) (map[string]*onion.PrivNode, Directory) {
+	privs := make(map[string]*onion.PrivNode, nodes)
+	dir := make(Directory, nodes)
+	for i := range dir {
+		n := onion.NewPrivNode()
+		privs[n.String()] = n
+		dir[i] = &Node{
+			Pub:         n.Pub(),
+			Capacity:    1,
+			Reliability: 1,
+		}
+	}
+	return privs, dir
+}
+
+func TestSelectConstraints(t *testing.T) {
+	_, dir := setupOnion(10)
+	bl := blacklist.New()
+	bl.Add(&blacklist.Entry{ID: dir[1].ID(), Expires: time.Now().Add(time.Hour)})
+	s := NewSelector(Exclude(dir[0].ID()), Blacklisted(bl))
+
+	bob := NewSelection()
+	assert.NoError(t, s.Select(dir, 4, bob))
+	alice := NewSelection(bob)
+	assert.NoError(t, s.Select(dir, 4, alice))
+
+	seen := make(map[string]bool)
+	for _, n := range append(bob.Hops, alice.Hops...) {
+		assert.False(t, seen[n.ID()], "node repeated")
+		seen[n.ID()] = true
+	}
+	assert.False(t, seen[dir[0].ID()])
+	assert.False(t, seen[dir[1].ID()])
+
+	// only 8 nodes are allowed and 8 are used
+	assert.Equal(t, ErrNotEnoughNodes, s.Select(dir, 1, NewSelection(bob, alice)))
+}
+
+func TestSelectFailureKeepsHops(t *testing.T) {
+	_, dir := setupOnion(5)
+	s := NewSelector()
+	sel := NewSelection()
+	assert.NoError(t, s.Select(dir, 2, sel))
+	hops := append([]*Node(nil), sel.Hops...)
+
+	assert.Equal(t, ErrNotEnoughNodes, s.Select(dir, 4, sel))
+	assert.Equal(t, hops, sel.Hops)
+}
+
+func TestOnionAvoidsPushed(t *testing.T) {
+	privs, dir := setupOnion(5)
+	s := NewSelector()
+
+	rb := privs[dir[0].ID()].NewReceiveRoute()
+	for _, n := range dir[1:3] {
+		assert.NoError(t, rb.Push(n.Pub.(*onion.PubNode)))
+	}
+	sel, err := s.Onion(rb, dir, 2, nil)
+	assert.NoError(t, err)
+	for _, n := range dir[:3] {
+		assert.False(t, sel.Has(n.ID()))
+	}
+
+	sel = NewSelection()
+	_, err = s.Onion(rb, dir, 1, sel)
+	assert.Equal(t, ErrNotEnoughNodes, err)
+	assert.Len(t, sel.Hops, 0)
+}
+
+func TestPushFailureKeepsRoute(t *testing.T) {
+	// with Rand at 0 the hops are chosen in directory order, so the last hop
+	// pushed is the one that asks for too much stamp work
+	s := NewSelector()
+	s.Rand = func() float64 { return 0 }
+
+	privs, dir := setupOnion(4)
+	hard := privs[dir[3].ID()]
+	hard.StampWork = onion.DefaultMaxStampWork + 1
+	dir[3].Pub = hard.Pub()
+	rb := privs[dir[0].ID()].NewReceiveRoute()
+	data, hops := append([]byte(nil), rb.Data...), rb.Hops()
+	sel := NewSelection()
+	_, err := s.Onion(rb, dir, 3, sel)
+	assert.Equal(t, onion.ErrStampTooHard{}, err)
+	assert.Equal(t, data, rb.Data)
+	assert.Equal(t, hops, rb.Hops())
+	assert.Len(t, sel.Hops, 0)
+
+	cdir := make(Directory, 4)
+	var receiver *cyclic.PrivNode
+	for i := range cdir {
+		n := cyclic.NewPrivNode()
+		if i == 0 {
+			receiver = n
+		}
+		if i == 3 {
+			n.StampWork = cyclic.DefaultMaxStampWork + 1
+		}
+		cdir[i] = &Node{Pub: n.Pub()}
+	}
+	crb := receiver.NewReceiveRoute()
+	data, hops = append([]byte(nil), crb.Data...), crb.Hops()
+	_, err = s.Cyclic(crb, cdir, 3, sel)
+	assert.Equal(t, cyclic.ErrStampTooHard, err)
+	assert.Equal(t, data, crb.Data)
+	assert.Equal(t, hops, crb.Hops())
+	assert.Len(t, sel.Hops, 0)
+}
+
+func TestSelectWeight(t *testing.T) {
+	_, dir := setupOnion(10)
+	for _, n := range dir[5:] {
+		n.Capacity = 0
+	}
+	dir[0].Reliability = 0
+
+	s := NewSelector()
+	s.Weight = ByCapacity
+	for i := 0; i < 20; i++ {
+		sel := NewSelection()
+		assert.NoError(t, s.Select(dir, 5, sel))
+		for _, n := range sel.Hops {
+			assert.Equal(t, 1.0, n.Capacity)
+		}
+	}
+
+	s.Weight = func(n *Node) float64 { return ByCapacity(n) * ByReliability(n) }
+	assert.Equal(t, ErrNotEnoughNodes, s.Select(dir, 5, NewSelection()))
+}
+
+func TestOnionRoute(t *testing.T) {
+	privs, dir := setupOnion(20)
+	s := NewSelector()
+
+	bob := privs[dir[0].ID()]
+	bob.Cache = make(map[string]onion.KeySet)
+	rb := bob.NewReceiveRoute()
+	bobsHops, err := s.Onion(rb, dir, 3, nil)
+	assert.NoError(t, err)
+	assert.False(t, bobsHops.Has(bob.String()))
+	id, ks := rb.Receive()
+	bob.Cache[id] = ks
+
+	_, err = s.Onion(rb, dir, 3, NewSelection(bobsHops))
+	assert.NoError(t, err)
+
+	msg := []byte("Hi Bob")
+	rp := rb.Send(msg)
+	d := &onion.Delivery{
+		Forward: true,
+		Next:    rp.Next,
+	}
+	for d.Forward {
+		rp = &onion.RoutePackage{
+			RouteMsg: rp.RouteMsg,
+		}
+		d, err = privs[encode(d.Next)].Deliver(rp)
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+	assert.Equal(t, msg, d.Msg)
+	assert.Equal(t, id, d.RouteID)
+}
+
+func TestCyclicRoute(t *testing.T) {
+	privs := make(map[string]*cyclic.PrivNode)
+	dir := make(Directory, 20)
+	for i := range dir {
+		n := cyclic.NewPrivNode()
+		privs[n.String()] = n
+		dir[i] = &Node{Pub: n.Pub()}
+	}
+	s := NewSelector()
+
+	bob := privs[dir[0].ID()]
+	rb := bob.NewReceiveRoute()
+	bobsHops, err := s.Cyclic(rb, dir, 3, nil)
+	assert.NoError(t, err)
+	rb.SumKeys()
+	_, err = s.Cyclic(rb, dir, 3, NewSelection(bobsHops))
+	assert.NoError(t, err)
+
+	msg := []byte("Hi Bob")
+	rt, err := rb.GetRoute(msg)
+	assert.NoError(t, err)
+	var out []byte
+	for err = cyclic.ErrNotDelivered; err == cyclic.ErrNotDelivered; {
+		n := privs[encode(rt.Next)]
+		rt = &cyclic.RoutePackage{
+			RouteMsg: rt.RouteMsg,
+		}
+		out, err = n.Receive(rt)
+	}
+	assert.NoError(t, err)
+	assert.Equal(t, msg, out)
+
+	_, err = s.Cyclic(cyclic.NewRouteBuilder(), Directory{{Pub: onion.NewPrivNode().Pub()}}, 1, nil)
+	assert.Equal(t, ErrWrongScheme, err)
+}
@@ -0,0 +1,71 @@
+package pow
+
+import (
+	"encoding/binary"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+	"math/bits"
+)
+
+const (
+	// NonceLen is the byte length of a marshaled nonce
+	NonceLen = 8
+	// MaxBits is the highest difficulty that can be required
+	MaxBits = 48
+)
+
+// ErrBadDifficulty is returned when a difficulty is negative or above MaxBits
+const ErrBadDifficulty errors.String = "Proof-of-work difficulty must be between 0 and MaxBits"
+
+// Zeros returns the number of leading zero bits in b
+func Zeros(b []byte) int {
+	z := 0
+	for _, c := range b {
+		if c != 0 {
+			return z + bits.LeadingZeros8(c)
+		}
+		z += 8
+	}
+	return z
+}
+
+// Check that the nonce is a proof for the data: the digest of the data followed
+// by the nonce must start with at least bits zero bits. Any nonce is a proof
+// when bits is zero.
+func Check(data []byte, nonce uint64, bits int) bool {
+	if bits <= 0 {
+		return true
+	}
+	dig := crypto.GetDigest(data, Marshal(nonce))
+	return Zeros(dig.Slice()) >= bits
+}
+
+// Solve finds the lowest nonce that is a proof for the data. It takes about
+// 2^bits digests.
+func Solve(data []byte, bits int) uint64 {
+	var nonce uint64
+	for !Check(data, nonce, bits) {
+		nonce++
+	}
+	return nonce
+}
+
+// Validate returns ErrBadDifficulty if bits is not a valid difficulty
+func Validate(bits int) error {
+	if bits < 0 || bits > MaxBits {
+		return ErrBadDifficulty
+	}
+	return nil
+}
+
+// Marshal a nonce
+func Marshal(nonce uint64) []byte {
+	b := make([]byte, NonceLen)
+	binary.BigEndian.PutUint64(b, nonce)
+	return b
+}
+
+// Unmarshal a nonce, b must be at least NonceLen long
+func Unmarshal(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
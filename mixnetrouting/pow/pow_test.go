@@ -0,0 +1,36 @@
+package pow
+
+import (
+	"github.com/dist-ribut-us/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestZeros(t *testing.T) {
+	assert.Equal(t, 0, Zeros([]byte{0x80}))
+	assert.Equal(t, 7, Zeros([]byte{0x01}))
+	assert.Equal(t, 12, Zeros([]byte{0, 0x08, 0xff}))
+	assert.Equal(t, 16, Zeros([]byte{0, 0}))
+	assert.Equal(t, 0, Zeros(nil))
+}
+
+func TestSolve(t *testing.T) {
+	data := []byte("test")
+	nonce := Solve(data, 10)
+	assert.True(t, Check(data, nonce, 10))
+	dig := crypto.GetDigest(data, Marshal(nonce))
+	assert.True(t, Zeros(dig.Slice()) >= 10)
+	// every nonce below the solution fails
+	for n := uint64(0); n < nonce; n++ {
+		assert.False(t, Check(data, n, 10))
+	}
+	assert.True(t, Check(data, 12345, 0))
+	assert.Equal(t, nonce, Unmarshal(Marshal(nonce)))
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Validate(0))
+	assert.NoError(t, Validate(MaxBits))
+	assert.Equal(t, ErrBadDifficulty, Validate(-1))
+	assert.Equal(t, ErrBadDifficulty, Validate(MaxBits+1))
+}
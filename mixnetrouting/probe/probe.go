@@ -0,0 +1,237 @@
+package probe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/dist-ribut-us/errors"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// DefaultBefore is the number of hops between the prober and the suspect
+	DefaultBefore = 1
+	// DefaultAfter is the number of hops between the suspect and the prober on
+	// the way back
+	DefaultAfter = 1
+	// DefaultTimeout is how long a probe has to arrive before it is lost
+	DefaultTimeout = time.Minute
+	// DefaultMinProbes is the number of probes that must be resolved before a
+	// node can fail
+	DefaultMinProbes = 10
+	// DefaultMinRate is the delivery rate a node must be able to reach
+	DefaultMinRate = 0.5
+	// DefaultZ is the z-score of the confidence bound, about 99% one-sided
+	DefaultZ = 2.33
+	// tokenLen is the length of the random message carried by a probe
+	tokenLen = 32
+)
+
+// ErrNoHops is returned by Probe when Before or After is less than one. The
+// suspect must never be next to the prober, or it would know the probe came
+// from, and returns to, the prober.
+const ErrNoHops errors.String = "Probes need hops on both sides of the suspect"
+
+// Stats for a suspect. Pending probes have not been delivered or lost yet.
+type Stats struct {
+	Sent, Delivered, Lost int
+}
+
+// Pending returns the number of probes that have not been resolved
+func (s Stats) Pending() int {
+	return s.Sent - s.Delivered - s.Lost
+}
+
+// Upper returns the upper bound of the Wilson score interval for the delivery
+// rate with z-score z. With no resolved probes it is 1.
+func (s Stats) Upper(z float64) float64 {
+	n := float64(s.Delivered + s.Lost)
+	if n == 0 {
+		return 1
+	}
+	p := float64(s.Delivered) / n
+	z2 := z * z
+	center := p + z2/(2*n)
+	margin := z * math.Sqrt(p*(1-p)/n+z2/(4*n*n))
+	return (center + margin) / (1 + z2/n)
+}
+
+type pending struct {
+	suspect string
+	token   []byte
+	sent    time.Time
+}
+
+// Prober finds nodes that decline to route by sending messages through them
+// and checking that they arrive. Each probe is a loop: a new receive route to
+// the prober with the suspect as an intermediate hop and Before hops pushed in
+// front of it. Hops chooses the other hops, and should avoid the prober and the
+// suspect. To the suspect, a probe is an ordinary message on a receive route;
+// the caller should send probes on the same schedule as other traffic.
+//
+// A suspect fails once MinProbes have been resolved and the upper confidence
+// bound on its delivery rate is below MinRate. Other hops also lose messages,
+// so MinRate should be well below the normal rate. OnFail is called once when
+// a suspect fails.
+type Prober struct {
+	Node      *onion.PrivNode
+	Hops      func(suspect *onion.PubNode, n int) ([]*onion.PubNode, error)
+	Transport func(*onion.RoutePackage) error
+	OnFail    func(id string, s Stats)
+	Before    int
+	After     int
+	Timeout   time.Duration
+	MinProbes int
+	MinRate   float64
+	Z         float64
+	// Now can be replaced for testing
+	Now     func() time.Time
+	stats   map[string]*Stats
+	failed  map[string]bool
+	pending map[string]*pending
+}
+
+// New creates a Prober with the default settings
+func New(n *onion.PrivNode, hops func(*onion.PubNode, int) ([]*onion.PubNode, error), transport func(*onion.RoutePackage) error) *Prober {
+	if n.Cache == nil {
+		n.Cache = make(map[string]onion.KeySet)
+	}
+	return &Prober{
+		Node:      n,
+		Hops:      hops,
+		Transport: transport,
+		Before:    DefaultBefore,
+		After:     DefaultAfter,
+		Timeout:   DefaultTimeout,
+		MinProbes: DefaultMinProbes,
+		MinRate:   DefaultMinRate,
+		Z:         DefaultZ,
+		Now:       time.Now,
+		stats:     make(map[string]*Stats),
+		failed:    make(map[string]bool),
+		pending:   make(map[string]*pending),
+	}
+}
+
+// Probe sends a message through the suspect. If the message cannot be sent to
+// the first hop, the error is returned and the probe is not counted.
+func (p *Prober) Probe(suspect *onion.PubNode) error {
+	if p.Before < 1 || p.After < 1 {
+		return ErrNoHops
+	}
+	hops, err := p.Hops(suspect, p.Before+p.After)
+	if err != nil {
+		return err
+	}
+
+	rb := p.Node.NewReceiveRoute()
+	for _, h := range hops[:p.After] {
+		if err = rb.Push(h); err != nil {
+			return err
+		}
+	}
+	if err = rb.Push(suspect); err != nil {
+		return err
+	}
+	id, ks := rb.Receive()
+	for _, h := range hops[p.After:] {
+		if err = rb.Push(h); err != nil {
+			return err
+		}
+	}
+
+	token := make([]byte, tokenLen)
+	rand.Read(token)
+	p.Node.Cache[id] = ks
+	if err = p.Transport(rb.Send(token)); err != nil {
+		delete(p.Node.Cache, id)
+		return err
+	}
+
+	sid := suspect.String()
+	p.pending[id] = &pending{
+		suspect: sid,
+		token:   token,
+		sent:    p.Now(),
+	}
+	p.stat(sid).Sent++
+	return nil
+}
+
+func (p *Prober) stat(id string) *Stats {
+	s, ok := p.stats[id]
+	if !ok {
+		s = &Stats{}
+		p.stats[id] = s
+	}
+	return s
+}
+
+// Deliver checks if a Delivery is a probe. If it is, the probe is resolved and
+// true is returned; the Delivery should not be handled any further.
+func (p *Prober) Deliver(d *onion.Delivery) bool {
+	pr, ok := p.pending[d.RouteID]
+	if !ok {
+		return false
+	}
+	p.resolve(d.RouteID, pr, bytes.Equal(pr.token, d.Msg))
+	return true
+}
+
+// Expire counts every probe that has been pending longer than Timeout as lost
+func (p *Prober) Expire() {
+	now := p.Now()
+	for id, pr := range p.pending {
+		if now.Sub(pr.sent) >= p.Timeout {
+			p.resolve(id, pr, false)
+		}
+	}
+}
+
+func (p *Prober) resolve(id string, pr *pending, delivered bool) {
+	delete(p.pending, id)
+	delete(p.Node.Cache, id)
+	s := p.stat(pr.suspect)
+	if delivered {
+		s.Delivered++
+	} else {
+		s.Lost++
+	}
+	if !p.failed[pr.suspect] && p.fails(s) {
+		p.failed[pr.suspect] = true
+		if p.OnFail != nil {
+			p.OnFail(pr.suspect, *s)
+		}
+	}
+}
+
+func (p *Prober) fails(s *Stats) bool {
+	return s.Delivered+s.Lost >= p.MinProbes && s.Upper(p.Z) < p.MinRate
+}
+
+// Stats returns the Stats for a suspect
+func (p *Prober) Stats(id string) Stats {
+	if s, ok := p.stats[id]; ok {
+		return *s
+	}
+	return Stats{}
+}
+
+// Failing returns the IDs of the suspects that have failed, sorted
+func (p *Prober) Failing() []string {
+	ids := make([]string, 0, len(p.failed))
+	for id := range p.failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Forget drops the Stats for a suspect, for instance once it has been
+// blacklisted. Pending probes through it are still resolved.
+func (p *Prober) Forget(id string) {
+	delete(p.stats, id)
+	delete(p.failed, id)
+}
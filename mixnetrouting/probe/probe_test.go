@@ -0,0 +1,108 @@
+package probe
+
+import (
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/dist-ribut-us/docs/mixnetrouting/path"
+	"github.com/dist-ribut-us/docs/mixnetrouting/sim"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestUpper(t *testing.T) {
+	assert.Equal(t, 1.0, Stats{}.Upper(DefaultZ))
+	assert.True(t, Stats{Delivered: 10}.Upper(DefaultZ) > 0.99)
+	assert.True(t, Stats{Lost: 10}.Upper(DefaultZ) < DefaultMinRate)
+	assert.True(t, Stats{Delivered: 1, Lost: 1}.Upper(DefaultZ) > DefaultMinRate)
+	assert.True(t, Stats{Delivered: 10, Lost: 90}.Upper(DefaultZ) < 0.2)
+	assert.Equal(t, 3, Stats{Sent: 5, Delivered: 1, Lost: 1}.Pending())
+}
+
+func setup(t *testing.T) (*sim.Sim, *sim.Node, *Prober) {
+	s, err := sim.New(20)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	n := s.Nodes[0]
+	return s, n, New(n.PrivNode, s.ProbeHops(n), n.Send)
+}
+
+func deliver(p *Prober, n *sim.Node) {
+	for _, d := range n.Inbox() {
+		p.Deliver(d)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	s, n, p := setup(t)
+	good, bad := s.Nodes[5], s.Nodes[6]
+	bad.Freeload = true
+	// other hops are not chosen from known freeloaders
+	s.Selector = path.NewSelector(path.Exclude(bad.String()))
+	var failed []string
+	p.OnFail = func(id string, st Stats) {
+		failed = append(failed, id)
+		assert.Equal(t, p.MinProbes, st.Lost)
+	}
+
+	for i := 0; i < p.MinProbes; i++ {
+		assert.NoError(t, p.Probe(good.Pub()))
+		assert.NoError(t, p.Probe(bad.Pub()))
+		deliver(p, n)
+	}
+	assert.Equal(t, Stats{Sent: p.MinProbes, Delivered: p.MinProbes}, p.Stats(good.String()))
+	assert.Equal(t, p.MinProbes, p.Stats(bad.String()).Pending())
+	assert.Len(t, p.Failing(), 0)
+
+	p.Now = func() time.Time { return time.Now().Add(p.Timeout) }
+	p.Expire()
+	assert.Equal(t, []string{bad.String()}, p.Failing())
+	assert.Equal(t, []string{bad.String()}, failed)
+	// resolved probes are removed from the node's Cache
+	assert.Len(t, n.Cache, 0)
+
+	// OnFail is only called once
+	p.Now = time.Now
+	assert.NoError(t, p.Probe(bad.Pub()))
+	p.Now = func() time.Time { return time.Now().Add(p.Timeout) }
+	p.Expire()
+	assert.Len(t, failed, 1)
+
+	p.Forget(bad.String())
+	assert.Len(t, p.Failing(), 0)
+	assert.Equal(t, Stats{}, p.Stats(bad.String()))
+}
+
+func TestProbeLooksNormal(t *testing.T) {
+	s, n, p := setup(t)
+	suspect := s.Nodes[7]
+	p.Transport = func(rp *onion.RoutePackage) error {
+		// the first hop is never the suspect
+		assert.NotEqual(t, suspect.ID, rp.Next)
+		return n.Send(rp)
+	}
+	suspect.Endpoint.Handle(func(from string, req []byte) ([]byte, error) {
+		// the suspect does not receive the probe from the prober
+		assert.NotEqual(t, n.String(), from)
+		return nil, nil
+	})
+	assert.NoError(t, p.Probe(suspect.Pub()))
+
+	// A probe is the same size as a message on an offered route
+	var sent *onion.RoutePackage
+	p.Transport = func(rp *onion.RoutePackage) error {
+		sent = rp
+		return nil
+	}
+	assert.NoError(t, p.Probe(suspect.Pub()))
+	fresh, err := s.Nodes[9].ManageRoutes(1, 2, time.Hour).Fresh()
+	assert.NoError(t, err)
+	rb := fresh[0].Offer.Copy()
+	assert.NoError(t, s.Extend(rb, 1))
+	rp := rb.Send([]byte("Hi"))
+	assert.Len(t, sent.Map, len(rp.Map))
+	assert.Len(t, sent.Data, len(rp.Data))
+
+	p.Before = 0
+	assert.Equal(t, ErrNoHops, p.Probe(suspect.Pub()))
+}
@@ -0,0 +1,65 @@
+package session
+
+import (
+	"github.com/dist-ribut-us/errors"
+	"sync"
+)
+
+// ErrNoState is returned by a Keystore when nothing is saved under an ID
+const ErrNoState errors.String = "No state saved for session"
+
+// Keystore persists the state of sessions. The state contains key material,
+// so an implementation should protect it at rest and Delete should erase it.
+type Keystore interface {
+	Load(id string) ([]byte, error)
+	Save(id string, state []byte) error
+	Delete(id string) error
+}
+
+// MemKeystore is a Keystore that holds state in memory
+type MemKeystore struct {
+	mux   sync.Mutex
+	state map[string][]byte
+}
+
+// NewMemKeystore creates an empty MemKeystore
+func NewMemKeystore() *MemKeystore {
+	return &MemKeystore{
+		state: make(map[string][]byte),
+	}
+}
+
+// Load the state saved under an ID
+func (ks *MemKeystore) Load(id string) ([]byte, error) {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	s, ok := ks.state[id]
+	if !ok {
+		return nil, ErrNoState
+	}
+	return append([]byte(nil), s...), nil
+}
+
+// Save state under an ID, replacing and erasing any previous state
+func (ks *MemKeystore) Save(id string, state []byte) error {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	erase(ks.state[id])
+	ks.state[id] = append([]byte(nil), state...)
+	return nil
+}
+
+// Delete and erase the state saved under an ID
+func (ks *MemKeystore) Delete(id string) error {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+	erase(ks.state[id])
+	delete(ks.state, id)
+	return nil
+}
+
+func erase(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,230 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/dist-ribut-us/crypto"
+	"github.com/dist-ribut-us/errors"
+)
+
+const (
+	// MaxSkip is the number of message keys that can be skipped when messages
+	// arrive out of order or are lost.
+	MaxSkip = 64
+	// headerLen is the length of the ratchet header, Key | Counter
+	headerLen = crypto.KeyLength + 4
+)
+
+const (
+	// ErrNoPeerKey is returned when sending before the peer's session key is
+	// known.
+	ErrNoPeerKey errors.String = "Peer session key is not known"
+	// ErrPeerKeyChanged is returned when a message carries a different session
+	// key than the one the ratchet was started with.
+	ErrPeerKeyChanged errors.String = "Peer session key changed"
+	// ErrOldMessage is returned when a message key has already been used and
+	// erased.
+	ErrOldMessage errors.String = "Message key has been erased"
+	// ErrTooFarAhead is returned when a message would skip more than MaxSkip
+	// keys.
+	ErrTooFarAhead errors.String = "Message is too far ahead"
+)
+
+// ratchet is a symmetric hash ratchet. The two sides exchange session keys and
+// derive a chain key for each direction from the shared secret, after which the
+// private key is erased. Each message is sealed with a key derived from the
+// chain and the chain is advanced, erasing the previous chain key. Compromising
+// the session state later does not expose earlier messages.
+type ratchet struct {
+	priv *crypto.XchgPriv
+	pub  []byte
+	peer []byte
+	// send and recv are the current chain keys; they are nil until the ratchet
+	// is started.
+	send, recv   []byte
+	sendN, recvN uint32
+	skipped      map[uint32][]byte
+}
+
+func newRatchet() *ratchet {
+	kp := crypto.GenerateXchgPair()
+	return &ratchet{
+		priv:    kp.Priv(),
+		pub:     kp.Pub().Slice(),
+		skipped: make(map[uint32][]byte),
+	}
+}
+
+// kdf derives a key from a secret key and a label. The key is always
+// crypto.KeyLength bytes, so the digest of key | label is a sound KDF.
+func kdf(key []byte, label byte) []byte {
+	return crypto.GetDigest(key, []byte{label}).Slice()
+}
+
+// setPeer records the peer's session key. It cannot be changed once set.
+func (r *ratchet) setPeer(peer []byte) error {
+	if r.peer != nil {
+		if !bytes.Equal(r.peer, peer) {
+			return ErrPeerKeyChanged
+		}
+		return nil
+	}
+	r.peer = append([]byte(nil), peer...)
+	return nil
+}
+
+// start derives the chain keys from the shared secret and erases the private
+// key. The side with the lower key sends on chain a.
+func (r *ratchet) start() error {
+	if r.send != nil {
+		return nil
+	}
+	if r.peer == nil {
+		return ErrNoPeerKey
+	}
+	if len(r.peer) != crypto.KeyLength || r.priv == nil {
+		return ErrNoPeerKey
+	}
+	shared := r.priv.Shared(crypto.XchgPubFromSlice(r.peer)).Slice()
+	a, b := kdf(shared, 'a'), kdf(shared, 'b')
+	erase(shared)
+	erase(r.priv.Slice())
+	if bytes.Compare(r.pub, r.peer) < 0 {
+		r.send, r.recv = a, b
+	} else {
+		r.send, r.recv = b, a
+	}
+	r.priv = nil
+	return nil
+}
+
+// step returns the message key and the next chain key
+func step(chain []byte) (msgKey, next []byte) {
+	return kdf(chain, 1), kdf(chain, 2)
+}
+
+// seal a message with the next send key and advance the chain
+func (r *ratchet) seal(msg []byte) ([]byte, error) {
+	if err := r.start(); err != nil {
+		return nil, err
+	}
+	mk, next := step(r.send)
+	erase(r.send)
+	r.send = next
+	out := make([]byte, headerLen, headerLen+crypto.NonceLength+crypto.Overhead+len(msg))
+	copy(out, r.pub)
+	binary.BigEndian.PutUint32(out[crypto.KeyLength:], r.sendN)
+	r.sendN++
+	out = append(out, crypto.SymmetricFromSlice(mk).Seal(msg, crypto.RandomNonce())...)
+	erase(mk)
+	return out, nil
+}
+
+// open a message, advancing the receive chain. The chain is only advanced if
+// the message is authentic. Keys for skipped messages are held until they are
+// used.
+func (r *ratchet) open(env []byte) ([]byte, error) {
+	if len(env) < headerLen+crypto.NonceLength {
+		return nil, ErrBadEnvelope
+	}
+	if err := r.setPeer(env[:crypto.KeyLength]); err != nil {
+		return nil, err
+	}
+	if err := r.start(); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(env[crypto.KeyLength:])
+	sealed := env[headerLen:]
+
+	if n < r.recvN {
+		mk, ok := r.skipped[n]
+		if !ok {
+			return nil, ErrOldMessage
+		}
+		msg, err := openWith(mk, sealed)
+		if err != nil {
+			return nil, err
+		}
+		erase(mk)
+		delete(r.skipped, n)
+		return msg, nil
+	}
+	if n-r.recvN > MaxSkip || len(r.skipped)+int(n-r.recvN) > MaxSkip {
+		return nil, ErrTooFarAhead
+	}
+
+	chain := r.recv
+	var skipped [][]byte
+	for i := r.recvN; i < n; i++ {
+		var mk []byte
+		mk, chain = step(chain)
+		skipped = append(skipped, mk)
+	}
+	mk, next := step(chain)
+	msg, err := openWith(mk, sealed)
+	erase(mk)
+	if err != nil {
+		return nil, err
+	}
+	for i, sk := range skipped {
+		r.skipped[r.recvN+uint32(i)] = sk
+	}
+	erase(r.recv)
+	r.recv = next
+	r.recvN = n + 1
+	return msg, nil
+}
+
+func openWith(mk, sealed []byte) ([]byte, error) {
+	nonce := crypto.ExtractNonce(sealed)
+	if nonce == nil {
+		return nil, ErrBadEnvelope
+	}
+	return crypto.SymmetricFromSlice(mk).NonceOpen(sealed[crypto.NonceLength:], nonce)
+}
+
+// ratchetState is the part of the ratchet saved with the session
+type ratchetState struct {
+	Priv, Pub, Peer []byte
+	Send, Recv      []byte
+	SendN, RecvN    uint32
+	Skipped         map[uint32][]byte
+}
+
+func (r *ratchet) state() *ratchetState {
+	st := &ratchetState{
+		Pub:     r.pub,
+		Peer:    r.peer,
+		Send:    r.send,
+		Recv:    r.recv,
+		SendN:   r.sendN,
+		RecvN:   r.recvN,
+		Skipped: r.skipped,
+	}
+	if r.priv != nil {
+		st.Priv = r.priv.Slice()
+	}
+	return st
+}
+
+func ratchetFromState(st *ratchetState) (*ratchet, error) {
+	r := &ratchet{
+		pub:     st.Pub,
+		peer:    st.Peer,
+		send:    st.Send,
+		recv:    st.Recv,
+		sendN:   st.SendN,
+		recvN:   st.RecvN,
+		skipped: st.Skipped,
+	}
+	if r.skipped == nil {
+		r.skipped = make(map[uint32][]byte)
+	}
+	if st.Priv != nil {
+		if len(st.Priv) != crypto.KeyLength {
+			return nil, ErrBadState
+		}
+		r.priv = crypto.XchgPrivFromSlice(st.Priv)
+	}
+	return r, nil
+}
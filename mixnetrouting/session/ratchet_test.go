@@ -0,0 +1,113 @@
+package session
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func setupRatchets(t *testing.T) (*ratchet, *ratchet) {
+	a, b := newRatchet(), newRatchet()
+	assert.Equal(t, ErrNoPeerKey, a.start())
+	assert.NoError(t, a.setPeer(b.pub))
+	assert.NoError(t, b.setPeer(a.pub))
+	return a, b
+}
+
+func TestRatchet(t *testing.T) {
+	a, b := setupRatchets(t)
+
+	for i := 0; i < 3; i++ {
+		env, err := a.seal([]byte("to b"))
+		assert.NoError(t, err)
+		msg, err := b.open(env)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("to b"), msg)
+
+		env, err = b.seal([]byte("to a"))
+		assert.NoError(t, err)
+		msg, err = a.open(env)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("to a"), msg)
+	}
+	// the private keys are erased once started
+	assert.Nil(t, a.priv)
+	assert.Nil(t, b.priv)
+
+	assert.Equal(t, ErrPeerKeyChanged, a.setPeer(newRatchet().pub))
+}
+
+func TestRatchetErasesKeys(t *testing.T) {
+	a, b := setupRatchets(t)
+	env, err := a.seal([]byte("once"))
+	assert.NoError(t, err)
+	assert.NoError(t, b.start())
+	old := b.recv
+	_, err = b.open(env)
+	assert.NoError(t, err)
+
+	// the message cannot be opened again and the old chain key is erased
+	_, err = b.open(env)
+	assert.Equal(t, ErrOldMessage, err)
+	assert.Equal(t, make([]byte, len(old)), old)
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	a, b := setupRatchets(t)
+	envs := make([][]byte, 4)
+	for i := range envs {
+		var err error
+		envs[i], err = a.seal([]byte{byte(i)})
+		assert.NoError(t, err)
+	}
+	for _, i := range []int{2, 0, 3, 1} {
+		msg, err := b.open(envs[i])
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{byte(i)}, msg)
+	}
+	assert.Len(t, b.skipped, 0)
+	_, err := b.open(envs[1])
+	assert.Equal(t, ErrOldMessage, err)
+}
+
+func TestRatchetTampered(t *testing.T) {
+	a, b := setupRatchets(t)
+	env, err := a.seal([]byte("hello"))
+	assert.NoError(t, err)
+	env[len(env)-1] ^= 1
+	_, err = b.open(env)
+	assert.Error(t, err)
+	// a forged message does not advance the chain
+	assert.Equal(t, uint32(0), b.recvN)
+	assert.Len(t, b.skipped, 0)
+
+	for i := 0; i <= MaxSkip; i++ {
+		env, err = a.seal([]byte("lost"))
+		assert.NoError(t, err)
+	}
+	env, err = a.seal([]byte("late"))
+	assert.NoError(t, err)
+	_, err = b.open(env)
+	assert.Equal(t, ErrTooFarAhead, err)
+}
+
+func TestRatchetState(t *testing.T) {
+	a, b := setupRatchets(t)
+	// a has not started, so its private key is saved
+	a2, err := ratchetFromState(a.state())
+	assert.NoError(t, err)
+
+	env, err := b.seal([]byte("hello"))
+	assert.NoError(t, err)
+	msg, err := a2.open(env)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), msg)
+
+	a3, err := ratchetFromState(a2.state())
+	assert.NoError(t, err)
+	assert.Nil(t, a3.priv)
+	env, err = a3.seal([]byte("back"))
+	assert.NoError(t, err)
+	msg, err = b.open(env)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("back"), msg)
+}
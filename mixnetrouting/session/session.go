@@ -0,0 +1,373 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"github.com/dist-ribut-us/docs/mixnetrouting/mailbox"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/dist-ribut-us/errors"
+	"time"
+)
+
+const (
+	// DefaultAttach is the number of new route offers attached to each message
+	DefaultAttach = 2
+	// DefaultMaxOffers is the number of the peer's offers that are kept
+	DefaultMaxOffers = 8
+	// DefaultOfferTTL is how long a peer's offer is used after it is received.
+	// It should be less than the TTL the peer's RouteManager uses.
+	DefaultOfferTTL = 10 * time.Minute
+)
+
+const (
+	// ErrNoRoutes is returned by Send when there are no usable routes to the
+	// peer.
+	ErrNoRoutes errors.String = "No routes to peer"
+	// ErrUnknownRoute is returned by Receive when a message did not arrive on a
+	// route offered in the session.
+	ErrUnknownRoute errors.String = "Message did not arrive on a route offered in the session"
+	// ErrBadEnvelope is returned by Receive when a message cannot be parsed
+	ErrBadEnvelope errors.String = "Bad session envelope"
+	// ErrBadState is returned by Load when the saved state is malformed
+	ErrBadState errors.String = "Bad session state"
+)
+
+// offer is a route to the peer
+type offer struct {
+	Route    *onion.RouteBuilder
+	Received time.Time
+	Uses     int
+}
+
+// Session keeps communication with a peer alive. Every message sent carries
+// new offers for routes back to us, and every message received refreshes the
+// routes we hold to the peer. Offers that expire or fail are dropped. Messages
+// are sealed end-to-end with a hash ratchet so that each message key is erased
+// once it is used, even when a receive route is reused.
+//
+// Routes sent to the peer are built by Routes, which should not be shared with
+// other sessions so that the peers cannot link them. Extend pushes our own
+// hops onto a peer's offer and Transport sends the finished package; it should
+// return an error if the package cannot be sent so the route is dropped.
+type Session struct {
+	ID        string
+	Routes    *onion.RouteManager
+	Keystore  Keystore
+	Extend    func(*onion.RouteBuilder) error
+	Transport func(*onion.RoutePackage) error
+	Attach    int
+	MaxOffers int
+	OfferTTL  time.Duration
+	// Now can be replaced for testing
+	Now func() time.Time
+	// offers to the peer, newest first
+	offers []*offer
+	// offered holds the IDs of our routes that have been offered to the peer
+	offered map[string]bool
+	ratchet *ratchet
+}
+
+// New creates a Session. The peer's session key and offers must be added with
+// AddBundle before the first Send.
+func New(id string, routes *onion.RouteManager, ks Keystore) *Session {
+	return &Session{
+		ID:        id,
+		Routes:    routes,
+		Keystore:  ks,
+		Attach:    DefaultAttach,
+		MaxOffers: DefaultMaxOffers,
+		OfferTTL:  DefaultOfferTTL,
+		Now:       time.Now,
+		offered:   make(map[string]bool),
+		ratchet:   newRatchet(),
+	}
+}
+
+// AddBundle sets the peer's session key and adds the offers from a Bundle
+// created by the peer's Session.
+func (s *Session) AddBundle(b *mailbox.Bundle) error {
+	if b.Key != nil {
+		if err := s.ratchet.setPeer(b.Key); err != nil {
+			return err
+		}
+	}
+	s.AddOffers(b.Offers...)
+	return nil
+}
+
+// AddOffers adds routes to the peer, such as the one received in a mailbox
+// Intro.
+func (s *Session) AddOffers(routes ...*onion.RouteBuilder) {
+	now := s.Now()
+	added := make([]*offer, 0, len(routes))
+	for i := len(routes) - 1; i >= 0; i-- {
+		added = append(added, &offer{
+			Route:    routes[i],
+			Received: now,
+		})
+	}
+	s.offers = append(added, s.offers...)
+	if len(s.offers) > s.MaxOffers {
+		s.offers = s.offers[:s.MaxOffers]
+	}
+}
+
+// Offers returns the number of routes held to the peer
+func (s *Session) Offers() int { return len(s.offers) }
+
+// expire drops the peer's expired offers and forgets our routes that the
+// RouteManager no longer holds.
+func (s *Session) expire() {
+	now := s.Now()
+	keep := s.offers[:0]
+	for _, o := range s.offers {
+		if now.Sub(o.Received) < s.OfferTTL {
+			keep = append(keep, o)
+		}
+	}
+	s.offers = keep
+	for id := range s.offered {
+		if s.Routes.Route(id) == nil {
+			delete(s.offered, id)
+		}
+	}
+}
+
+// attach returns fresh routes that have not been offered to the peer, building
+// more if needed.
+func (s *Session) attach() ([]*onion.ManagedRoute, error) {
+	fresh, err := s.Routes.Fresh()
+	if err != nil {
+		return nil, err
+	}
+	var rs []*onion.ManagedRoute
+	for _, r := range fresh {
+		if len(rs) == s.Attach {
+			break
+		}
+		if !s.offered[r.ID] {
+			rs = append(rs, r)
+		}
+	}
+	for len(rs) < s.Attach {
+		r, err := s.Routes.Build()
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// Bundle returns our session key and new route offers for the peer and records
+// them as offered. It is used to bootstrap a session, for instance as the
+// Bundle in a mailbox reply.
+func (s *Session) Bundle() (*mailbox.Bundle, error) {
+	s.expire()
+	rs, err := s.attach()
+	if err != nil {
+		return nil, err
+	}
+	b := &mailbox.Bundle{
+		Key:    s.ratchet.pub,
+		Offers: make([]*onion.RouteBuilder, len(rs)),
+	}
+	for i, r := range rs {
+		b.Offers[i] = r.Offer.Copy()
+		s.offered[r.ID] = true
+	}
+	return b, s.Save()
+}
+
+// Send a message to the peer on the newest route that works. New route offers
+// are attached to the message.
+func (s *Session) Send(msg []byte) error {
+	s.expire()
+	if len(s.offers) == 0 {
+		return ErrNoRoutes
+	}
+	if err := s.ratchet.start(); err != nil {
+		return err
+	}
+	rs, err := s.attach()
+	if err != nil {
+		return err
+	}
+	bundle := &mailbox.Bundle{
+		Key:    s.ratchet.pub,
+		Offers: make([]*onion.RouteBuilder, len(rs)),
+	}
+	for i, r := range rs {
+		bundle.Offers[i] = r.Offer.Copy()
+	}
+	plain, err := pack(bundle, msg)
+	if err != nil {
+		return err
+	}
+	env, err := s.ratchet.seal(plain)
+	if err != nil {
+		return err
+	}
+
+	for len(s.offers) > 0 {
+		o := s.offers[0]
+		rb := o.Route.Copy()
+		if err = s.Extend(rb); err != nil {
+			return err
+		}
+		if err = s.Transport(rb.Send(env)); err == nil {
+			o.Uses++
+			for _, r := range rs {
+				s.offered[r.ID] = true
+			}
+			return s.Save()
+		}
+		s.offers = s.offers[1:]
+	}
+	if err = s.Save(); err != nil {
+		return err
+	}
+	return ErrNoRoutes
+}
+
+// Receive a Delivery on one of the routes offered in the session. The offers
+// attached to it are added and the message is returned.
+func (s *Session) Receive(d *onion.Delivery) ([]byte, error) {
+	if !s.offered[d.RouteID] {
+		return nil, ErrUnknownRoute
+	}
+	plain, err := s.ratchet.open(d.Msg)
+	if err != nil {
+		return nil, err
+	}
+	bundle, msg, err := unpack(plain)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.AddBundle(bundle); err != nil {
+		return nil, err
+	}
+	s.expire()
+	return msg, s.Save()
+}
+
+// Owns returns true if the route ID was offered in this session. It can be used
+// to find the session a Delivery belongs to.
+func (s *Session) Owns(routeID string) bool {
+	return s.offered[routeID]
+}
+
+// pack creates an envelope as len(bundle) | bundle | msg
+func pack(b *mailbox.Bundle, msg []byte) ([]byte, error) {
+	bb, err := b.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	env := make([]byte, 4, 4+len(bb)+len(msg))
+	binary.BigEndian.PutUint32(env, uint32(len(bb)))
+	env = append(env, bb...)
+	return append(env, msg...), nil
+}
+
+// unpack reverses pack
+func unpack(env []byte) (*mailbox.Bundle, []byte, error) {
+	if len(env) < 4 {
+		return nil, nil, ErrBadEnvelope
+	}
+	ln := binary.BigEndian.Uint32(env)
+	env = env[4:]
+	if uint64(ln) > uint64(len(env)) {
+		return nil, nil, ErrBadEnvelope
+	}
+	b, err := mailbox.UnmarshalBundle(env[:ln])
+	if err != nil {
+		return nil, nil, ErrBadEnvelope
+	}
+	return b, env[ln:], nil
+}
+
+// state is the part of a Session saved in the Keystore
+type state struct {
+	Offers   [][]byte
+	Received []time.Time
+	Uses     []int
+	Offered  []string
+	Ratchet  *ratchetState
+}
+
+// Save the session state to the Keystore
+func (s *Session) Save() error {
+	st := &state{
+		Ratchet: s.ratchet.state(),
+	}
+	for _, o := range s.offers {
+		b, err := o.Route.MarshalOffer()
+		if err != nil {
+			return err
+		}
+		st.Offers = append(st.Offers, b)
+		st.Received = append(st.Received, o.Received)
+		st.Uses = append(st.Uses, o.Uses)
+	}
+	for id := range s.offered {
+		st.Offered = append(st.Offered, id)
+	}
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(st); err != nil {
+		return err
+	}
+	return s.Keystore.Save(s.ID, buf.Bytes())
+}
+
+// Load a Session from the Keystore. Only the IDs of the routes offered to the
+// peer are saved; their keys are held by the RouteManager, so it must be the
+// one the session was using. Offered routes that the RouteManager does not
+// hold, as happens if it is created again after a restart, are forgotten and
+// the peer's messages on them fail with ErrUnknownRoute until the session
+// sends new offers.
+func Load(id string, routes *onion.RouteManager, ks Keystore) (*Session, error) {
+	b, err := ks.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	st := &state{}
+	if err = gob.NewDecoder(bytes.NewReader(b)).Decode(st); err != nil {
+		return nil, err
+	}
+	if st.Ratchet == nil || len(st.Received) != len(st.Offers) || len(st.Uses) != len(st.Offers) {
+		return nil, ErrBadState
+	}
+	s := New(id, routes, ks)
+	if s.ratchet, err = ratchetFromState(st.Ratchet); err != nil {
+		return nil, err
+	}
+	for i, ob := range st.Offers {
+		rb, err := onion.UnmarshalOffer(ob)
+		if err != nil {
+			return nil, err
+		}
+		s.offers = append(s.offers, &offer{
+			Route:    rb,
+			Received: st.Received[i],
+			Uses:     st.Uses[i],
+		})
+	}
+	for _, rid := range st.Offered {
+		if routes.Route(rid) != nil {
+			s.offered[rid] = true
+		}
+	}
+	return s, nil
+}
+
+// Close deletes the session state from the Keystore and revokes the routes
+// offered in it.
+func (s *Session) Close() error {
+	for id := range s.offered {
+		s.Routes.Revoke(id)
+	}
+	s.offered = make(map[string]bool)
+	s.offers = nil
+	return s.Keystore.Delete(s.ID)
+}
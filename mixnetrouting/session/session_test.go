@@ -0,0 +1,142 @@
+package session
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/dist-ribut-us/docs/mixnetrouting/sim"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func setupSessions(t *testing.T) (*sim.Sim, *sim.Node, *Session, *sim.Node, *Session) {
+	s, err := sim.New(30)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	alice, bob := s.Nodes[4], s.Nodes[21]
+	extend := func(rb *onion.RouteBuilder) error { return s.Extend(rb, 2) }
+
+	aliceS := New("bob", alice.ManageRoutes(2, 2, time.Hour), NewMemKeystore())
+	aliceS.Extend, aliceS.Transport = extend, alice.Send
+	bobS := New("alice", bob.ManageRoutes(2, 2, time.Hour), NewMemKeystore())
+	bobS.Extend, bobS.Transport = extend, bob.Send
+
+	// Alice introduces herself with a bundle of offers
+	b, err := aliceS.Bundle()
+	assert.NoError(t, err)
+	assert.NoError(t, bobS.AddBundle(b))
+	return s, alice, aliceS, bob, bobS
+}
+
+func receive(t *testing.T, n *sim.Node, s *Session) []byte {
+	in := n.Inbox()
+	if !assert.Len(t, in, 1) {
+		t.FailNow()
+	}
+	msg, err := s.Receive(in[0])
+	assert.NoError(t, err)
+	return msg
+}
+
+func TestSession(t *testing.T) {
+	_, alice, aliceS, bob, bobS := setupSessions(t)
+
+	_, err := aliceS.Receive(&onion.Delivery{RouteID: "nope"})
+	assert.Equal(t, ErrUnknownRoute, err)
+	assert.Equal(t, ErrNoRoutes, aliceS.Send([]byte("too soon")))
+
+	assert.NoError(t, bobS.Send([]byte("Hi Alice")))
+	assert.Equal(t, []byte("Hi Alice"), receive(t, alice, aliceS))
+	assert.Equal(t, DefaultAttach, aliceS.Offers())
+
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, aliceS.Send([]byte("Hi Bob")))
+		assert.Equal(t, []byte("Hi Bob"), receive(t, bob, bobS))
+		assert.NoError(t, bobS.Send([]byte("Hi Alice")))
+		assert.Equal(t, []byte("Hi Alice"), receive(t, alice, aliceS))
+	}
+	assert.Equal(t, DefaultMaxOffers, aliceS.Offers())
+	assert.Equal(t, DefaultMaxOffers, bobS.Offers())
+}
+
+func TestSessionDropsRoutes(t *testing.T) {
+	_, alice, aliceS, bob, bobS := setupSessions(t)
+	assert.NoError(t, bobS.Send([]byte("Hi Alice")))
+	receive(t, alice, aliceS)
+
+	// Bob revokes one of his routes. If Alice tries it first, it fails and she
+	// falls back to the other.
+	for id := range bobS.offered {
+		bob.Manager.Revoke(id)
+		break
+	}
+	assert.NoError(t, aliceS.Send([]byte("Hi Bob")))
+	receive(t, bob, bobS)
+	assert.True(t, aliceS.Offers() > 0)
+
+	for id := range bobS.offered {
+		bob.Manager.Revoke(id)
+	}
+	assert.Equal(t, ErrNoRoutes, aliceS.Send([]byte("Hi Bob")))
+	assert.Equal(t, 0, aliceS.Offers())
+
+	// Offers expire
+	now := time.Now().Add(DefaultOfferTTL)
+	bobS.Now = func() time.Time { return now }
+	assert.Equal(t, ErrNoRoutes, bobS.Send([]byte("Hi Alice")))
+	assert.Equal(t, 0, bobS.Offers())
+}
+
+func TestSessionSaveLoad(t *testing.T) {
+	_, alice, aliceS, bob, bobS := setupSessions(t)
+	assert.NoError(t, bobS.Send([]byte("Hi Alice")))
+	receive(t, alice, aliceS)
+
+	loaded, err := Load("bob", alice.Manager, aliceS.Keystore)
+	assert.NoError(t, err)
+	assert.Equal(t, aliceS.Offers(), loaded.Offers())
+	assert.Equal(t, aliceS.offered, loaded.offered)
+	loaded.Extend, loaded.Transport = aliceS.Extend, aliceS.Transport
+	assert.NoError(t, loaded.Send([]byte("Hi Bob")))
+	assert.Equal(t, []byte("Hi Bob"), receive(t, bob, bobS))
+
+	assert.NoError(t, loaded.Close())
+	_, err = Load("bob", alice.Manager, aliceS.Keystore)
+	assert.Equal(t, ErrNoState, err)
+}
+
+func TestSessionLoadNewManager(t *testing.T) {
+	_, alice, aliceS, bob, bobS := setupSessions(t)
+	assert.NoError(t, bobS.Send([]byte("Hi Alice")))
+	receive(t, alice, aliceS)
+
+	// the routes offered to Bob are lost with the RouteManager
+	loaded, err := Load("bob", alice.ManageRoutes(2, 2, time.Hour), aliceS.Keystore)
+	assert.NoError(t, err)
+	assert.Len(t, loaded.offered, 0)
+	assert.Equal(t, aliceS.Offers(), loaded.Offers())
+
+	// sending offers new routes so Bob can reply
+	loaded.Extend, loaded.Transport = aliceS.Extend, aliceS.Transport
+	assert.NoError(t, loaded.Send([]byte("Hi Bob")))
+	assert.Equal(t, []byte("Hi Bob"), receive(t, bob, bobS))
+	assert.NoError(t, bobS.Send([]byte("Hi Alice")))
+	assert.Equal(t, []byte("Hi Alice"), receive(t, alice, loaded))
+}
+
+func TestLoadBadState(t *testing.T) {
+	_, alice, aliceS, _, _ := setupSessions(t)
+	for _, st := range []*state{
+		{},
+		{Offers: [][]byte{{}}, Ratchet: aliceS.ratchet.state()},
+		{Offers: [][]byte{{}}, Received: []time.Time{{}}, Ratchet: aliceS.ratchet.state()},
+	} {
+		buf := &bytes.Buffer{}
+		assert.NoError(t, gob.NewEncoder(buf).Encode(st))
+		assert.NoError(t, aliceS.Keystore.Save("bob", buf.Bytes()))
+		_, err := Load("bob", alice.Manager, aliceS.Keystore)
+		assert.Equal(t, ErrBadState, err)
+	}
+}
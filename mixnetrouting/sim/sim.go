@@ -0,0 +1,274 @@
+package sim
+
+import (
+	"encoding/base64"
+	"github.com/dist-ribut-us/docs/mixnetrouting/bridge"
+	"github.com/dist-ribut-us/docs/mixnetrouting/dht"
+	"github.com/dist-ribut-us/docs/mixnetrouting/memnet"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/dist-ribut-us/docs/mixnetrouting/path"
+	"github.com/dist-ribut-us/errors"
+	"sync"
+	"time"
+)
+
+// ErrBadRequest is returned when a node receives a request it cannot parse
+const ErrBadRequest errors.String = "Bad request"
+
+const (
+	kindDHT byte = iota
+	kindRoute
+	kindBatch
+)
+
+var encode = base64.URLEncoding.EncodeToString
+
+// Sim is a network of overlay nodes running on memnet. Each node is an onion
+// PrivNode and a DHT node sharing the same ID, and the ID is also its memnet
+// address. Requests are delivered synchronously, so sending a RoutePackage
+// returns once it has been delivered or dropped, and any error along the
+// route is returned to the sender to make simulations easy to follow.
+type Sim struct {
+	Net      *memnet.Network
+	Nodes    []*Node
+	Selector *path.Selector
+	byID     map[string]*Node
+}
+
+// Node is an overlay node in the simulation. If Manager is set, it handles
+// deliveries so that messages on revoked routes are dropped. If Bridge is set,
+// low-urgency messages to bridge peers are held and piggyback on other
+// traffic to the peer. If Freeload is set, the node accepts routed messages
+// but never forwards them. If the PrivNode has a Blacklist, routed messages
+// from blocked nodes are refused as well as forwards to them.
+type Node struct {
+	*onion.PrivNode
+	DHT      *dht.Node
+	Endpoint *memnet.Endpoint
+	Manager  *onion.RouteManager
+	Bridge   *bridge.Holder
+	Freeload bool
+	sim      *Sim
+	mux      sync.Mutex
+	inbox    []*onion.Delivery
+}
+
+// New creates a Sim with size nodes that have all joined the DHT.
+func New(size int) (*Sim, error) {
+	s := &Sim{
+		Net:      memnet.New(),
+		Selector: path.NewSelector(),
+		byID:     make(map[string]*Node, size),
+	}
+	for i := 0; i < size; i++ {
+		n, err := s.Add()
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			if err = n.DHT.Join(s.Nodes[0].Endpoint.Addr()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+// Add a node to the simulation. It does not join the DHT.
+func (s *Sim) Add() (*Node, error) {
+	n := &Node{
+		PrivNode: onion.NewPrivNode(),
+		sim:      s,
+	}
+	ep, err := s.Net.Listen(n.String(), n.handle)
+	if err != nil {
+		return nil, err
+	}
+	n.Endpoint = ep
+	n.DHT, err = dht.New(n.ID, ep.Addr(), dhtTransport{ep})
+	if err != nil {
+		return nil, err
+	}
+	n.OnMessage = n.receive
+	s.Nodes = append(s.Nodes, n)
+	s.byID[n.String()] = n
+	return n, nil
+}
+
+// Node returns the node with the given ID or nil
+func (s *Sim) Node(id []byte) *Node {
+	return s.byID[encode(id)]
+}
+
+// Directory returns every node in the simulation
+func (s *Sim) Directory() path.Directory {
+	dir := make(path.Directory, len(s.Nodes))
+	for i, n := range s.Nodes {
+		dir[i] = &path.Node{
+			Pub: n.Pub(),
+		}
+	}
+	return dir
+}
+
+// Hops returns a function that selects hops for a RouteManager, avoiding the
+// node the routes lead to.
+func (s *Sim) Hops(n *Node, hops int) func() ([]*onion.PubNode, error) {
+	return func() ([]*onion.PubNode, error) {
+		return s.selectHops(hops, n.String())
+	}
+}
+
+// ProbeHops returns a function that selects hops for a probe.Prober running on
+// the node, avoiding the node and the suspect.
+func (s *Sim) ProbeHops(n *Node) func(*onion.PubNode, int) ([]*onion.PubNode, error) {
+	return func(suspect *onion.PubNode, hops int) ([]*onion.PubNode, error) {
+		return s.selectHops(hops, n.String(), suspect.String())
+	}
+}
+
+func (s *Sim) selectHops(hops int, avoid ...string) ([]*onion.PubNode, error) {
+	sel := path.NewSelection()
+	sel.Avoid(avoid...)
+	if err := s.Selector.Select(s.Directory(), hops, sel); err != nil {
+		return nil, err
+	}
+	pubs := make([]*onion.PubNode, len(sel.Hops))
+	for i, h := range sel.Hops {
+		pubs[i] = h.Pub.(*onion.PubNode)
+	}
+	return pubs, nil
+}
+
+// Extend pushes hops onto a send route
+func (s *Sim) Extend(rb *onion.RouteBuilder, hops int) error {
+	_, err := s.Selector.Onion(rb, s.Directory(), hops, nil)
+	return err
+}
+
+// ManageRoutes gives the node a RouteManager that builds routes through the
+// simulation.
+func (n *Node) ManageRoutes(target, hops int, ttl time.Duration) *onion.RouteManager {
+	n.Manager = onion.NewRouteManager(n.PrivNode, target, ttl, n.sim.Hops(n, hops))
+	return n.Manager
+}
+
+// Send a RoutePackage to the next node on its route. Any messages held for the
+// next node are sent with it.
+func (n *Node) Send(rp *onion.RoutePackage) error {
+	var req []byte
+	var held []*onion.RouteMsg
+	if n.Bridge != nil {
+		held = n.Bridge.Piggyback(rp.Next)
+	}
+	if len(held) == 0 {
+		req = append([]byte{kindRoute}, rp.RouteMsg.Marshal()...)
+	} else {
+		batch := append([]*onion.RouteMsg{rp.RouteMsg}, held...)
+		req = append([]byte{kindBatch}, bridge.MarshalBatch(batch)...)
+	}
+	_, err := n.Endpoint.Request(encode(rp.Next), req)
+	return err
+}
+
+// SendDue sends the held messages that are due on their own
+func (n *Node) SendDue() error {
+	if n.Bridge == nil {
+		return nil
+	}
+	var err error
+	for _, h := range n.Bridge.Due() {
+		serr := n.Send(&onion.RoutePackage{
+			RouteMsg: h.RouteMsg,
+			Next:     h.Next,
+		})
+		if err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// Inbox returns and clears the messages delivered to the node
+func (n *Node) Inbox() []*onion.Delivery {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	in := n.inbox
+	n.inbox = nil
+	return in
+}
+
+func (n *Node) receive(d *onion.Delivery) {
+	n.mux.Lock()
+	n.inbox = append(n.inbox, d)
+	n.mux.Unlock()
+}
+
+func (n *Node) handle(from string, req []byte) ([]byte, error) {
+	if len(req) == 0 {
+		return nil, ErrBadRequest
+	}
+	if req[0] == kindDHT {
+		return n.DHT.Handle(from, req[1:])
+	}
+	if n.Blacklist != nil && n.Blacklist.Blocked(from) {
+		return nil, onion.ErrBlocked{}
+	}
+	switch req[0] {
+	case kindRoute:
+		rm, err := onion.UnmarshalRouteMsg(req[1:])
+		if err != nil {
+			return nil, err
+		}
+		return nil, n.route(rm)
+	case kindBatch:
+		rms, err := bridge.UnmarshalBatch(req[1:])
+		if err != nil {
+			return nil, err
+		}
+		for _, rm := range rms {
+			if rerr := n.route(rm); err == nil {
+				err = rerr
+			}
+		}
+		return nil, err
+	}
+	return nil, ErrBadRequest
+}
+
+func (n *Node) route(rm *onion.RouteMsg) error {
+	rp := &onion.RoutePackage{
+		RouteMsg: rm,
+	}
+	var d *onion.Delivery
+	var err error
+	if n.Manager != nil {
+		d, err = n.Manager.Deliver(rp)
+	} else {
+		d, err = n.Deliver(rp)
+	}
+	if err != nil {
+		return err
+	}
+	if d.Forward {
+		if n.Freeload {
+			return nil
+		}
+		if n.Bridge != nil && n.Bridge.Hold(d, rp.RouteMsg) {
+			return nil
+		}
+		rp.Next = d.Next
+		return n.Send(rp)
+	}
+	return nil
+}
+
+// dhtTransport marks requests so the node can tell DHT traffic from routed
+// traffic.
+type dhtTransport struct {
+	ep *memnet.Endpoint
+}
+
+func (t dhtTransport) Request(to string, req []byte) ([]byte, error) {
+	return t.ep.Request(to, append([]byte{kindDHT}, req...))
+}
@@ -0,0 +1,98 @@
+package sim
+
+import (
+	"github.com/dist-ribut-us/docs/mixnetrouting/bridge"
+	"github.com/dist-ribut-us/docs/mixnetrouting/onion"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSim(t *testing.T) {
+	s, err := New(30)
+	assert.NoError(t, err)
+	bob := s.Nodes[3]
+	alice := s.Nodes[17]
+
+	m := bob.ManageRoutes(2, 3, time.Minute)
+	fresh, err := m.Fresh()
+	assert.NoError(t, err)
+	assert.Len(t, fresh, 2)
+
+	rb := fresh[0].Offer.Copy()
+	assert.NoError(t, s.Extend(rb, 3))
+	msg := []byte("Hi Bob")
+	assert.NoError(t, alice.Send(rb.Send(msg)))
+
+	in := bob.Inbox()
+	if assert.Len(t, in, 1) {
+		assert.Equal(t, msg, in[0].Msg)
+		assert.Equal(t, fresh[0].ID, in[0].RouteID)
+	}
+	assert.Len(t, bob.Inbox(), 0)
+	assert.Equal(t, 1, m.Route(fresh[0].ID).Uses)
+	assert.Equal(t, bob, s.Node(bob.ID))
+
+	// the DHT is shared with routing
+	assert.NoError(t, alice.DHT.Put(bob.ID, bob.Pub().Marshal(), time.Minute))
+	vs, err := s.Nodes[0].DHT.Get(bob.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{bob.Pub().Marshal()}, vs)
+}
+
+func TestBridge(t *testing.T) {
+	s, err := New(30)
+	assert.NoError(t, err)
+	a, b, bob, carol := s.Nodes[1], s.Nodes[2], s.Nodes[3], s.Nodes[4]
+
+	d := &bridge.Descriptor{
+		A:       a.Pub(),
+		B:       b.Pub(),
+		Expires: time.Now().Add(time.Hour),
+	}
+	assert.NoError(t, bridge.Publish(a.DHT, d))
+	a.Bridge = bridge.NewHolder()
+	a.Bridge.Add(d)
+
+	// Carol finds the bridge and crosses it on her way to Bob
+	ds, err := bridge.Find(carol.DHT, a.ID)
+	assert.NoError(t, err)
+	assert.Len(t, ds, 1)
+	fresh, err := bob.ManageRoutes(1, 2, time.Hour).Fresh()
+	assert.NoError(t, err)
+	rb := fresh[0].Offer.Copy()
+	assert.NoError(t, s.Extend(rb, 1))
+	assert.NoError(t, ds[0].Push(rb))
+	assert.NoError(t, s.Extend(rb, 1))
+	msg := []byte("low urgency")
+	assert.NoError(t, carol.Send(rb.Send(msg)))
+
+	// The message is held by a
+	assert.Len(t, bob.Inbox(), 0)
+	assert.Equal(t, 1, a.Bridge.Len(b.ID))
+
+	// until a sends to b
+	direct := onion.NewSendRoute()
+	direct.BaseKey = b.Pub().Key
+	assert.NoError(t, direct.Push(b.Pub()))
+	assert.NoError(t, a.Send(direct.Send([]byte("Hi b"))))
+	in := b.Inbox()
+	if assert.Len(t, in, 1) {
+		assert.Equal(t, []byte("Hi b"), in[0].Msg)
+	}
+	in = bob.Inbox()
+	if assert.Len(t, in, 1) {
+		assert.Equal(t, msg, in[0].Msg)
+	}
+	assert.Equal(t, 0, a.Bridge.Len(b.ID))
+
+	// Messages that wait too long are sent on their own
+	rb = fresh[0].Offer.Copy()
+	assert.NoError(t, s.Extend(rb, 1))
+	assert.NoError(t, ds[0].Push(rb))
+	assert.NoError(t, carol.Send(rb.Send(msg)))
+	assert.Equal(t, 1, a.Bridge.Len(b.ID))
+	a.Bridge.MaxHold = 0
+	assert.NoError(t, a.SendDue())
+	assert.Len(t, bob.Inbox(), 1)
+}
@@ -0,0 +1,17 @@
+package sizeclass
+
+// Classes are the lengths that messages are padded to by both the onion and
+// cyclic schemes and the classes a node advertises in its descriptor. Messages
+// longer than the largest class are rounded up to a multiple of it.
+var Classes = []int{4096, 8192, 16384, 32768, 65536}
+
+// Of returns the padded length for a message of length ln
+func Of(ln int) int {
+	for _, c := range Classes {
+		if ln <= c {
+			return c
+		}
+	}
+	max := Classes[len(Classes)-1]
+	return ((ln + max - 1) / max) * max
+}
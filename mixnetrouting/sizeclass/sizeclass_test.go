@@ -0,0 +1,13 @@
+package sizeclass
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestOf(t *testing.T) {
+	assert.Equal(t, 4096, Of(0))
+	assert.Equal(t, 4096, Of(4096))
+	assert.Equal(t, 8192, Of(4097))
+	assert.Equal(t, 2*65536, Of(65537))
+}